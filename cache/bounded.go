@@ -0,0 +1,479 @@
+package cache
+
+import (
+	"container/heap"
+	"hash/fnv"
+	"reflect"
+	"sync"
+	"sync/atomic"
+	"time"
+)
+
+// EvictionPolicy chooses the items a BoundedStore evicts when full.
+type EvictionPolicy int
+
+const (
+	// LRU evicts the least recently used items first.
+	LRU EvictionPolicy = iota
+	// LFU evicts the least frequently used items first, the least recently
+	// used among those equally used.
+	LFU
+)
+
+const (
+	defaultBoundedShards = 16
+
+	// boundedSweepInterval is how often a shard drops its expired items
+	// when it is written to.
+	boundedSweepInterval = time.Minute
+)
+
+// BoundedStore is an in-memory store holding a limited number of items, or
+// of bytes, evicting the others. Like InMemoryStore, it keeps the values as
+// they are rather than serializing them.
+//
+// The keys are spread over shards locked independently, each holding an
+// equal part of the limits.
+type BoundedStore struct {
+	// Accessed atomically, first to be 64-bit aligned.
+	hits      uint64
+	misses    uint64
+	evictions uint64
+
+	defaultExpiration time.Duration
+	shards            []*boundedShard
+}
+
+// BoundedOptions holds the settings of a BoundedStore.
+type BoundedOptions struct {
+	// MaxEntries is the maximum number of items, unlimited if zero.
+	MaxEntries int
+
+	// MaxBytes is the maximum size of the keys and values, unlimited if
+	// zero. Sizes are estimated from the memory they use; items larger than
+	// a shard can hold are not stored.
+	MaxBytes int64
+
+	// Policy chooses the items evicted first. It defaults to LRU.
+	Policy EvictionPolicy
+
+	// Shards is the number of shards, 16 by default. It is lowered so that
+	// every shard may hold at least one item.
+	Shards int
+}
+
+// BoundedStats counts the lookups and the evictions of a BoundedStore.
+type BoundedStats struct {
+	Hits      uint64
+	Misses    uint64
+	Evictions uint64
+}
+
+func NewBoundedStore(defaultExpiration time.Duration, options BoundedOptions) *BoundedStore {
+	n := options.Shards
+	if n <= 0 {
+		n = defaultBoundedShards
+	}
+	if options.MaxEntries > 0 && n > options.MaxEntries {
+		n = options.MaxEntries
+	}
+	c := &BoundedStore{defaultExpiration: defaultExpiration, shards: make([]*boundedShard, n)}
+	for i := range c.shards {
+		// Spread the remainders so that the limits of the shards add up.
+		s := &boundedShard{
+			policy: options.Policy,
+			items:  make(map[string]*boundedItem),
+			order:  boundedOrder{policy: options.Policy},
+		}
+		if options.MaxEntries > 0 {
+			s.maxEntries = options.MaxEntries / n
+			if i < options.MaxEntries%n {
+				s.maxEntries++
+			}
+		}
+		if options.MaxBytes > 0 {
+			s.maxBytes = options.MaxBytes / int64(n)
+			if int64(i) < options.MaxBytes%int64(n) {
+				s.maxBytes++
+			}
+		}
+		c.shards[i] = s
+	}
+	return c
+}
+
+// Stats returns the counters of the store since it was created.
+func (c *BoundedStore) Stats() BoundedStats {
+	return BoundedStats{
+		Hits:      atomic.LoadUint64(&c.hits),
+		Misses:    atomic.LoadUint64(&c.misses),
+		Evictions: atomic.LoadUint64(&c.evictions),
+	}
+}
+
+func (c *BoundedStore) Get(key string, value interface{}) error {
+	val, found := c.getValue(key)
+	if !found {
+		return ErrCacheMiss
+	}
+
+	v := reflect.ValueOf(value)
+	if v.Type().Kind() != reflect.Ptr || !v.Elem().CanSet() {
+		return ErrNotStored
+	}
+	if val == nil {
+		v.Elem().Set(reflect.Zero(v.Elem().Type()))
+		return nil
+	}
+	if !reflect.TypeOf(val).AssignableTo(v.Elem().Type()) {
+		return ErrNotStored
+	}
+	v.Elem().Set(reflect.ValueOf(val))
+	return nil
+}
+
+// getValue returns the value of key as stored, without reflection.
+func (c *BoundedStore) getValue(key string) (interface{}, bool) {
+	s := c.shard(key)
+	s.Lock()
+	item := s.lookup(key, time.Now())
+	var val interface{}
+	if item != nil {
+		s.touch(item)
+		val = item.value
+	}
+	s.Unlock()
+	if item == nil {
+		atomic.AddUint64(&c.misses, 1)
+		return nil, false
+	}
+	atomic.AddUint64(&c.hits, 1)
+	return val, true
+}
+
+func (c *BoundedStore) Set(key string, value interface{}, expires time.Duration) error {
+	return c.store(key, value, expires, func(found bool) bool { return true })
+}
+
+func (c *BoundedStore) Add(key string, value interface{}, expires time.Duration) error {
+	return c.store(key, value, expires, func(found bool) bool { return !found })
+}
+
+func (c *BoundedStore) Replace(key string, value interface{}, expires time.Duration) error {
+	return c.store(key, value, expires, func(found bool) bool { return found })
+}
+
+func (c *BoundedStore) Delete(key string) error {
+	s := c.shard(key)
+	s.Lock()
+	defer s.Unlock()
+	item := s.lookup(key, time.Now())
+	if item == nil {
+		return ErrCacheMiss
+	}
+	s.remove(item)
+	return nil
+}
+
+func (c *BoundedStore) Increment(key string, delta uint64) (uint64, error) {
+	return c.count(key, func(n uint64) uint64 { return n + delta })
+}
+
+func (c *BoundedStore) Decrement(key string, delta uint64) (uint64, error) {
+	return c.count(key, func(n uint64) uint64 {
+		if delta > n {
+			return 0
+		}
+		return n - delta
+	})
+}
+
+func (c *BoundedStore) Flush() error {
+	for _, s := range c.shards {
+		s.Lock()
+		s.items = make(map[string]*boundedItem)
+		s.order = boundedOrder{policy: s.policy}
+		s.bytes = 0
+		s.Unlock()
+	}
+	return nil
+}
+
+// store sets key if ok returns true given whether key exists.
+func (c *BoundedStore) store(key string, value interface{}, expires time.Duration, ok func(found bool) bool) error {
+	now := time.Now()
+	switch expires {
+	case DEFAULT:
+		expires = c.defaultExpiration
+	case FOREVER:
+		expires = time.Duration(0)
+	}
+	item := &boundedItem{key: key, value: value, size: sizeOf(key) + sizeOf(value)}
+	if expires > 0 {
+		item.expires = now.Add(expires)
+	}
+
+	s := c.shard(key)
+	s.Lock()
+	defer s.Unlock()
+	s.sweep(now)
+	old := s.lookup(key, now)
+	if !ok(old != nil) {
+		return ErrNotStored
+	}
+	if s.maxBytes > 0 && item.size > s.maxBytes {
+		if old != nil {
+			s.remove(old)
+		}
+		return ErrNotStored
+	}
+	if old != nil {
+		item.hits = old.hits
+		s.remove(old)
+	}
+	// Evicting before adding the item, or LFU would always evict it.
+	evicted := s.evict(1, item.size)
+	atomic.AddUint64(&c.evictions, uint64(evicted))
+	s.add(item)
+	return nil
+}
+
+// count updates the integer at key with f, keeping its type.
+func (c *BoundedStore) count(key string, f func(uint64) uint64) (uint64, error) {
+	s := c.shard(key)
+	s.Lock()
+	defer s.Unlock()
+	item := s.lookup(key, time.Now())
+	if item == nil {
+		return 0, ErrCacheMiss
+	}
+	v := reflect.New(reflect.TypeOf(item.value)).Elem()
+	v.Set(reflect.ValueOf(item.value))
+	var n uint64
+	switch v.Kind() {
+	case reflect.Int, reflect.Int8, reflect.Int16, reflect.Int32, reflect.Int64:
+		n = f(uint64(v.Int()))
+		v.SetInt(int64(n))
+	case reflect.Uint, reflect.Uint8, reflect.Uint16, reflect.Uint32, reflect.Uint64, reflect.Uintptr:
+		n = f(v.Uint())
+		v.SetUint(n)
+	default:
+		return 0, ErrNotSupport
+	}
+	item.value = v.Interface()
+	s.touch(item)
+	return n, nil
+}
+
+func (c *BoundedStore) shard(key string) *boundedShard {
+	if len(c.shards) == 1 {
+		return c.shards[0]
+	}
+	h := fnv.New32a()
+	h.Write([]byte(key))
+	return c.shards[h.Sum32()%uint32(len(c.shards))]
+}
+
+type boundedItem struct {
+	key     string
+	value   interface{}
+	size    int64
+	expires time.Time
+
+	// hits and used order the items for eviction, index is their position
+	// in the order.
+	hits  uint64
+	used  uint64
+	index int
+}
+
+type boundedShard struct {
+	sync.Mutex
+	policy     EvictionPolicy
+	maxEntries int
+	maxBytes   int64
+
+	items     map[string]*boundedItem
+	order     boundedOrder
+	bytes     int64
+	clock     uint64
+	nextSweep time.Time
+}
+
+// lookup returns the item of key, dropping it if it expired.
+func (s *boundedShard) lookup(key string, now time.Time) *boundedItem {
+	item := s.items[key]
+	if item == nil {
+		return nil
+	}
+	if !item.expires.IsZero() && !now.Before(item.expires) {
+		s.remove(item)
+		return nil
+	}
+	return item
+}
+
+// touch records a use of item.
+func (s *boundedShard) touch(item *boundedItem) {
+	s.clock++
+	item.used = s.clock
+	item.hits++
+	heap.Fix(&s.order, item.index)
+}
+
+func (s *boundedShard) add(item *boundedItem) {
+	s.clock++
+	item.used = s.clock
+	item.hits++
+	s.items[item.key] = item
+	heap.Push(&s.order, item)
+	s.bytes += item.size
+}
+
+func (s *boundedShard) remove(item *boundedItem) {
+	delete(s.items, item.key)
+	heap.Remove(&s.order, item.index)
+	s.bytes -= item.size
+}
+
+// evict removes items until the shard has room for entries more items of
+// bytes in total, returning how many it removed.
+func (s *boundedShard) evict(entries int, bytes int64) int {
+	n := 0
+	for len(s.order.items) > 0 &&
+		((s.maxEntries > 0 && len(s.items)+entries > s.maxEntries) || (s.maxBytes > 0 && s.bytes+bytes > s.maxBytes)) {
+		s.remove(s.order.items[0])
+		n++
+	}
+	return n
+}
+
+// sweep drops the expired items once in a while.
+func (s *boundedShard) sweep(now time.Time) {
+	if now.Before(s.nextSweep) {
+		return
+	}
+	s.nextSweep = now.Add(boundedSweepInterval)
+	for key := range s.items {
+		s.lookup(key, now)
+	}
+}
+
+// boundedOrder is a heap of items, the next one to evict first.
+type boundedOrder struct {
+	policy EvictionPolicy
+	items  []*boundedItem
+}
+
+func (o boundedOrder) Len() int { return len(o.items) }
+
+func (o boundedOrder) Less(i, j int) bool {
+	a, b := o.items[i], o.items[j]
+	if o.policy == LFU && a.hits != b.hits {
+		return a.hits < b.hits
+	}
+	return a.used < b.used
+}
+
+func (o boundedOrder) Swap(i, j int) {
+	o.items[i], o.items[j] = o.items[j], o.items[i]
+	o.items[i].index = i
+	o.items[j].index = j
+}
+
+func (o *boundedOrder) Push(x interface{}) {
+	item := x.(*boundedItem)
+	item.index = len(o.items)
+	o.items = append(o.items, item)
+}
+
+func (o *boundedOrder) Pop() interface{} {
+	n := len(o.items) - 1
+	item := o.items[n]
+	o.items[n] = nil
+	o.items = o.items[:n]
+	return item
+}
+
+// sizeOf estimates the memory used by value, counting the memory it points
+// to once.
+func sizeOf(value interface{}) int64 {
+	if value == nil {
+		return 0
+	}
+	v := reflect.ValueOf(value)
+	return int64(v.Type().Size()) + sizeOfReferenced(v, make(map[uintptr]bool))
+}
+
+var locationType = reflect.TypeOf(time.Location{})
+
+// sizeOfReferenced returns the size of the memory v points to. Time zones
+// are shared and not counted.
+func sizeOfReferenced(v reflect.Value, seen map[uintptr]bool) int64 {
+	switch v.Kind() {
+	case reflect.Ptr:
+		if v.IsNil() || seen[v.Pointer()] || v.Type().Elem() == locationType {
+			return 0
+		}
+		seen[v.Pointer()] = true
+		return int64(v.Elem().Type().Size()) + sizeOfReferenced(v.Elem(), seen)
+	case reflect.Interface:
+		if v.IsNil() {
+			return 0
+		}
+		return int64(v.Elem().Type().Size()) + sizeOfReferenced(v.Elem(), seen)
+	case reflect.String:
+		return int64(v.Len())
+	case reflect.Slice:
+		if v.IsNil() || seen[v.Pointer()] {
+			return 0
+		}
+		seen[v.Pointer()] = true
+		size := int64(v.Cap()) * int64(v.Type().Elem().Size())
+		for i := 0; i < v.Len() && references(v.Type().Elem()); i++ {
+			size += sizeOfReferenced(v.Index(i), seen)
+		}
+		return size
+	case reflect.Array:
+		var size int64
+		for i := 0; i < v.Len() && references(v.Type().Elem()); i++ {
+			size += sizeOfReferenced(v.Index(i), seen)
+		}
+		return size
+	case reflect.Map:
+		if v.IsNil() || seen[v.Pointer()] {
+			return 0
+		}
+		seen[v.Pointer()] = true
+		t := v.Type()
+		size := int64(v.Len()) * int64(t.Key().Size()+t.Elem().Size())
+		for _, k := range v.MapKeys() {
+			size += sizeOfReferenced(k, seen) + sizeOfReferenced(v.MapIndex(k), seen)
+		}
+		return size
+	case reflect.Struct:
+		var size int64
+		for i := 0; i < v.NumField(); i++ {
+			size += sizeOfReferenced(v.Field(i), seen)
+		}
+		return size
+	}
+	return 0
+}
+
+// references reports whether values of type t may point to memory.
+func references(t reflect.Type) bool {
+	switch t.Kind() {
+	case reflect.Ptr, reflect.Interface, reflect.String, reflect.Slice, reflect.Map:
+		return true
+	case reflect.Array:
+		return references(t.Elem())
+	case reflect.Struct:
+		for i := 0; i < t.NumField(); i++ {
+			if references(t.Field(i).Type) {
+				return true
+			}
+		}
+	}
+	return false
+}
@@ -0,0 +1,139 @@
+package cache
+
+import (
+	"fmt"
+	"strings"
+	"testing"
+	"time"
+)
+
+var newBoundedStore = func(_ *testing.T, defaultExpiration time.Duration) CacheStore {
+	return NewBoundedStore(defaultExpiration, BoundedOptions{MaxEntries: 1000})
+}
+
+func TestBoundedCache_TypicalGetSet(t *testing.T) {
+	typicalGetSet(t, newBoundedStore)
+}
+
+func TestBoundedCache_IncrDecr(t *testing.T) {
+	incrDecr(t, newBoundedStore)
+}
+
+func TestBoundedCache_Expiration(t *testing.T) {
+	expiration(t, newBoundedStore)
+}
+
+func TestBoundedCache_EmptyCache(t *testing.T) {
+	emptyCache(t, newBoundedStore)
+}
+
+func TestBoundedCache_Replace(t *testing.T) {
+	testReplace(t, newBoundedStore)
+}
+
+func TestBoundedCache_Add(t *testing.T) {
+	testAdd(t, newBoundedStore)
+}
+
+func TestBoundedCache_Concurrency(t *testing.T) {
+	concurrency(t, newBoundedStore)
+}
+
+func TestBoundedCache_CachePage(t *testing.T) {
+	cachePage(t, NewBoundedStore(time.Hour, BoundedOptions{MaxBytes: 1 << 20}))
+}
+
+// present returns the keys of store among keys.
+func present(store CacheStore, keys ...string) string {
+	var found []string
+	for _, key := range keys {
+		var value interface{}
+		if store.Get(key, &value) == nil {
+			found = append(found, key)
+		}
+	}
+	return strings.Join(found, " ")
+}
+
+func TestBoundedCache_LRU(t *testing.T) {
+	store := NewBoundedStore(time.Hour, BoundedOptions{MaxEntries: 3, Shards: 1})
+	store.Set("a", 1, DEFAULT)
+	store.Set("b", 2, DEFAULT)
+	store.Set("c", 3, DEFAULT)
+	var value int
+	store.Get("a", &value)
+	store.Set("d", 4, DEFAULT)
+	if keys := present(store, "a", "b", "c", "d"); keys != "a c d" {
+		t.Errorf("Expected b to be evicted, got %q", keys)
+	}
+	if stats := store.Stats(); stats.Evictions != 1 || stats.Hits != 4 || stats.Misses != 1 {
+		t.Errorf("Expected 1 eviction, 4 hits and 1 miss, got %+v", stats)
+	}
+}
+
+func TestBoundedCache_LFU(t *testing.T) {
+	store := NewBoundedStore(time.Hour, BoundedOptions{MaxEntries: 3, Shards: 1, Policy: LFU})
+	store.Set("a", 1, DEFAULT)
+	store.Set("b", 2, DEFAULT)
+	store.Set("c", 3, DEFAULT)
+	var value int
+	store.Get("a", &value)
+	store.Get("a", &value)
+	store.Get("b", &value)
+	store.Get("c", &value)
+	store.Get("c", &value)
+	store.Set("d", 4, DEFAULT)
+	if keys := present(store, "a", "b", "c", "d"); keys != "a c d" {
+		t.Errorf("Expected b to be evicted, got %q", keys)
+	}
+}
+
+func TestBoundedCache_MaxBytes(t *testing.T) {
+	store := NewBoundedStore(time.Hour, BoundedOptions{MaxBytes: 10000, Shards: 1})
+	for i := 0; i < 10; i++ {
+		if err := store.Set(fmt.Sprint(i), strings.Repeat("x", 2000), DEFAULT); err != nil {
+			t.Fatalf("Error setting a value: %s", err)
+		}
+	}
+	if keys := present(store, "0", "5", "6", "7", "8", "9"); keys != "6 7 8 9" {
+		t.Errorf("Expected the last 4 values to fit, got %q", keys)
+	}
+	if err := store.Set("large", strings.Repeat("x", 20000), DEFAULT); err != ErrNotStored {
+		t.Errorf("Expected ErrNotStored for a value larger than the store, got %v", err)
+	}
+	if store.Stats().Evictions != 6 {
+		t.Errorf("Expected 6 evictions, got %+v", store.Stats())
+	}
+}
+
+func TestBoundedCache_Shards(t *testing.T) {
+	store := NewBoundedStore(time.Hour, BoundedOptions{MaxEntries: 100})
+	for i := 0; i < 1000; i++ {
+		store.Set(fmt.Sprint(i), i, DEFAULT)
+	}
+	total := 0
+	for _, s := range store.shards {
+		if len(s.items) > s.maxEntries {
+			t.Errorf("Expected at most %d items in a shard, got %d", s.maxEntries, len(s.items))
+		}
+		total += len(s.items)
+	}
+	if total != 100 {
+		t.Errorf("Expected 100 items, got %d", total)
+	}
+
+	// Small limits lower the number of shards.
+	if n := len(NewBoundedStore(time.Hour, BoundedOptions{MaxEntries: 3}).shards); n != 3 {
+		t.Errorf("Expected 3 shards, got %d", n)
+	}
+}
+
+func TestSizeOf(t *testing.T) {
+	if size := sizeOf(strings.Repeat("x", 100)); size != 116 {
+		t.Errorf("Expected 116 bytes for a string of 100 bytes, got %d", size)
+	}
+	page := responseCache{data: make([]byte, 1000), date: time.Now()}
+	if size := sizeOf(page); size < 1000 || size > 1500 {
+		t.Errorf("Expected a bit more than 1000 bytes for a page, got %d", size)
+	}
+}
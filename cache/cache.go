@@ -8,6 +8,8 @@ import (
 	"io"
 	"net/http"
 	"net/url"
+	"strconv"
+	"sync"
 	"time"
 )
 
@@ -35,19 +37,112 @@ type CacheStore interface {
 	Flush() error
 }
 
-type responseCache struct {
-	status int
-	header http.Header
-	data   []byte
+// Options holds the optional settings of SiteCache and CachePage.
+// The zero value is ready to use.
+type Options struct {
+	// MaxBodySize is the largest response body, in bytes, that will be kept
+	// in the store. Bigger responses are still sent to the client but are not
+	// cached. Zero means no limit.
+	MaxBodySize int
+
+	// KeyFunc computes the part of the cache key identifying the request.
+	// It is always prefixed with PageCachePrefix, and followed by the values of
+	// the request headers listed in the Vary header set by the middlewares
+	// running before the cache. Default value is DefaultKey.
+	KeyFunc KeyFunc
+
+	// Methods lists the request methods whose responses may be cached.
+	// Default value is GET and HEAD.
+	Methods []string
+
+	// Statuses lists the response status codes that may be cached. Default
+	// value is the codes cacheable by default per RFC 7231, except 206.
+	Statuses []int
+
+	// StripSetCookie caches responses setting cookies with their Set-Cookie
+	// headers removed. By default such responses are not cached at all so
+	// that a user's session is never replayed to others.
+	StripSetCookie bool
+
+	// StaleWhileRevalidate is how long an expired page may still be served
+	// while a single background request refreshes it. Zero disables it.
+	// It has no effect on pages cached with DEFAULT or FOREVER expiration.
+	StaleWhileRevalidate time.Duration
+
+	// StaleIfError is how long an expired page may still be served in place
+	// of a response with a 5xx status or a panic from the handler. Zero
+	// disables it. It has no effect on pages cached with DEFAULT or FOREVER
+	// expiration.
+	StaleIfError time.Duration
+
+	// Coalesce runs the handler only once for concurrent misses on the same
+	// key within the process, the other requests waiting for its response.
+	// Requests whose response turns out not to be cacheable are handled
+	// separately.
+	Coalesce bool
+
+	// LockTTL, when set along with Coalesce, also coalesces misses across
+	// processes sharing the store: a lock is taken with the store's Add
+	// before running the handler, and other processes wait up to LockTTL for
+	// the page to be stored. It is rounded up to whole seconds.
+	LockTTL time.Duration
+
+	// InvalidateByPrefix records the path of cached pages so that they can be
+	// evicted with InvalidatePrefix. It costs a store lookup per path segment
+	// on every hit.
+	InvalidateByPrefix bool
+
+	// Logger is called with the errors of the store that cannot be reported
+	// to the client, such as a page failing to be stored or looked up, and
+	// with the panics of the handler recovered to serve a stale page, along
+	// with the key of the page. They are ignored by default.
+	Logger func(c *gin.Context, key string, err error)
+
+	// GzipLevel, when not zero, stores along with each page a variant
+	// compressed with gzip at this level, such as gzip.DefaultCompression,
+	// served to the clients accepting it. Pages compressed by the handler
+	// are always stored with their gzip variant.
+	GzipLevel int
+}
+
+// logError reports err to the Logger, if any. Misses are not errors.
+func (o Options) logError(c *gin.Context, key string, err error) {
+	if err != nil && err != ErrCacheMiss && o.Logger != nil {
+		o.Logger(c, key, err)
+	}
+}
+
+// key returns the key of the page for c. It includes the values of the
+// request headers listed in the Vary header already set by the middlewares
+// running before the cache, such as cors.
+func (o Options) key(c *gin.Context) string {
+	keyFunc := o.KeyFunc
+	if keyFunc == nil {
+		keyFunc = DefaultKey
+	}
+	return urlEscape(PageCachePrefix, keyFunc(c)+varyKey(varyFields(c.Writer.Header()), c.Request))
 }
 
 type cachedWriter struct {
 	gin.ResponseWriter
-	status  int
-	written bool
 	store   CacheStore
 	expire  time.Duration
 	key     string
+	options Options
+	body    bytes.Buffer
+	skip    bool
+
+	// outer reports whether the response was already encoded by a middleware
+	// wrapping writer, such as gzip.Gzip.
+	outer bool
+
+	// vary lists the request headers the key depends on. Responses varying
+	// on other request headers are not stored.
+	vary []string
+
+	// date is when the response started, which is its default
+	// Last-Modified.
+	date time.Time
 }
 
 func urlEscape(prefix string, u string) string {
@@ -64,43 +159,102 @@ func urlEscape(prefix string, u string) string {
 	return buffer.String()
 }
 
-func newCachedWriter(store CacheStore, expire time.Duration, writer gin.ResponseWriter, key string) *cachedWriter {
-	return &cachedWriter{writer, 0, false, store, expire, key}
+func newCachedWriter(store CacheStore, expire time.Duration, writer gin.ResponseWriter, key string, options Options) *cachedWriter {
+	return &cachedWriter{
+		ResponseWriter: writer,
+		store:          store,
+		expire:         expire,
+		key:            key,
+		options:        options,
+		outer:          writer.Header().Get("Content-Encoding") != "",
+		date:           time.Now(),
+	}
 }
 
-func (w *cachedWriter) WriteHeader(code int) {
-	w.status = code
-	w.written = true
-	w.ResponseWriter.WriteHeader(code)
+func (w *cachedWriter) Write(data []byte) (int, error) {
+	ret, err := w.ResponseWriter.Write(data)
+	if err == nil {
+		w.capture(data[:ret])
+	}
+	return ret, err
 }
 
-func (w *cachedWriter) Status() int {
-	return w.status
+func (w *cachedWriter) WriteString(s string) (int, error) {
+	ret, err := w.ResponseWriter.WriteString(s)
+	if err == nil {
+		w.capture([]byte(s[:ret]))
+	}
+	return ret, err
 }
 
-func (w *cachedWriter) Written() bool {
-	return w.written
+// capture appends data to the buffered body, giving up on caching the
+// response once it grows past maxSize.
+func (w *cachedWriter) capture(data []byte) {
+	if w.skip {
+		return
+	}
+	if w.options.MaxBodySize > 0 && w.body.Len()+len(data) > w.options.MaxBodySize {
+		w.skip = true
+		w.body = bytes.Buffer{}
+		return
+	}
+	w.body.Write(data)
 }
 
-func (w *cachedWriter) Write(data []byte) (int, error) {
-	ret, err := w.ResponseWriter.Write(data)
-	if err == nil {
-		//cache response
-		store := w.store
-		val := responseCache{
-			w.status,
-			w.Header(),
-			data,
-		}
-		err = store.Set(w.key, val, w.expire)
-		if err != nil {
-			// need logger
+// commit stores the buffered response if the cache policy allows it, along
+// with the versions of its tags read by tags, and returns it with ok set. It
+// must be called once the handler has returned, so that the status set
+// through WriteHeader or WriteHeaderNow and the whole body are known.
+func (w *cachedWriter) commit(tags *tagSnapshot) (val responseCache, ok bool, err error) {
+	if w.skip || !w.Written() {
+		return val, false, nil
+	}
+	header := cloneHeader(w.Header())
+	header.Del("Age")
+	header.Del("X-Cache")
+	expire, ok := w.options.lifetime(w.Status(), header, w.expire)
+	if !ok {
+		return val, false, nil
+	}
+	for _, field := range varyFields(header) {
+		if !containsString(w.vary, field) {
+			return val, false, nil
 		}
 	}
-	return ret, err
+	val = responseCache{
+		status: w.Status(),
+		header: header,
+		data:   w.body.Bytes(),
+		date:   w.date,
+	}
+	if err = val.encode(w.outer, w.options.GzipLevel); err != nil {
+		return val, false, err
+	}
+	val.setValidators()
+	if val.tags, err = tags.get(); err != nil {
+		return val, false, err
+	}
+	if expire > 0 {
+		// Keep the entry around after it expires for as long as it may be
+		// served stale.
+		val.expires = val.date.Add(expire)
+		expire += w.options.staleGrace()
+	}
+	return val, true, w.store.Set(w.key, val, expire)
+}
+
+func cloneHeader(h http.Header) http.Header {
+	clone := make(http.Header, len(h))
+	for k, vals := range h {
+		clone[k] = append([]string(nil), vals...)
+	}
+	return clone
 }
 
 // Cache Middleware
+//
+// It stores a pointer to the store, which Default dereferences. WithStore
+// avoids the pointer.
 func Cache(store *CacheStore) gin.HandlerFunc {
 	return func(c *gin.Context) {
 		c.Set(CACHE_MIDDLEWARE_KEY, store)
@@ -108,46 +262,227 @@ func Cache(store *CacheStore) gin.HandlerFunc {
 	}
 }
 
+// WithStore makes store the one returned by Default for the requests it
+// handles. Registered on a route group after another WithStore, it overrides
+// it for the group.
+func WithStore(store CacheStore) gin.HandlerFunc {
+	return func(c *gin.Context) {
+		c.Set(CACHE_MIDDLEWARE_KEY, store)
+		c.Next()
+	}
+}
+
+// WithNamedStore makes store the one returned by Named with name, so that a
+// request can use several stores. Like WithStore, it can be overridden for a
+// route group.
+func WithNamedStore(name string, store CacheStore) gin.HandlerFunc {
+	key := namedStoreKey(name)
+	return func(c *gin.Context) {
+		c.Set(key, store)
+		c.Next()
+	}
+}
+
+// shortcut to get the store set by WithStore or Cache. It panics if there is
+// none.
+func Default(c *gin.Context) CacheStore {
+	switch store := c.MustGet(CACHE_MIDDLEWARE_KEY).(type) {
+	case *CacheStore:
+		return *store
+	default:
+		return store.(CacheStore)
+	}
+}
+
+// Named returns the store set by WithNamedStore with name. It panics if there
+// is none.
+func Named(c *gin.Context, name string) CacheStore {
+	return c.MustGet(namedStoreKey(name)).(CacheStore)
+}
+
+func namedStoreKey(name string) string {
+	return CACHE_MIDDLEWARE_KEY + "." + name
+}
+
 func SiteCache(store CacheStore, expire time.Duration) gin.HandlerFunc {
+	return SiteCacheWithOptions(store, expire, Options{})
+}
+
+// SiteCacheWithOptions is like SiteCache but accepts Options.
+func SiteCacheWithOptions(store CacheStore, expire time.Duration, options Options) gin.HandlerFunc {
 
 	return func(c *gin.Context) {
 		var cache responseCache
-		url := c.Request.URL
-		key := urlEscape(PageCachePrefix, url.RequestURI())
-		if err := store.Get(key, &cache); err != nil {
+		if lookup, _ := options.cacheableRequest(c.Request); !lookup {
+			c.Next()
+			return
+		}
+		key := options.key(c)
+		err := store.Get(key, &cache)
+		options.logError(c, key, err)
+		if err != nil || !cache.fresh(time.Now()) || !cache.valid(store) {
 			c.Next()
 		} else {
-			c.Writer.WriteHeader(cache.status)
-			for k, vals := range cache.header {
-				for _, v := range vals {
-					c.Writer.Header().Add(k, v)
-				}
-			}
-			c.Writer.Write(cache.data)
+			replay(c, cache, "HIT")
 		}
 	}
 }
 
 // Cache Decorator
+//
+// Cached responses carry an ETag and a Last-Modified, unless the handler sets
+// its own, and conditional requests matching them are answered with 304 Not
+// Modified. Last-Modified is sent from the first response on, but the ETag
+// hashes the whole body and so is only sent once the page is served from
+// the cache.
 func CachePage(store CacheStore, expire time.Duration, handle gin.HandlerFunc) gin.HandlerFunc {
+	return CachePageWithOptions(store, expire, Options{}, handle)
+}
 
-	return func(c *gin.Context) {
-		var cache responseCache
-		url := c.Request.URL
-		key := urlEscape(PageCachePrefix, url.RequestURI())
-		if err := store.Get(key, &cache); err != nil {
-			// replace writer
-			writer := newCachedWriter(store, expire, c.Writer, key)
-			c.Writer = writer
-			handle(c)
-		} else {
-			c.Writer.WriteHeader(cache.status)
-			for k, vals := range cache.header {
-				for _, v := range vals {
-					c.Writer.Header().Add(k, v)
-				}
+// CachePageWithOptions is like CachePage but accepts Options.
+func CachePageWithOptions(store CacheStore, expire time.Duration, options Options, handle gin.HandlerFunc) gin.HandlerFunc {
+	p := &pageCache{
+		store:      store,
+		expire:     expire,
+		options:    options,
+		handle:     handle,
+		refreshing: make(map[string]bool),
+		calls:      make(map[string]*call),
+	}
+	return p.serve
+}
+
+// pageCache holds the state of a CachePage decorator.
+type pageCache struct {
+	store   CacheStore
+	expire  time.Duration
+	options Options
+	handle  gin.HandlerFunc
+
+	mu         sync.Mutex
+	refreshing map[string]bool
+	calls      map[string]*call
+}
+
+func (p *pageCache) serve(c *gin.Context) {
+	var cache responseCache
+	lookup, cacheable := p.options.cacheableRequest(c.Request)
+	if !cacheable {
+		p.handle(c)
+		return
+	}
+	key := p.options.key(c)
+	if !lookup {
+		p.coalescedMiss(c, key)
+		return
+	}
+	err := p.store.Get(key, &cache)
+	p.options.logError(c, key, err)
+	if err != nil || !cache.valid(p.store) {
+		p.coalescedMiss(c, key)
+		return
+	}
+
+	now := time.Now()
+	switch {
+	case cache.fresh(now):
+		replay(c, cache, "HIT")
+	case now.Before(cache.expires.Add(p.options.StaleWhileRevalidate)):
+		replay(c, cache, "STALE")
+		p.revalidate(c, key)
+	case now.Before(cache.expires.Add(p.options.StaleIfError)):
+		p.missOrStale(c, key, cache)
+	default:
+		p.coalescedMiss(c, key)
+	}
+}
+
+// newWriter returns a cachedWriter capturing into w the response to c, to be
+// stored under key. The response gets a Last-Modified of now unless the
+// handler sets its own, so that clients receive a validator on the first
+// fetch too.
+func (p *pageCache) newWriter(c *gin.Context, w gin.ResponseWriter, key string) *cachedWriter {
+	writer := newCachedWriter(p.store, p.expire, w, key, p.options)
+	writer.vary = varyFields(c.Writer.Header())
+	if w.Header().Get("Last-Modified") == "" {
+		w.Header().Set("Last-Modified", writer.date.UTC().Format(http.TimeFormat))
+	}
+	return writer
+}
+
+// miss runs the handler, sending its response to the client while capturing
+// it for the store. The response is returned if it was cacheable.
+func (p *pageCache) miss(c *gin.Context, key string) (responseCache, bool) {
+	writer := p.newWriter(c, c.Writer, key)
+	c.Writer = writer
+	c.Header("X-Cache", "MISS")
+	tags := p.options.snapshotTags(c, p.store)
+	p.handle(c)
+	c.Writer = writer.ResponseWriter
+	cache, ok, err := writer.commit(tags)
+	p.options.logError(c, key, err)
+	return cache, ok
+}
+
+// replay sends a cached response, or 304 Not Modified if the request
+// validators match it. state is reported in the X-Cache header. The gzip
+// variant is sent to the clients accepting it, unless a middleware such as
+// gzip.Gzip already encodes the response. The cached headers replace those
+// already set by the middlewares, except Vary which is merged.
+func replay(c *gin.Context, cache responseCache, state string) {
+	header := c.Writer.Header()
+	outer := header.Get("Content-Encoding") != ""
+	body := cache.data
+	compressed := !outer && cache.gzip != nil && acceptsGzip(c.Request)
+	if compressed {
+		body = cache.gzip
+		cache.etag = gzipETag(cache.etag)
+	}
+	// cache.header may be shared with other requests, copy it.
+	copyHeader := func(k string) {
+		switch k = http.CanonicalHeaderKey(k); k {
+		case "Etag":
+			if cache.header.Get(k) != "" {
+				header.Set(k, cache.etag)
+			}
+		case "Vary":
+			for _, v := range cache.header[k] {
+				addVary(header, v)
 			}
-			c.Writer.Write(cache.data)
+		default:
+			header[k] = append([]string(nil), cache.header[k]...)
+		}
+	}
+	if cache.gzip != nil {
+		addVary(header, "Accept-Encoding")
+	}
+
+	if notModified(c.Request, cache) {
+		c.Writer.WriteHeader(http.StatusNotModified)
+		for _, k := range notModifiedHeaders {
+			copyHeader(k)
+		}
+		c.Header("X-Cache", state)
+		c.Writer.WriteHeaderNow()
+		return
+	}
+	c.Writer.WriteHeader(cache.status)
+	for k := range cache.header {
+		copyHeader(k)
+	}
+	if compressed {
+		header.Set("Content-Encoding", "gzip")
+	}
+	if !outer && len(body) > 0 {
+		header.Set("Content-Length", strconv.Itoa(len(body)))
+	}
+	if !cache.date.IsZero() {
+		age := time.Since(cache.date) / time.Second
+		if age < 0 {
+			age = 0
 		}
+		c.Header("Age", strconv.FormatInt(int64(age), 10))
 	}
+	c.Header("X-Cache", state)
+	c.Writer.Write(body)
 }
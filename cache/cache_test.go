@@ -1,9 +1,18 @@
 package cache
 
 import (
+	"errors"
+	"io"
 	"math"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"sync"
 	"testing"
 	"time"
+
+	"github.com/gin-gonic/contrib/cors"
+	"github.com/gin-gonic/gin"
 )
 
 type cacheFactory func(*testing.T, time.Duration) CacheStore
@@ -200,3 +209,362 @@ func testAdd(t *testing.T, newCache cacheFactory) {
 		t.Errorf("Expected 3, got: %d", i)
 	}
 }
+
+// Test that the atomic operations hold under parallel load
+func concurrency(t *testing.T, newCache cacheFactory) {
+	const workers, iterations = 20, 50
+	cache := newCache(t, time.Hour)
+	parallel := func(f func(worker int)) {
+		var wg sync.WaitGroup
+		for i := 0; i < workers; i++ {
+			wg.Add(1)
+			go func(i int) {
+				defer wg.Done()
+				f(i)
+			}(i)
+		}
+		wg.Wait()
+	}
+
+	// No increment is lost.
+	if err := cache.Set("counter", 0, DEFAULT); err != nil {
+		t.Fatalf("Error setting counter: %s", err)
+	}
+	parallel(func(int) {
+		for i := 0; i < iterations; i++ {
+			if _, err := cache.Increment("counter", 2); err != nil {
+				t.Errorf("Error incrementing: %s", err)
+			}
+		}
+	})
+	var counter int
+	if err := cache.Get("counter", &counter); err != nil || counter != workers*iterations*2 {
+		t.Errorf("Expected %d, got %d: %v", workers*iterations*2, counter, err)
+	}
+
+	// Decrements never go below zero.
+	parallel(func(int) {
+		for i := 0; i < iterations; i++ {
+			if _, err := cache.Decrement("counter", 3); err != nil {
+				t.Errorf("Error decrementing: %s", err)
+			}
+		}
+	})
+	if err := cache.Get("counter", &counter); err != nil || counter != 0 {
+		t.Errorf("Expected the counter to stop at 0, got %d: %v", counter, err)
+	}
+
+	// A single Add wins.
+	var mu sync.Mutex
+	added := 0
+	parallel(func(worker int) {
+		err := cache.Add("added", worker, DEFAULT)
+		if err == nil {
+			mu.Lock()
+			added++
+			mu.Unlock()
+		} else if err != ErrNotStored {
+			t.Errorf("Unexpected error adding: %s", err)
+		}
+	})
+	if added != 1 {
+		t.Errorf("Expected a single successful Add, got %d", added)
+	}
+
+	// Replace never creates a key, a single Delete wins.
+	cache.Delete("replaced")
+	parallel(func(worker int) {
+		if err := cache.Replace("replaced", worker, DEFAULT); err != ErrNotStored {
+			t.Errorf("Expected ErrNotStored replacing a missing key, got %v", err)
+		}
+	})
+	deleted := 0
+	parallel(func(int) {
+		err := cache.Delete("added")
+		if err == nil {
+			mu.Lock()
+			deleted++
+			mu.Unlock()
+		} else if err != ErrCacheMiss {
+			t.Errorf("Unexpected error deleting: %s", err)
+		}
+	})
+	if deleted != 1 {
+		t.Errorf("Expected a single successful Delete, got %d", deleted)
+	}
+}
+
+// Test that flushing a store leaves the keys of other namespaces alone
+func namespaceFlush(t *testing.T, flushed CacheStore, others ...CacheStore) {
+	values := []string{"flushed", "namespace", "database"}
+	stores := append([]CacheStore{flushed}, others...)
+	for i, store := range stores {
+		if err := store.Set("value", values[i], DEFAULT); err != nil {
+			t.Fatalf("Error setting a value: %s", err)
+		}
+	}
+
+	if err := flushed.Flush(); err != nil {
+		t.Fatalf("Error flushing: %s", err)
+	}
+
+	var value string
+	if err := flushed.Get("value", &value); err != ErrCacheMiss {
+		t.Errorf("Expected ErrCacheMiss after a flush, got %v", err)
+	}
+	if err := flushed.Set("value", "again", DEFAULT); err != nil {
+		t.Errorf("Error setting a value after a flush: %s", err)
+	}
+	for i, store := range others {
+		value = ""
+		if err := store.Get("value", &value); err != nil || value != values[i+1] {
+			t.Errorf("Expected %q to survive the flush, got %q: %v", values[i+1], value, err)
+		}
+	}
+}
+
+func init() {
+	gin.SetMode(gin.TestMode)
+}
+
+func performRequest(r http.Handler, method, path string) *httptest.ResponseRecorder {
+	req, _ := http.NewRequest(method, path, nil)
+	w := httptest.NewRecorder()
+	r.ServeHTTP(w, req)
+	return w
+}
+
+// Test that a page cached through CachePage is replayed intact
+func cachePage(t *testing.T, store CacheStore) {
+	calls := 0
+	router := gin.New()
+	router.GET("/page", CachePage(store, time.Hour, func(c *gin.Context) {
+		calls++
+		c.Header("X-Multi", "a")
+		c.Writer.Header().Add("X-Multi", "b")
+		c.Data(http.StatusNonAuthoritativeInfo, "text/plain", []byte("cached page"))
+	}))
+
+	for i := 0; i < 2; i++ {
+		w := performRequest(router, "GET", "/page")
+		if w.Code != http.StatusNonAuthoritativeInfo {
+			t.Errorf("Request %d: expected status 203, got %d", i, w.Code)
+		}
+		if body := w.Body.String(); body != "cached page" {
+			t.Errorf("Request %d: expected the cached body, got %q", i, body)
+		}
+		if ct := w.Header().Get("Content-Type"); ct != "text/plain" {
+			t.Errorf("Request %d: expected Content-Type text/plain, got %q", i, ct)
+		}
+		if multi := w.Header()["X-Multi"]; len(multi) != 2 || multi[0] != "a" || multi[1] != "b" {
+			t.Errorf("Request %d: expected X-Multi [a b], got %v", i, multi)
+		}
+	}
+	if calls != 1 {
+		t.Errorf("Expected the handler to run once, ran %d times", calls)
+	}
+}
+
+func TestCachePage_MultipleWrites(t *testing.T) {
+	store := NewInMemoryStore(time.Minute)
+	calls := 0
+	router := gin.New()
+	router.GET("/stream", CachePage(store, time.Minute, func(c *gin.Context) {
+		calls++
+		c.Header("X-Test", "stream")
+		c.Status(http.StatusNonAuthoritativeInfo)
+		c.Writer.Write([]byte("first,"))
+		c.Writer.WriteString("second,")
+		io.Copy(c.Writer, strings.NewReader("third"))
+	}))
+
+	for i := 0; i < 2; i++ {
+		w := performRequest(router, "GET", "/stream")
+		if w.Code != http.StatusNonAuthoritativeInfo {
+			t.Errorf("Request %d: expected status 203, got %d", i, w.Code)
+		}
+		if body := w.Body.String(); body != "first,second,third" {
+			t.Errorf("Request %d: expected the full body, got %q", i, body)
+		}
+		if h := w.Header().Get("X-Test"); h != "stream" {
+			t.Errorf("Request %d: expected X-Test header, got %q", i, h)
+		}
+	}
+	if calls != 1 {
+		t.Errorf("Expected the handler to run once, ran %d times", calls)
+	}
+}
+
+func TestCachePage_WriteHeaderNow(t *testing.T) {
+	store := NewInMemoryStore(time.Minute)
+	router := gin.New()
+	router.GET("/empty", CachePage(store, time.Minute, func(c *gin.Context) {
+		c.AbortWithStatus(http.StatusNoContent)
+	}))
+
+	performRequest(router, "GET", "/empty")
+	w := performRequest(router, "GET", "/empty")
+	if w.Code != http.StatusNoContent || w.Header().Get("X-Cache") != "HIT" {
+		t.Errorf("Expected cached status 204, got %d", w.Code)
+	}
+}
+
+// performRequestWith is performRequest with a request header set.
+func performRequestWith(r http.Handler, path, header, value string) *httptest.ResponseRecorder {
+	req, _ := http.NewRequest("GET", path, nil)
+	req.Header.Set(header, value)
+	w := httptest.NewRecorder()
+	r.ServeHTTP(w, req)
+	return w
+}
+
+func TestCachePage_CORS(t *testing.T) {
+	store := NewInMemoryStore(time.Minute)
+	calls := 0
+	router := gin.New()
+	router.Use(cors.New(cors.Config{
+		AllowedOrigins: []string{"http://a.example", "http://b.example"},
+		AllowedMethods: []string{"GET"},
+	}))
+	router.GET("/cors", CachePage(store, time.Minute, func(c *gin.Context) {
+		calls++
+		c.String(http.StatusOK, "shared")
+	}))
+
+	for i, origin := range []string{"http://a.example", "http://a.example", "http://b.example", "http://b.example"} {
+		w := performRequestWith(router, "/cors", "Origin", origin)
+		if acao := w.Header()["Access-Control-Allow-Origin"]; len(acao) != 1 || acao[0] != origin {
+			t.Errorf("Request %d: expected Access-Control-Allow-Origin [%s], got %v", i, origin, acao)
+		}
+		if vary := w.Header()["Vary"]; len(vary) != 1 || vary[0] != "Origin" {
+			t.Errorf("Request %d: expected Vary [Origin], got %v", i, vary)
+		}
+		if body := w.Body.String(); body != "shared" {
+			t.Errorf("Request %d: expected the page, got %q", i, body)
+		}
+	}
+	if calls != 2 {
+		t.Errorf("Expected the handler to run once per origin, ran %d times", calls)
+	}
+}
+
+func TestCachePage_Vary(t *testing.T) {
+	store := NewInMemoryStore(time.Minute)
+	calls := 0
+	router := gin.New()
+	router.GET("/vary", CachePage(store, time.Minute, func(c *gin.Context) {
+		calls++
+		c.Header("Vary", "X-Variant")
+		c.String(http.StatusOK, c.GetHeader("X-Variant"))
+	}))
+
+	for i, variant := range []string{"a", "b", "a"} {
+		w := performRequestWith(router, "/vary", "X-Variant", variant)
+		if body := w.Body.String(); body != variant {
+			t.Errorf("Request %d: expected %q, got %q", i, variant, body)
+		}
+		if state := w.Header().Get("X-Cache"); state != "MISS" {
+			t.Errorf("Request %d: expected a response varying on X-Variant not to be cached, got %s", i, state)
+		}
+	}
+	if calls != 3 {
+		t.Errorf("Expected the handler to run for every request, ran %d times", calls)
+	}
+}
+
+func TestCachePage_MaxBodySize(t *testing.T) {
+	store := NewInMemoryStore(time.Minute)
+	calls := 0
+	router := gin.New()
+	router.GET("/big", CachePageWithOptions(store, time.Minute, Options{MaxBodySize: 8}, func(c *gin.Context) {
+		calls++
+		c.String(http.StatusOK, "0123456789")
+	}))
+
+	for i := 0; i < 2; i++ {
+		w := performRequest(router, "GET", "/big")
+		if body := w.Body.String(); body != "0123456789" {
+			t.Errorf("Request %d: expected the full body, got %q", i, body)
+		}
+	}
+	if calls != 2 {
+		t.Errorf("Expected oversized responses not to be cached, handler ran %d times", calls)
+	}
+}
+
+// failingStore is a store whose lookups and writes fail.
+type failingStore struct {
+	CacheStore
+}
+
+var errStoreDown = errors.New("store down")
+
+func (failingStore) Get(key string, value interface{}) error {
+	return errStoreDown
+}
+
+func (failingStore) Set(key string, value interface{}, expire time.Duration) error {
+	return errStoreDown
+}
+
+func TestCachePage_Logger(t *testing.T) {
+	var logged []string
+	options := Options{Logger: func(c *gin.Context, key string, err error) {
+		logged = append(logged, c.Request.URL.Path+" "+key+" "+err.Error())
+	}}
+	router := gin.New()
+	router.GET("/page", CachePageWithOptions(failingStore{NewInMemoryStore(time.Minute)}, time.Minute, options, func(c *gin.Context) {
+		c.String(http.StatusOK, "page")
+	}))
+
+	if w := performRequest(router, "GET", "/page"); w.Body.String() != "page" {
+		t.Errorf("Expected the page despite the store failing, got %q", w.Body.String())
+	}
+	key := urlEscape(PageCachePrefix, "/page")
+	expected := "/page " + key + " store down"
+	if len(logged) != 2 || logged[0] != expected || logged[1] != expected {
+		t.Errorf("Expected the failed lookup and write to be logged, got %q", logged)
+	}
+}
+
+func TestDefault(t *testing.T) {
+	global := NewInMemoryStore(time.Minute)
+	override := NewInMemoryStore(time.Minute)
+	sessions := NewInMemoryStore(time.Minute)
+	var legacy CacheStore = NewInMemoryStore(time.Minute)
+
+	var found []CacheStore
+	record := func(c *gin.Context) {
+		found = append(found, Default(c), Named(c, "sessions"))
+	}
+	router := gin.New()
+	router.Use(WithStore(global), WithNamedStore("sessions", sessions))
+	router.GET("/", record)
+	group := router.Group("/group", WithStore(override))
+	group.GET("/", record)
+	router.GET("/legacy", Cache(&legacy), func(c *gin.Context) {
+		found = append(found, Default(c))
+	})
+
+	performRequest(router, "GET", "/")
+	performRequest(router, "GET", "/group/")
+	performRequest(router, "GET", "/legacy")
+	expected := []CacheStore{global, sessions, override, sessions, legacy}
+	if len(found) != len(expected) {
+		t.Fatalf("Expected %d stores, got %d", len(expected), len(found))
+	}
+	for i, store := range expected {
+		if found[i] != store {
+			t.Errorf("Store %d: expected %p, got %p", i, store, found[i])
+		}
+	}
+}
+
+func TestDefault_Missing(t *testing.T) {
+	defer func() {
+		if recover() == nil {
+			t.Errorf("Expected Named to panic without a store")
+		}
+	}()
+	Named(&gin.Context{}, "missing")
+}
@@ -0,0 +1,102 @@
+package cache
+
+import (
+	"time"
+
+	"github.com/gin-gonic/gin"
+)
+
+const lockPollInterval = 50 * time.Millisecond
+
+// call is a running handler whose response is shared with the concurrent
+// requests for the same key.
+type call struct {
+	done  chan struct{}
+	cache responseCache
+	ok    bool
+}
+
+// coalescedMiss is miss with concurrent requests for the same key sharing a
+// single handler execution, when Coalesce is set.
+func (p *pageCache) coalescedMiss(c *gin.Context, key string) {
+	if !p.options.Coalesce {
+		p.miss(c, key)
+		return
+	}
+
+	p.mu.Lock()
+	if cl, ok := p.calls[key]; ok {
+		p.mu.Unlock()
+		select {
+		case <-cl.done:
+		case <-c.Request.Context().Done():
+			return
+		}
+		if cl.ok {
+			replay(c, cl.cache, "HIT")
+		} else {
+			p.miss(c, key)
+		}
+		return
+	}
+	cl := &call{done: make(chan struct{})}
+	p.calls[key] = cl
+	p.mu.Unlock()
+
+	defer func() {
+		p.mu.Lock()
+		delete(p.calls, key)
+		p.mu.Unlock()
+		close(cl.done)
+	}()
+
+	if p.options.LockTTL > 0 {
+		cache, found, locked := p.lockOrWait(c, key)
+		if found {
+			cl.cache, cl.ok = cache, true
+			replay(c, cache, "HIT")
+			return
+		}
+		if locked {
+			defer p.store.Delete(lockKey(key))
+		} else if c.Request.Context().Err() != nil {
+			return
+		}
+	}
+	cl.cache, cl.ok = p.miss(c, key)
+}
+
+// lockOrWait takes the store lock of key. While another process holds it,
+// lockOrWait polls the store for the page that process renders, giving up
+// after LockTTL. Errors of the store other than ErrNotStored let the request
+// proceed without the lock.
+func (p *pageCache) lockOrWait(c *gin.Context, key string) (cache responseCache, found bool, locked bool) {
+	ttl := (p.options.LockTTL + time.Second - 1) / time.Second * time.Second
+	deadline := time.Now().Add(ttl)
+	for {
+		// Look for the page first, the lock is released once it is stored.
+		if p.store.Get(key, &cache) == nil && cache.fresh(time.Now()) && cache.valid(p.store) {
+			return cache, true, false
+		}
+		err := p.store.Add(lockKey(key), 1, ttl)
+		if err == nil {
+			return cache, false, true
+		}
+		if err != ErrNotStored {
+			p.options.logError(c, key, err)
+			return cache, false, false
+		}
+		if time.Now().After(deadline) {
+			return cache, false, false
+		}
+		select {
+		case <-c.Request.Context().Done():
+			return cache, false, false
+		case <-time.After(lockPollInterval):
+		}
+	}
+}
+
+func lockKey(key string) string {
+	return key + ":lock"
+}
@@ -0,0 +1,129 @@
+package cache
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/gin-gonic/gin"
+)
+
+// countingHandler counts its calls and blocks until release is closed.
+type countingHandler struct {
+	mu      sync.Mutex
+	calls   int
+	started chan struct{}
+	release chan struct{}
+	cookie  bool
+}
+
+func newCountingHandler() *countingHandler {
+	return &countingHandler{started: make(chan struct{}, 100), release: make(chan struct{})}
+}
+
+func (h *countingHandler) handle(c *gin.Context) {
+	h.mu.Lock()
+	h.calls++
+	h.mu.Unlock()
+	h.started <- struct{}{}
+	<-h.release
+	if h.cookie {
+		c.SetCookie("session", "secret", 3600, "/", "", false, true)
+	}
+	c.String(http.StatusOK, "rendered")
+}
+
+func (h *countingHandler) count() int {
+	h.mu.Lock()
+	defer h.mu.Unlock()
+	return h.calls
+}
+
+// concurrentRequests sends n requests to router while the first one is being
+// handled, returning their responses.
+func concurrentRequests(router http.Handler, h *countingHandler, n int) []*httptest.ResponseRecorder {
+	responses := make([]*httptest.ResponseRecorder, n)
+	var wg sync.WaitGroup
+	for i := range responses {
+		wg.Add(1)
+		go func(i int) {
+			defer wg.Done()
+			responses[i] = performRequest(router, "GET", "/page")
+		}(i)
+		if i == 0 {
+			<-h.started
+		}
+	}
+	time.Sleep(50 * time.Millisecond)
+	close(h.release)
+	wg.Wait()
+	return responses
+}
+
+func TestCachePage_Coalesce(t *testing.T) {
+	h := newCountingHandler()
+	router := gin.New()
+	router.GET("/page", CachePageWithOptions(NewInMemoryStore(time.Hour), time.Minute, Options{Coalesce: true}, h.handle))
+
+	for i, w := range concurrentRequests(router, h, 10) {
+		if w.Code != http.StatusOK || w.Body.String() != "rendered" {
+			t.Errorf("Request %d: expected the shared response, got %d %q", i, w.Code, w.Body.String())
+		}
+	}
+	if calls := h.count(); calls != 1 {
+		t.Errorf("Expected a single handler execution, got %d", calls)
+	}
+}
+
+func TestCachePage_CoalesceUncacheable(t *testing.T) {
+	h := newCountingHandler()
+	h.cookie = true
+	router := gin.New()
+	router.GET("/page", CachePageWithOptions(NewInMemoryStore(time.Hour), time.Minute, Options{Coalesce: true}, h.handle))
+
+	for i, w := range concurrentRequests(router, h, 3) {
+		if w.Header().Get("Set-Cookie") == "" {
+			t.Errorf("Request %d: expected its own response with a cookie", i)
+		}
+	}
+	if calls := h.count(); calls != 3 {
+		t.Errorf("Expected uncacheable responses not to be shared, got %d handler executions", calls)
+	}
+}
+
+func TestCachePage_CoalesceLock(t *testing.T) {
+	store := NewInMemoryStore(time.Hour)
+	options := Options{Coalesce: true, LockTTL: 5 * time.Second}
+	first, second := newCountingHandler(), newCountingHandler()
+	close(second.release)
+
+	// Two instances of the application sharing the store.
+	router1 := gin.New()
+	router1.GET("/page", CachePageWithOptions(store, time.Minute, options, first.handle))
+	router2 := gin.New()
+	router2.GET("/page", CachePageWithOptions(store, time.Minute, options, second.handle))
+
+	done := make(chan struct{})
+	go func() {
+		performRequest(router1, "GET", "/page")
+		close(done)
+	}()
+	<-first.started
+
+	go func() {
+		time.Sleep(100 * time.Millisecond)
+		close(first.release)
+	}()
+	w := performRequest(router2, "GET", "/page")
+	<-done
+
+	if w.Body.String() != "rendered" || second.count() != 0 {
+		t.Errorf("Expected the second instance to wait for the first one, got %q after %d calls", w.Body.String(), second.count())
+	}
+	var lock int
+	if err := store.Get(lockKey(urlEscape(PageCachePrefix, "/page")), &lock); err != ErrCacheMiss {
+		t.Errorf("Expected the lock to be released, got %v", err)
+	}
+}
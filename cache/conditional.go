@@ -0,0 +1,61 @@
+package cache
+
+import (
+	"crypto/sha1"
+	"fmt"
+	"net/http"
+	"strings"
+	"time"
+)
+
+// notModifiedHeaders are the headers kept in a 304 Not Modified response,
+// per RFC 7232 section 4.1.
+var notModifiedHeaders = []string{"Cache-Control", "Content-Location", "Date", "ETag", "Expires", "Last-Modified", "Vary"}
+
+// setValidators fills in the ETag and Last-Modified of a response about to be
+// stored. Validators set by the handler are kept, otherwise the ETag is a hash
+// of the body and the response is considered modified when its handler
+// started, as told to the client by newWriter.
+func (r *responseCache) setValidators() {
+	r.etag = r.header.Get("ETag")
+	if r.etag == "" {
+		r.etag = fmt.Sprintf(`"%x"`, sha1.Sum(r.data))
+		r.header.Set("ETag", r.etag)
+	}
+	if t, err := http.ParseTime(r.header.Get("Last-Modified")); err == nil {
+		r.lastModified = t
+	} else {
+		r.lastModified = r.date
+		r.header.Set("Last-Modified", r.date.UTC().Format(http.TimeFormat))
+	}
+}
+
+// notModified reports whether the conditional headers of req allow answering
+// with 304 Not Modified instead of the cached response. If-None-Match takes
+// precedence over If-Modified-Since.
+func notModified(req *http.Request, cache responseCache) bool {
+	if cache.status != http.StatusOK || (req.Method != "GET" && req.Method != "HEAD") {
+		return false
+	}
+	if inm := req.Header.Get("If-None-Match"); inm != "" {
+		return cache.etag != "" && etagMatch(inm, cache.etag)
+	}
+	if ims := req.Header.Get("If-Modified-Since"); ims != "" && !cache.lastModified.IsZero() {
+		t, err := http.ParseTime(ims)
+		return err == nil && !cache.lastModified.Truncate(time.Second).After(t)
+	}
+	return false
+}
+
+// etagMatch reports whether etag is in the If-None-Match list, using the weak
+// comparison function.
+func etagMatch(list string, etag string) bool {
+	etag = strings.TrimPrefix(etag, "W/")
+	for _, candidate := range strings.Split(list, ",") {
+		candidate = strings.TrimSpace(candidate)
+		if candidate == "*" || strings.TrimPrefix(candidate, "W/") == etag {
+			return true
+		}
+	}
+	return false
+}
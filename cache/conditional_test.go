@@ -0,0 +1,107 @@
+package cache
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"testing"
+	"time"
+
+	"github.com/gin-gonic/gin"
+)
+
+func TestETagMatch(t *testing.T) {
+	cases := []struct {
+		list string
+		etag string
+		ok   bool
+	}{
+		{`"a"`, `"a"`, true},
+		{`"b", "a"`, `"a"`, true},
+		{`W/"a"`, `"a"`, true},
+		{`"a"`, `W/"a"`, true},
+		{`*`, `"a"`, true},
+		{`"b"`, `"a"`, false},
+	}
+	for _, tc := range cases {
+		if ok := etagMatch(tc.list, tc.etag); ok != tc.ok {
+			t.Errorf("etagMatch(%s, %s): expected %t", tc.list, tc.etag, tc.ok)
+		}
+	}
+}
+
+func TestCachePage_Conditional(t *testing.T) {
+	store := NewInMemoryStore(time.Minute)
+	router := gin.New()
+	router.GET("/poll", CachePage(store, time.Minute, func(c *gin.Context) {
+		c.Header("Cache-Control", "public")
+		c.String(http.StatusOK, "payload")
+	}))
+
+	w := performRequest(router, "GET", "/poll")
+	lastModified := w.Header().Get("Last-Modified")
+	if lastModified == "" {
+		t.Fatalf("Expected Last-Modified on the first response, got %v", w.Header())
+	}
+	w = performRequest(router, "GET", "/poll")
+	etag := w.Header().Get("ETag")
+	if etag == "" || w.Header().Get("Last-Modified") != lastModified {
+		t.Fatalf("Expected ETag and the same Last-Modified on cached responses, got %v", w.Header())
+	}
+
+	request := func(name, value string) *httptest.ResponseRecorder {
+		req, _ := http.NewRequest("GET", "/poll", nil)
+		req.Header.Set(name, value)
+		w := httptest.NewRecorder()
+		router.ServeHTTP(w, req)
+		return w
+	}
+
+	w = request("If-None-Match", etag)
+	if w.Code != http.StatusNotModified || w.Body.Len() != 0 {
+		t.Errorf("Expected 304 with an empty body, got %d %q", w.Code, w.Body.String())
+	}
+	if w.Header().Get("ETag") != etag || w.Header().Get("Cache-Control") != "public" || w.Header().Get("Content-Type") != "" {
+		t.Errorf("Unexpected 304 headers %v", w.Header())
+	}
+
+	if w = request("If-None-Match", `"other"`); w.Code != http.StatusOK || w.Body.String() != "payload" {
+		t.Errorf("Expected the full response for another ETag, got %d", w.Code)
+	}
+
+	if w = request("If-Modified-Since", lastModified); w.Code != http.StatusNotModified {
+		t.Errorf("Expected 304 for If-Modified-Since, got %d", w.Code)
+	}
+
+	past := time.Now().Add(-time.Hour).UTC().Format(http.TimeFormat)
+	if w = request("If-Modified-Since", past); w.Code != http.StatusOK {
+		t.Errorf("Expected 200 for an older If-Modified-Since, got %d", w.Code)
+	}
+}
+
+func TestCachePage_HandlerValidators(t *testing.T) {
+	store := NewInMemoryStore(time.Minute)
+	modified := time.Date(2015, 1, 2, 3, 4, 5, 0, time.UTC)
+	router := gin.New()
+	router.GET("/doc", CachePage(store, time.Minute, func(c *gin.Context) {
+		c.Header("ETag", `W/"v1"`)
+		c.Header("Last-Modified", modified.Format(http.TimeFormat))
+		c.String(http.StatusOK, "doc")
+	}))
+	performRequest(router, "GET", "/doc")
+
+	req, _ := http.NewRequest("GET", "/doc", nil)
+	req.Header.Set("If-None-Match", `"v1"`)
+	w := httptest.NewRecorder()
+	router.ServeHTTP(w, req)
+	if w.Code != http.StatusNotModified || w.Header().Get("ETag") != `W/"v1"` {
+		t.Errorf("Expected the handler's ETag to be used, got %d %v", w.Code, w.Header())
+	}
+
+	req, _ = http.NewRequest("GET", "/doc", nil)
+	req.Header.Set("If-Modified-Since", modified.Add(time.Hour).Format(http.TimeFormat))
+	w = httptest.NewRecorder()
+	router.ServeHTTP(w, req)
+	if w.Code != http.StatusNotModified {
+		t.Errorf("Expected the handler's Last-Modified to be used, got %d", w.Code)
+	}
+}
@@ -0,0 +1,181 @@
+package cache
+
+import (
+	"context"
+	"reflect"
+	"time"
+)
+
+// ContextStore is the context-aware counterpart of CacheStore. Operations give
+// up with the error of the context once it is cancelled or its deadline is
+// exceeded; a command already sent to a remote store may still complete.
+//
+// It also has batch operations and expiration inspection. Use
+// NewContextStore to get a ContextStore from any CacheStore.
+type ContextStore interface {
+	GetContext(ctx context.Context, key string, value interface{}) error
+	SetContext(ctx context.Context, key string, value interface{}, expire time.Duration) error
+	AddContext(ctx context.Context, key string, value interface{}, expire time.Duration) error
+	ReplaceContext(ctx context.Context, key string, value interface{}, expire time.Duration) error
+	DeleteContext(ctx context.Context, key string) error
+	IncrementContext(ctx context.Context, key string, data uint64) (uint64, error)
+	DecrementContext(ctx context.Context, key string, data uint64) (uint64, error)
+	FlushContext(ctx context.Context) error
+
+	// GetMulti looks up all the keys of values at once, decoding each item
+	// found in the pointer its key maps to. Keys not found are removed from
+	// values.
+	GetMulti(ctx context.Context, values map[string]interface{}) error
+	// SetMulti stores all the items of values with the same expiration.
+	SetMulti(ctx context.Context, values map[string]interface{}, expire time.Duration) error
+	// DeleteMulti deletes the keys, ignoring those not found.
+	DeleteMulti(ctx context.Context, keys ...string) error
+	// TTL returns how long key has left to live, FOREVER if it does not
+	// expire, or ErrNotSupport if the store cannot tell.
+	TTL(ctx context.Context, key string) (time.Duration, error)
+	// Touch changes the expiration of an existing key.
+	Touch(ctx context.Context, key string, expire time.Duration) error
+}
+
+var (
+	_ ContextStore = (*InMemoryStore)(nil)
+	_ ContextStore = (*RedisStore)(nil)
+	_ ContextStore = (*MemcachedStore)(nil)
+)
+
+// NewContextStore returns store as a ContextStore. Stores implementing it
+// natively are returned as is, others are wrapped: their batch operations
+// are done one key at a time, TTL and Touch are not supported.
+func NewContextStore(store CacheStore) ContextStore {
+	if s, ok := store.(ContextStore); ok {
+		return s
+	}
+	return contextStore{store}
+}
+
+type contextStore struct {
+	store CacheStore
+}
+
+func (s contextStore) GetContext(ctx context.Context, key string, value interface{}) error {
+	return getContext(ctx, value, func(value interface{}) error { return s.store.Get(key, value) })
+}
+
+func (s contextStore) SetContext(ctx context.Context, key string, value interface{}, expire time.Duration) error {
+	return runContext(ctx, func() error { return s.store.Set(key, value, expire) })
+}
+
+func (s contextStore) AddContext(ctx context.Context, key string, value interface{}, expire time.Duration) error {
+	return runContext(ctx, func() error { return s.store.Add(key, value, expire) })
+}
+
+func (s contextStore) ReplaceContext(ctx context.Context, key string, value interface{}, expire time.Duration) error {
+	return runContext(ctx, func() error { return s.store.Replace(key, value, expire) })
+}
+
+func (s contextStore) DeleteContext(ctx context.Context, key string) error {
+	return runContext(ctx, func() error { return s.store.Delete(key) })
+}
+
+func (s contextStore) IncrementContext(ctx context.Context, key string, delta uint64) (uint64, error) {
+	return countContext(ctx, func() (uint64, error) { return s.store.Increment(key, delta) })
+}
+
+func (s contextStore) DecrementContext(ctx context.Context, key string, delta uint64) (uint64, error) {
+	return countContext(ctx, func() (uint64, error) { return s.store.Decrement(key, delta) })
+}
+
+func (s contextStore) FlushContext(ctx context.Context) error {
+	return runContext(ctx, s.store.Flush)
+}
+
+func (s contextStore) GetMulti(ctx context.Context, values map[string]interface{}) error {
+	for key, value := range values {
+		err := s.GetContext(ctx, key, value)
+		if err == ErrCacheMiss {
+			delete(values, key)
+		} else if err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+func (s contextStore) SetMulti(ctx context.Context, values map[string]interface{}, expire time.Duration) error {
+	for key, value := range values {
+		if err := s.SetContext(ctx, key, value, expire); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+func (s contextStore) DeleteMulti(ctx context.Context, keys ...string) error {
+	for _, key := range keys {
+		if err := s.DeleteContext(ctx, key); err != nil && err != ErrCacheMiss {
+			return err
+		}
+	}
+	return nil
+}
+
+func (s contextStore) TTL(ctx context.Context, key string) (time.Duration, error) {
+	return 0, ErrNotSupport
+}
+
+func (s contextStore) Touch(ctx context.Context, key string, expire time.Duration) error {
+	return ErrNotSupport
+}
+
+// runContext runs f, returning early with the error of ctx if it is done
+// first. f keeps running in the background in that case, so it must release
+// its own resources and must not write anything the caller can see: results
+// are only read once runContext returned without error.
+func runContext(ctx context.Context, f func() error) error {
+	if err := ctx.Err(); err != nil {
+		return err
+	}
+	if ctx.Done() == nil {
+		return f()
+	}
+	done := make(chan error, 1)
+	go func() {
+		done <- f()
+	}()
+	select {
+	case err := <-done:
+		return err
+	case <-ctx.Done():
+		return ctx.Err()
+	}
+}
+
+// getContext runs get with runContext, decoding into a value private to get
+// which is copied into value, a pointer, only once get succeeded. An
+// abandoned get so never writes into value.
+func getContext(ctx context.Context, value interface{}, get func(value interface{}) error) error {
+	ptr := reflect.ValueOf(value)
+	if ptr.Kind() != reflect.Ptr || ptr.IsNil() {
+		// Let the store report the invalid value.
+		return runContext(ctx, func() error { return get(value) })
+	}
+	private := reflect.New(ptr.Type().Elem())
+	if err := runContext(ctx, func() error { return get(private.Interface()) }); err != nil {
+		return err
+	}
+	ptr.Elem().Set(private.Elem())
+	return nil
+}
+
+// countContext runs count with runContext.
+func countContext(ctx context.Context, count func() (uint64, error)) (uint64, error) {
+	var n uint64
+	err := runContext(ctx, func() (err error) {
+		n, err = count()
+		return err
+	})
+	if err != nil {
+		return 0, err
+	}
+	return n, nil
+}
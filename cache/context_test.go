@@ -0,0 +1,129 @@
+package cache
+
+import (
+	"context"
+	"testing"
+	"time"
+)
+
+// contextContract checks the operations specific to ContextStore.
+func contextContract(t *testing.T, store ContextStore) {
+	ctx := context.Background()
+	if err := store.FlushContext(ctx); err != nil {
+		t.Fatalf("Error flushing: %s", err)
+	}
+
+	err := store.SetMulti(ctx, map[string]interface{}{"int": 1, "string": "foo"}, time.Hour)
+	if err != nil {
+		t.Fatalf("Error setting multiple values: %s", err)
+	}
+	var i int
+	var s, missing string
+	values := map[string]interface{}{"int": &i, "string": &s, "missing": &missing}
+	if err = store.GetMulti(ctx, values); err != nil {
+		t.Fatalf("Error getting multiple values: %s", err)
+	}
+	if i != 1 || s != "foo" {
+		t.Errorf("Expected 1 and foo, got %d and %q", i, s)
+	}
+	if _, ok := values["missing"]; ok || len(values) != 2 {
+		t.Errorf("Expected only the missing key to be removed, got %v", values)
+	}
+
+	if err = store.DeleteMulti(ctx, "int", "missing"); err != nil {
+		t.Errorf("Error deleting multiple values: %s", err)
+	}
+	if err = store.GetContext(ctx, "int", &i); err != ErrCacheMiss {
+		t.Errorf("Expected a deleted key to be missing, got %v", err)
+	}
+
+	if err = store.Touch(ctx, "missing", time.Hour); err != ErrCacheMiss && err != ErrNotSupport {
+		t.Errorf("Expected ErrCacheMiss touching a missing key, got %v", err)
+	}
+	if err = store.Touch(ctx, "string", 2*time.Hour); err != nil && err != ErrNotSupport {
+		t.Errorf("Error touching a key: %s", err)
+	}
+	if ttl, err := store.TTL(ctx, "string"); err == nil {
+		if ttl <= time.Hour || ttl > 2*time.Hour {
+			t.Errorf("Expected a TTL of 2h after touching, got %s", ttl)
+		}
+		if _, err = store.TTL(ctx, "missing"); err != ErrCacheMiss {
+			t.Errorf("Expected ErrCacheMiss for the TTL of a missing key, got %v", err)
+		}
+		if err = store.SetContext(ctx, "forever", 1, FOREVER); err != nil {
+			t.Fatalf("Error setting a value: %s", err)
+		}
+		if ttl, err = store.TTL(ctx, "forever"); err != nil || ttl != FOREVER {
+			t.Errorf("Expected FOREVER, got %s: %v", ttl, err)
+		}
+	} else if err != ErrNotSupport {
+		t.Errorf("Error getting a TTL: %s", err)
+	}
+
+	if err = store.AddContext(ctx, "counter", 1, time.Hour); err != nil {
+		t.Fatalf("Error adding a value: %s", err)
+	}
+	if n, err := store.IncrementContext(ctx, "counter", 2); err != nil || n != 3 {
+		t.Errorf("Expected 3, got %d: %v", n, err)
+	}
+
+	cancelled, cancel := context.WithCancel(ctx)
+	cancel()
+	if err = store.GetContext(cancelled, "string", &s); err != context.Canceled {
+		t.Errorf("Expected context.Canceled, got %v", err)
+	}
+	if err = store.SetMulti(cancelled, map[string]interface{}{"int": 2}, time.Hour); err != context.Canceled {
+		t.Errorf("Expected context.Canceled, got %v", err)
+	}
+}
+
+func TestNewContextStore(t *testing.T) {
+	store := NewInMemoryStore(time.Hour)
+	if NewContextStore(store) != ContextStore(store) {
+		t.Errorf("Expected a native ContextStore to be returned as is")
+	}
+
+	// Hide the native implementation to test the adapter.
+	adapted := NewContextStore(struct{ CacheStore }{store})
+	if _, ok := adapted.(contextStore); !ok {
+		t.Fatalf("Expected an adapter, got %T", adapted)
+	}
+	contextContract(t, adapted)
+}
+
+// slowStore holds the lookups until release is closed, and reports on done
+// when they are over.
+type slowStore struct {
+	CacheStore
+	release chan struct{}
+	done    chan struct{}
+}
+
+func (s slowStore) Get(key string, value interface{}) error {
+	<-s.release
+	defer func() { s.done <- struct{}{} }()
+	return s.CacheStore.Get(key, value)
+}
+
+func TestGetContext_Abandoned(t *testing.T) {
+	inner := NewInMemoryStore(time.Hour)
+	inner.Set("string", "stored", DEFAULT)
+	slow := slowStore{inner, make(chan struct{}), make(chan struct{}, 1)}
+	store := NewContextStore(slow)
+
+	ctx, cancel := context.WithTimeout(context.Background(), 10*time.Millisecond)
+	defer cancel()
+	s := "unchanged"
+	if err := store.GetContext(ctx, "string", &s); err != context.DeadlineExceeded {
+		t.Errorf("Expected context.DeadlineExceeded, got %v", err)
+	}
+	close(slow.release)
+	<-slow.done
+	if s != "unchanged" {
+		t.Errorf("Expected an abandoned lookup to leave the value alone, got %q", s)
+	}
+
+	if err := store.GetContext(context.Background(), "string", &s); err != nil || s != "stored" {
+		t.Errorf("Expected stored, got %q: %v", s, err)
+	}
+}
@@ -0,0 +1,462 @@
+package cache
+
+import (
+	"crypto/sha1"
+	"encoding/binary"
+	"encoding/hex"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"time"
+)
+
+const (
+	// diskItemVersion is the first byte of every item file, followed by
+	// the expiration as big-endian Unix nanoseconds, 0 for never, and the
+	// serialized value.
+	diskItemVersion byte = 1
+	diskHeaderSize       = 9
+
+	defaultDiskSweepInterval = time.Minute
+
+	// diskTempDir holds the files being written, diskTempAge is when the
+	// sweeper considers them abandoned.
+	diskTempDir    = ".tmp"
+	diskTempPrefix = "item"
+	diskTempAge    = time.Hour
+)
+
+// DiskStore keeps the items in files, one per key, so that they survive
+// restarts. Files are spread over 65536 directories by the hash of their key
+// and written atomically by renaming complete temporary files.
+//
+// The atomic operations are only atomic within the process: a directory must
+// not be shared by several processes. Writes are not synced to the disk, so
+// items written just before a crash may be lost.
+type DiskStore struct {
+	// Accessed atomically, first to be 64-bit aligned.
+	size int64
+
+	dir               string
+	defaultExpiration time.Duration
+	serializer        Serializer
+	maxBytes          int64
+
+	locks [256]sync.Mutex
+	wake  chan struct{}
+	stop  chan struct{}
+	once  sync.Once
+}
+
+// DiskOptions holds the optional settings of a DiskStore.
+type DiskOptions struct {
+	// Serializer encodes the values. Without one, values are encoded with
+	// gob and no header, as in the other stores.
+	Serializer Serializer
+
+	// MaxBytes caps the total size of the files. When it is exceeded, the
+	// sweeper deletes the least recently written items. Zero means no cap.
+	MaxBytes int64
+
+	// SweepInterval is how often expired items are deleted in the
+	// background, one minute by default. A negative value disables the
+	// sweeper, which also disables MaxBytes.
+	SweepInterval time.Duration
+}
+
+func NewDiskStore(dir string, defaultExpiration time.Duration) *DiskStore {
+	return NewDiskStoreWithOptions(dir, defaultExpiration, DiskOptions{})
+}
+
+// NewDiskStoreWithOptions is like NewDiskStore but accepts DiskOptions. The
+// sweeper runs until Close is called.
+func NewDiskStoreWithOptions(dir string, defaultExpiration time.Duration, options DiskOptions) *DiskStore {
+	c := &DiskStore{
+		dir:               dir,
+		defaultExpiration: defaultExpiration,
+		serializer:        options.Serializer,
+		maxBytes:          options.MaxBytes,
+		wake:              make(chan struct{}, 1),
+		stop:              make(chan struct{}),
+	}
+	if options.SweepInterval >= 0 {
+		if options.SweepInterval == 0 {
+			options.SweepInterval = defaultDiskSweepInterval
+		}
+		go c.sweeper(options.SweepInterval)
+	}
+	return c
+}
+
+// Close stops the sweeper.
+func (c *DiskStore) Close() error {
+	c.once.Do(func() { close(c.stop) })
+	return nil
+}
+
+func (c *DiskStore) Get(key string, value interface{}) error {
+	data, _, err := c.read(c.path(key))
+	if err != nil {
+		return err
+	}
+	return deserialize(c.serializer, data, value)
+}
+
+func (c *DiskStore) Set(key string, value interface{}, expires time.Duration) error {
+	return c.store(key, value, expires, func(found bool) bool { return true })
+}
+
+func (c *DiskStore) Add(key string, value interface{}, expires time.Duration) error {
+	return c.store(key, value, expires, func(found bool) bool { return !found })
+}
+
+func (c *DiskStore) Replace(key string, value interface{}, expires time.Duration) error {
+	return c.store(key, value, expires, func(found bool) bool { return found })
+}
+
+func (c *DiskStore) Delete(key string) error {
+	path := c.path(key)
+	lock := c.lock(path)
+	lock.Lock()
+	defer lock.Unlock()
+	if _, _, err := c.read(path); err != nil {
+		return err
+	}
+	return c.remove(path)
+}
+
+func (c *DiskStore) Increment(key string, delta uint64) (uint64, error) {
+	return c.count(key, func(n uint64) uint64 { return n + delta })
+}
+
+func (c *DiskStore) Decrement(key string, delta uint64) (uint64, error) {
+	return c.count(key, func(n uint64) uint64 {
+		if delta > n {
+			return 0
+		}
+		return n - delta
+	})
+}
+
+// Flush deletes every item. Other files in the directory of the store are left
+// untouched.
+func (c *DiskStore) Flush() error {
+	for i := range c.locks {
+		c.locks[i].Lock()
+	}
+	defer func() {
+		for i := range c.locks {
+			c.locks[i].Unlock()
+		}
+	}()
+	entries, err := ioutil.ReadDir(c.dir)
+	if os.IsNotExist(err) {
+		return nil
+	}
+	if err != nil {
+		return err
+	}
+	for _, entry := range entries {
+		if !entry.IsDir() || !isHex(entry.Name(), 2) {
+			continue
+		}
+		if err = os.RemoveAll(filepath.Join(c.dir, entry.Name())); err != nil {
+			return err
+		}
+	}
+	atomic.StoreInt64(&c.size, 0)
+	return nil
+}
+
+// store writes key if ok returns true given whether key exists.
+func (c *DiskStore) store(key string, value interface{}, expires time.Duration, ok func(found bool) bool) error {
+	switch expires {
+	case DEFAULT:
+		expires = c.defaultExpiration
+	case FOREVER:
+		expires = time.Duration(0)
+	}
+	var deadline time.Time
+	if expires > 0 {
+		deadline = time.Now().Add(expires)
+	}
+	data, err := serialize(c.serializer, value)
+	if err != nil {
+		return err
+	}
+
+	path := c.path(key)
+	lock := c.lock(path)
+	lock.Lock()
+	defer lock.Unlock()
+	_, _, err = c.read(path)
+	if err != nil && err != ErrCacheMiss {
+		return err
+	}
+	if !ok(err == nil) {
+		return ErrNotStored
+	}
+	return c.write(path, data, deadline)
+}
+
+// count updates the integer at key with f, keeping its expiration.
+func (c *DiskStore) count(key string, f func(uint64) uint64) (uint64, error) {
+	path := c.path(key)
+	lock := c.lock(path)
+	lock.Lock()
+	defer lock.Unlock()
+	data, expires, err := c.read(path)
+	if err != nil {
+		return 0, err
+	}
+	n, err := strconv.ParseUint(string(data), 10, 64)
+	if err != nil {
+		return 0, err
+	}
+	n = f(n)
+	return n, c.write(path, []byte(strconv.FormatUint(n, 10)), expires)
+}
+
+// path returns the file of key: the hex SHA-1 of key, in directories named
+// after its first two bytes.
+func (c *DiskStore) path(key string) string {
+	sum := sha1.Sum([]byte(key))
+	name := hex.EncodeToString(sum[:])
+	return filepath.Join(c.dir, name[0:2], name[2:4], name)
+}
+
+// lock returns the lock of the items sharing the first directory of path.
+// Only item paths are locked, anything else gets the first lock.
+func (c *DiskStore) lock(path string) *sync.Mutex {
+	var b []byte
+	if name := filepath.Base(path); len(name) >= 2 {
+		b, _ = hex.DecodeString(name[0:2])
+	}
+	if len(b) == 0 {
+		return &c.locks[0]
+	}
+	return &c.locks[b[0]]
+}
+
+// isItem reports whether path, relative to the directory of the store, is
+// laid out as returned by path: xx/yy/xxyy... with 40 hex digits.
+func isItem(path string) bool {
+	parts := strings.Split(filepath.ToSlash(path), "/")
+	return len(parts) == 3 && isHex(parts[0], 2) && isHex(parts[1], 2) &&
+		isHex(parts[2], 2*sha1.Size) && parts[2][0:4] == parts[0]+parts[1]
+}
+
+// isHex reports whether s is made of n lowercase hex digits.
+func isHex(s string, n int) bool {
+	if len(s) != n {
+		return false
+	}
+	for _, r := range s {
+		if !('0' <= r && r <= '9' || 'a' <= r && r <= 'f') {
+			return false
+		}
+	}
+	return true
+}
+
+// read returns the value and expiration of the item at path. Expired and
+// unreadable items are misses, left to the sweeper as the lock of path may
+// not be held.
+func (c *DiskStore) read(path string) ([]byte, time.Time, error) {
+	data, err := ioutil.ReadFile(path)
+	if os.IsNotExist(err) {
+		return nil, time.Time{}, ErrCacheMiss
+	}
+	if err != nil {
+		return nil, time.Time{}, err
+	}
+	expires, ok := diskExpiration(data)
+	// Written by another version, corrupted, or expired.
+	if !ok || (!expires.IsZero() && !time.Now().Before(expires)) {
+		return nil, time.Time{}, ErrCacheMiss
+	}
+	return data[diskHeaderSize:], expires, nil
+}
+
+// write replaces the file at path atomically.
+func (c *DiskStore) write(path string, data []byte, expires time.Time) error {
+	tmp := filepath.Join(c.dir, diskTempDir)
+	if err := os.MkdirAll(tmp, 0755); err != nil {
+		return err
+	}
+	if err := os.MkdirAll(filepath.Dir(path), 0755); err != nil {
+		return err
+	}
+	f, err := ioutil.TempFile(tmp, diskTempPrefix)
+	if err != nil {
+		return err
+	}
+	var header [diskHeaderSize]byte
+	header[0] = diskItemVersion
+	if !expires.IsZero() {
+		binary.BigEndian.PutUint64(header[1:], uint64(expires.UnixNano()))
+	}
+	_, err = f.Write(header[:])
+	if err == nil {
+		_, err = f.Write(data)
+	}
+	if closeErr := f.Close(); err == nil {
+		err = closeErr
+	}
+	if err != nil {
+		os.Remove(f.Name())
+		return err
+	}
+
+	var old int64
+	if info, err := os.Stat(path); err == nil {
+		old = info.Size()
+	}
+	if err = os.Rename(f.Name(), path); err != nil {
+		os.Remove(f.Name())
+		return err
+	}
+	size := atomic.AddInt64(&c.size, int64(len(header)+len(data))-old)
+	if c.maxBytes > 0 && size > c.maxBytes {
+		select {
+		case c.wake <- struct{}{}:
+		default:
+		}
+	}
+	return nil
+}
+
+func (c *DiskStore) remove(path string) error {
+	info, err := os.Stat(path)
+	if err == nil {
+		err = os.Remove(path)
+	}
+	if os.IsNotExist(err) {
+		return ErrCacheMiss
+	}
+	if err == nil {
+		atomic.AddInt64(&c.size, -info.Size())
+	}
+	return err
+}
+
+// diskExpiration parses the header of an item file.
+func diskExpiration(data []byte) (time.Time, bool) {
+	if len(data) < diskHeaderSize || data[0] != diskItemVersion {
+		return time.Time{}, false
+	}
+	nsec := int64(binary.BigEndian.Uint64(data[1:diskHeaderSize]))
+	if nsec == 0 {
+		return time.Time{}, true
+	}
+	return time.Unix(0, nsec), true
+}
+
+// sweeper sweeps the store every interval, or as soon as it grows over its
+// cap, until Close.
+func (c *DiskStore) sweeper(interval time.Duration) {
+	ticker := time.NewTicker(interval)
+	defer ticker.Stop()
+	c.sweep()
+	for {
+		select {
+		case <-c.stop:
+			return
+		case <-ticker.C:
+		case <-c.wake:
+		}
+		c.sweep()
+	}
+}
+
+type diskFile struct {
+	path     string
+	size     int64
+	modified time.Time
+}
+
+// sweep deletes the expired items and abandoned temporary files, then the
+// least recently written items while the store is over its cap. It also
+// recounts the size of the store. Files it did not create are left alone.
+func (c *DiskStore) sweep() {
+	now := time.Now()
+	var files []diskFile
+	var size int64
+	filepath.Walk(c.dir, func(path string, info os.FileInfo, err error) error {
+		rel, relErr := filepath.Rel(c.dir, path)
+		if err != nil || relErr != nil || rel == "." {
+			return nil
+		}
+		depth := len(strings.Split(filepath.ToSlash(rel), "/"))
+		if info.IsDir() {
+			// Only descend into the shard directories and the temporary one.
+			name := info.Name()
+			if depth > 2 || (depth == 1 && name != diskTempDir && !isHex(name, 2)) ||
+				(depth == 2 && !isHex(name, 2)) {
+				return filepath.SkipDir
+			}
+			return nil
+		}
+		if depth == 2 && filepath.Base(filepath.Dir(path)) == diskTempDir {
+			if strings.HasPrefix(info.Name(), diskTempPrefix) && now.Sub(info.ModTime()) > diskTempAge {
+				os.Remove(path)
+			}
+			return nil
+		}
+		if !isItem(rel) {
+			return nil
+		}
+		if c.expired(path, now) {
+			return nil
+		}
+		files = append(files, diskFile{path, info.Size(), info.ModTime()})
+		size += info.Size()
+		return nil
+	})
+	atomic.StoreInt64(&c.size, size)
+	if c.maxBytes <= 0 || size <= c.maxBytes {
+		return
+	}
+
+	sort.Slice(files, func(i, j int) bool { return files[i].modified.Before(files[j].modified) })
+	for _, f := range files {
+		if atomic.LoadInt64(&c.size) <= c.maxBytes {
+			return
+		}
+		lock := c.lock(f.path)
+		lock.Lock()
+		c.remove(f.path)
+		lock.Unlock()
+	}
+}
+
+// expired deletes the item at path if it expired, reporting whether it did.
+func (c *DiskStore) expired(path string, now time.Time) bool {
+	f, err := os.Open(path)
+	if err != nil {
+		return false
+	}
+	header := make([]byte, diskHeaderSize)
+	_, err = f.Read(header)
+	f.Close()
+	expires, ok := diskExpiration(header)
+	if err != nil || !ok || (!expires.IsZero() && !now.Before(expires)) {
+		lock := c.lock(path)
+		lock.Lock()
+		defer lock.Unlock()
+		// Check again, it may have been rewritten meanwhile.
+		if data, err := ioutil.ReadFile(path); err == nil {
+			if expires, ok := diskExpiration(data); ok && (expires.IsZero() || now.Before(expires)) {
+				return false
+			}
+		}
+		os.Remove(path)
+		return true
+	}
+	return false
+}
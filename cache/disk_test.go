@@ -0,0 +1,230 @@
+package cache
+
+import (
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+)
+
+// withDiskStores runs f with a factory of disk stores in temporary
+// directories, removed afterwards.
+func withDiskStores(t *testing.T, f func(*testing.T, cacheFactory)) {
+	dir, err := ioutil.TempDir("", "cache")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	f(t, func(t *testing.T, defaultExpiration time.Duration) CacheStore {
+		storeDir, err := ioutil.TempDir(dir, "store")
+		if err != nil {
+			t.Fatal(err)
+		}
+		return NewDiskStoreWithOptions(storeDir, defaultExpiration, DiskOptions{SweepInterval: -1})
+	})
+}
+
+func TestDiskCache_TypicalGetSet(t *testing.T) {
+	withDiskStores(t, typicalGetSet)
+}
+
+func TestDiskCache_IncrDecr(t *testing.T) {
+	withDiskStores(t, incrDecr)
+}
+
+func TestDiskCache_Expiration(t *testing.T) {
+	withDiskStores(t, expiration)
+}
+
+func TestDiskCache_EmptyCache(t *testing.T) {
+	withDiskStores(t, emptyCache)
+}
+
+func TestDiskCache_Replace(t *testing.T) {
+	withDiskStores(t, testReplace)
+}
+
+func TestDiskCache_Add(t *testing.T) {
+	withDiskStores(t, testAdd)
+}
+
+func TestDiskCache_Concurrency(t *testing.T) {
+	withDiskStores(t, concurrency)
+}
+
+func TestDiskCache_CachePage(t *testing.T) {
+	withDiskStores(t, func(t *testing.T, newStore cacheFactory) {
+		cachePage(t, newStore(t, time.Hour))
+	})
+}
+
+func TestDiskCache_Persistence(t *testing.T) {
+	dir, err := ioutil.TempDir("", "cache")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+
+	store := NewDiskStore(dir, time.Hour)
+	store.Set("page", "content", DEFAULT)
+	store.Set("hits", 1, time.Second)
+	store.Close()
+
+	store = NewDiskStore(dir, time.Hour)
+	defer store.Close()
+	var page string
+	if err = store.Get("page", &page); err != nil || page != "content" {
+		t.Errorf("Expected the page to survive a restart, got %q, %v", page, err)
+	}
+	if n, err := store.Increment("hits", 1); err != nil || n != 2 {
+		t.Errorf("Expected 2, got %d, %v", n, err)
+	}
+	// Incrementing keeps the expiration.
+	time.Sleep(1100 * time.Millisecond)
+	if _, err = store.Increment("hits", 1); err != ErrCacheMiss {
+		t.Errorf("Expected the counter to expire, got %v", err)
+	}
+}
+
+// diskFiles returns the number of item files in dir.
+func diskFiles(dir string) int {
+	n := 0
+	filepath.Walk(dir, func(path string, info os.FileInfo, err error) error {
+		if err == nil && !info.IsDir() && !strings.Contains(path, diskTempDir) {
+			n++
+		}
+		return nil
+	})
+	return n
+}
+
+func TestDiskCache_Sweep(t *testing.T) {
+	dir, err := ioutil.TempDir("", "cache")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+
+	store := NewDiskStoreWithOptions(dir, time.Hour, DiskOptions{SweepInterval: 50 * time.Millisecond})
+	defer store.Close()
+	store.Set("short", "value", 100*time.Millisecond)
+	store.Set("long", "value", DEFAULT)
+
+	for deadline := time.Now().Add(5 * time.Second); diskFiles(dir) != 1; {
+		if time.Now().After(deadline) {
+			t.Fatalf("Expected the expired item to be swept, %d files left", diskFiles(dir))
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+}
+
+func TestDiskCache_MaxBytes(t *testing.T) {
+	dir, err := ioutil.TempDir("", "cache")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+
+	value := strings.Repeat("x", 1000)
+	store := NewDiskStoreWithOptions(dir, time.Hour, DiskOptions{MaxBytes: 3500})
+	defer store.Close()
+	for _, key := range []string{"a", "b", "c"} {
+		store.Set(key, value, DEFAULT)
+		// Distinct modification times, some file systems are coarse.
+		past := time.Now().Add(-time.Hour)
+		if key == "a" {
+			past = past.Add(-time.Hour)
+		}
+		os.Chtimes(store.path(key), past, past)
+	}
+	store.Set("d", value, DEFAULT)
+
+	stored := func() string {
+		var found []string
+		for _, key := range []string{"a", "b", "c", "d"} {
+			var s string
+			if store.Get(key, &s) == nil {
+				found = append(found, key)
+			}
+		}
+		return strings.Join(found, " ")
+	}
+	for deadline := time.Now().Add(5 * time.Second); stored() != "b c d"; {
+		if time.Now().After(deadline) {
+			t.Fatalf("Expected the oldest item to be evicted, got %q", stored())
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+}
+
+func TestDiskCache_ForeignFiles(t *testing.T) {
+	dir, err := ioutil.TempDir("", "cache")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	foreign := []string{
+		filepath.Join(dir, "README"),
+		filepath.Join(dir, "notes", "a.txt"),
+		filepath.Join(dir, "ab", "zz"),
+		filepath.Join(dir, diskTempDir, "other"),
+	}
+	for _, path := range foreign {
+		os.MkdirAll(filepath.Dir(path), 0755)
+		if err = ioutil.WriteFile(path, []byte("x"), 0644); err != nil {
+			t.Fatal(err)
+		}
+		old := time.Now().Add(-2 * diskTempAge)
+		os.Chtimes(path, old, old)
+	}
+
+	store := NewDiskStoreWithOptions(dir, time.Hour, DiskOptions{SweepInterval: -1})
+	store.Set("value", "stored", DEFAULT)
+	store.sweep()
+	for _, path := range foreign {
+		if _, err := os.Stat(path); err != nil {
+			t.Errorf("Expected %s to survive a sweep, got %v", path, err)
+		}
+	}
+
+	// Flush removes the shard directories, including ab.
+	if err = store.Flush(); err != nil {
+		t.Fatalf("Error flushing: %s", err)
+	}
+	for _, path := range []string{foreign[0], foreign[1], foreign[3]} {
+		if _, err := os.Stat(path); err != nil {
+			t.Errorf("Expected %s to survive a flush, got %v", path, err)
+		}
+	}
+	if n := diskFiles(dir); n != 2 {
+		t.Errorf("Expected only the foreign files to be left, got %d files", n)
+	}
+}
+
+func TestDiskCache_ExpiredRace(t *testing.T) {
+	dir, err := ioutil.TempDir("", "cache")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	store := NewDiskStoreWithOptions(dir, time.Hour, DiskOptions{SweepInterval: -1})
+
+	// Reading an expired item must not delete the one written meanwhile.
+	for i := 0; i < 50; i++ {
+		store.Set("value", "old", time.Nanosecond)
+		done := make(chan struct{})
+		go func() {
+			var value string
+			store.Get("value", &value)
+			close(done)
+		}()
+		store.Set("value", "new", DEFAULT)
+		<-done
+		var value string
+		if err := store.Get("value", &value); err != nil || value != "new" {
+			t.Fatalf("Expected new, got %q: %v", value, err)
+		}
+	}
+}
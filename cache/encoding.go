@@ -0,0 +1,173 @@
+package cache
+
+import (
+	"bytes"
+	"compress/gzip"
+	"io/ioutil"
+	"net/http"
+	"sort"
+	"strconv"
+	"strings"
+)
+
+// encode normalizes a response about to be stored: its body is kept in the
+// identity encoding, along with a gzip variant if the handler compressed it
+// or if level is not zero. outer reports whether a middleware running before
+// the handler, such as gzip.Gzip, encodes the response, in which case the
+// body was captured before being encoded.
+func (r *responseCache) encode(outer bool, level int) error {
+	r.header.Del("Content-Length")
+	if outer {
+		r.header.Del("Content-Encoding")
+		removeVary(r.header, "Accept-Encoding")
+	}
+	switch strings.ToLower(r.header.Get("Content-Encoding")) {
+	case "":
+	case "gzip", "x-gzip":
+		identity, err := gunzip(r.data)
+		if err != nil {
+			return err
+		}
+		r.data, r.gzip = identity, r.data
+		r.header.Del("Content-Encoding")
+		return nil
+	default:
+		// Encoded by the handler with something else, kept as is.
+		return nil
+	}
+
+	if level == 0 || len(r.data) == 0 {
+		return nil
+	}
+	var b bytes.Buffer
+	gz, err := gzip.NewWriterLevel(&b, level)
+	if err != nil {
+		return err
+	}
+	gz.Write(r.data)
+	if err = gz.Close(); err != nil {
+		return err
+	}
+	// Not worth it for small or already compressed bodies.
+	if b.Len() < len(r.data) {
+		r.gzip = b.Bytes()
+	}
+	return nil
+}
+
+func gunzip(data []byte) ([]byte, error) {
+	gz, err := gzip.NewReader(bytes.NewReader(data))
+	if err != nil {
+		return nil, err
+	}
+	defer gz.Close()
+	return ioutil.ReadAll(gz)
+}
+
+// acceptsGzip reports whether the Accept-Encoding header of req allows a gzip
+// response, per RFC 7231 section 5.3.4.
+func acceptsGzip(req *http.Request) bool {
+	gzipQ, anyQ := -1.0, -1.0
+	for _, value := range req.Header["Accept-Encoding"] {
+		for _, coding := range strings.Split(value, ",") {
+			params := strings.Split(coding, ";")
+			q := 1.0
+			for _, param := range params[1:] {
+				param = strings.TrimSpace(param)
+				if len(param) > 2 && strings.EqualFold(param[:2], "q=") {
+					if f, err := strconv.ParseFloat(param[2:], 64); err == nil {
+						q = f
+					}
+				}
+			}
+			switch strings.ToLower(strings.TrimSpace(params[0])) {
+			case "gzip", "x-gzip":
+				gzipQ = q
+			case "*":
+				anyQ = q
+			}
+		}
+	}
+	return gzipQ > 0 || (gzipQ < 0 && anyQ > 0)
+}
+
+// gzipETag returns the entity tag of the gzip variant of a response whose
+// identity body has etag, as both must differ.
+func gzipETag(etag string) string {
+	if strings.HasSuffix(etag, `"`) && len(etag) > 1 {
+		return etag[:len(etag)-1] + `-gzip"`
+	}
+	return etag
+}
+
+// addVary adds the fields listed in value to the Vary header of h, unless
+// they are already there.
+func addVary(h http.Header, value string) {
+	for _, field := range strings.Split(value, ",") {
+		field = strings.TrimSpace(field)
+		if field != "" && !varies(h, field) {
+			h.Add("Vary", field)
+		}
+	}
+}
+
+// varies reports whether the Vary header of h lists field, or "*".
+func varies(h http.Header, field string) bool {
+	for _, value := range h["Vary"] {
+		for _, f := range strings.Split(value, ",") {
+			f = strings.TrimSpace(f)
+			if f == "*" || strings.EqualFold(f, field) {
+				return true
+			}
+		}
+	}
+	return false
+}
+
+// removeVary removes field from the Vary header of h.
+func removeVary(h http.Header, field string) {
+	var kept []string
+	for _, value := range h["Vary"] {
+		for _, f := range strings.Split(value, ",") {
+			f = strings.TrimSpace(f)
+			if f != "" && !strings.EqualFold(f, field) {
+				kept = append(kept, f)
+			}
+		}
+	}
+	if len(kept) == 0 {
+		h.Del("Vary")
+	} else {
+		h["Vary"] = []string{strings.Join(kept, ", ")}
+	}
+}
+
+// varyFields returns the canonical names of the request headers listed in the
+// Vary header of h, sorted. Accept-Encoding, handled by the gzip variant, and
+// "*" are left out.
+func varyFields(h http.Header) []string {
+	var fields []string
+	for _, value := range h["Vary"] {
+		for _, f := range strings.Split(value, ",") {
+			f = http.CanonicalHeaderKey(strings.TrimSpace(f))
+			if f != "" && f != "*" && f != "Accept-Encoding" && !containsString(fields, f) {
+				fields = append(fields, f)
+			}
+		}
+	}
+	sort.Strings(fields)
+	return fields
+}
+
+// varyKey returns the suffix of the key of a page for the values of the
+// request headers fields in r.
+func varyKey(fields []string, r *http.Request) string {
+	var b bytes.Buffer
+	for _, f := range fields {
+		b.WriteString("|")
+		b.WriteString(f)
+		b.WriteString("=")
+		b.WriteString(strings.Join(r.Header[f], ","))
+	}
+	return b.String()
+}
@@ -0,0 +1,188 @@
+package cache
+
+import (
+	"bytes"
+	"compress/gzip"
+	"net/http"
+	"net/http/httptest"
+	"strconv"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/gin-gonic/gin"
+)
+
+func TestAcceptsGzip(t *testing.T) {
+	cases := []struct {
+		header string
+		ok     bool
+	}{
+		{"", false},
+		{"gzip", true},
+		{"deflate, gzip;q=0.5", true},
+		{"GZIP", true},
+		{"x-gzip", true},
+		{"gzip;q=0", false},
+		{"*", true},
+		{"*;q=0", false},
+		{"gzip;q=0, *", false},
+		{"br", false},
+	}
+	for _, tc := range cases {
+		req, _ := http.NewRequest("GET", "/", nil)
+		req.Header.Set("Accept-Encoding", tc.header)
+		if ok := acceptsGzip(req); ok != tc.ok {
+			t.Errorf("acceptsGzip(%q): expected %t", tc.header, tc.ok)
+		}
+	}
+}
+
+func TestVary(t *testing.T) {
+	h := http.Header{"Vary": {"Origin, accept-encoding"}}
+	addVary(h, "Accept-Encoding, Cookie")
+	if vary := strings.Join(h["Vary"], ", "); vary != "Origin, accept-encoding, Cookie" {
+		t.Errorf("Expected Accept-Encoding not to be repeated, got %q", vary)
+	}
+	removeVary(h, "Accept-Encoding")
+	if vary := strings.Join(h["Vary"], ", "); vary != "Origin, Cookie" {
+		t.Errorf("Expected Accept-Encoding to be removed, got %q", vary)
+	}
+}
+
+func gzipped(s string) []byte {
+	var b bytes.Buffer
+	gz := gzip.NewWriter(&b)
+	gz.Write([]byte(s))
+	gz.Close()
+	return b.Bytes()
+}
+
+// requestEncoding performs a GET request accepting encoding, and returns the
+// response with its decoded body.
+func requestEncoding(t *testing.T, r http.Handler, path, encoding string) (*httptest.ResponseRecorder, string) {
+	req, _ := http.NewRequest("GET", path, nil)
+	req.Header.Set("Accept-Encoding", encoding)
+	w := httptest.NewRecorder()
+	r.ServeHTTP(w, req)
+	body := w.Body.Bytes()
+	if w.Header().Get("Content-Encoding") == "gzip" {
+		var err error
+		if body, err = gunzip(body); err != nil {
+			t.Fatalf("Error decompressing %s: %s", path, err)
+		}
+	}
+	return w, string(body)
+}
+
+var page = strings.Repeat("compressible page ", 100)
+
+func TestCachePage_GzipLevel(t *testing.T) {
+	store := NewInMemoryStore(time.Minute)
+	router := gin.New()
+	router.GET("/page", CachePageWithOptions(store, time.Minute, Options{GzipLevel: gzip.BestSpeed}, func(c *gin.Context) {
+		c.String(http.StatusOK, page)
+	}))
+	requestEncoding(t, router, "/page", "")
+
+	w, body := requestEncoding(t, router, "/page", "gzip, deflate")
+	if w.Header().Get("Content-Encoding") != "gzip" || body != page {
+		t.Fatalf("Expected the gzip variant, got %v", w.Header())
+	}
+	if w.Header().Get("Content-Length") != strconv.Itoa(w.Body.Len()) || w.Body.Len() >= len(page) {
+		t.Errorf("Expected the compressed Content-Length, got %s for %d bytes", w.Header().Get("Content-Length"), w.Body.Len())
+	}
+	if w.Header().Get("Vary") != "Accept-Encoding" {
+		t.Errorf("Expected Vary: Accept-Encoding, got %v", w.Header()["Vary"])
+	}
+	etag := w.Header().Get("ETag")
+
+	w, body = requestEncoding(t, router, "/page", "br")
+	if w.Header().Get("Content-Encoding") != "" || body != page {
+		t.Errorf("Expected the identity body, got %v", w.Header())
+	}
+	if w.Header().Get("Content-Length") != strconv.Itoa(len(page)) || w.Header().Get("Vary") != "Accept-Encoding" {
+		t.Errorf("Unexpected identity headers %v", w.Header())
+	}
+	if w.Header().Get("ETag") == etag {
+		t.Errorf("Expected the variants to have distinct ETags, got %s", etag)
+	}
+
+	req, _ := http.NewRequest("GET", "/page", nil)
+	req.Header.Set("Accept-Encoding", "gzip")
+	req.Header.Set("If-None-Match", etag)
+	w = httptest.NewRecorder()
+	router.ServeHTTP(w, req)
+	if w.Code != http.StatusNotModified || w.Header().Get("ETag") != etag {
+		t.Errorf("Expected 304 for the gzip ETag, got %d %v", w.Code, w.Header())
+	}
+}
+
+func TestCachePage_GzippedByHandler(t *testing.T) {
+	store := NewInMemoryStore(time.Minute)
+	router := gin.New()
+	router.GET("/page", CachePage(store, time.Minute, func(c *gin.Context) {
+		c.Header("Content-Encoding", "gzip")
+		c.Data(http.StatusOK, "text/plain", gzipped(page))
+	}))
+	requestEncoding(t, router, "/page", "gzip")
+
+	if w, body := requestEncoding(t, router, "/page", ""); w.Header().Get("Content-Encoding") != "" || body != page {
+		t.Errorf("Expected the decompressed body, got %v", w.Header())
+	}
+	if w, body := requestEncoding(t, router, "/page", "gzip"); w.Header().Get("Content-Encoding") != "gzip" || body != page {
+		t.Errorf("Expected the body compressed by the handler, got %v", w.Header())
+	}
+}
+
+// gzipWriter compresses the response like the gzip middleware.
+type gzipWriter struct {
+	gin.ResponseWriter
+	writer *gzip.Writer
+}
+
+func (g *gzipWriter) WriteString(s string) (int, error) {
+	return g.writer.Write([]byte(s))
+}
+
+func (g *gzipWriter) Write(data []byte) (int, error) {
+	return g.writer.Write(data)
+}
+
+func gzipMiddleware(c *gin.Context) {
+	if !strings.Contains(c.Request.Header.Get("Accept-Encoding"), "gzip") {
+		return
+	}
+	gz := gzip.NewWriter(c.Writer)
+	c.Header("Content-Encoding", "gzip")
+	c.Header("Vary", "Accept-Encoding")
+	c.Writer = &gzipWriter{c.Writer, gz}
+	defer gz.Close()
+	c.Next()
+}
+
+func TestCachePage_GzipMiddleware(t *testing.T) {
+	store := NewInMemoryStore(time.Minute)
+	router := gin.New()
+	router.Use(gzipMiddleware)
+	router.GET("/page", CachePageWithOptions(store, time.Minute, Options{GzipLevel: gzip.BestSpeed}, func(c *gin.Context) {
+		c.String(http.StatusOK, page)
+	}))
+
+	// Cached by a client accepting gzip, replayed to one that does not.
+	if w, body := requestEncoding(t, router, "/page", "gzip"); w.Header().Get("X-Cache") != "MISS" || body != page {
+		t.Fatalf("Expected a miss, got %v", w.Header())
+	}
+	w, body := requestEncoding(t, router, "/page", "")
+	if w.Header().Get("Content-Encoding") != "" || body != page {
+		t.Errorf("Expected the identity body, got %v", w.Header())
+	}
+
+	w, body = requestEncoding(t, router, "/page", "gzip")
+	if w.Header().Get("X-Cache") != "HIT" || w.Header().Get("Content-Encoding") != "gzip" || body != page {
+		t.Errorf("Expected the body compressed once, got %v", w.Header())
+	}
+	if vary := w.Header()["Vary"]; len(vary) != 1 {
+		t.Errorf("Expected a single Vary header, got %v", vary)
+	}
+}
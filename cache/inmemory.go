@@ -1,6 +1,7 @@
 package cache
 
 import (
+	"context"
 	"github.com/robfig/go-cache"
 	"reflect"
 	"time"
@@ -28,6 +29,11 @@ func (c *InMemoryStore) Get(key string, value interface{}) error {
 	return ErrNotStored
 }
 
+// getValue returns the value of key as stored, without reflection.
+func (c *InMemoryStore) getValue(key string) (interface{}, bool) {
+	return c.Cache.Get(key)
+}
+
 func (c *InMemoryStore) Set(key string, value interface{}, expires time.Duration) error {
 	// NOTE: go-cache understands the values of DEFAULT and FOREVER
 	c.Cache.Set(key, value, expires)
@@ -76,3 +82,118 @@ func (c *InMemoryStore) Flush() error {
 	c.Cache.Flush()
 	return nil
 }
+
+// The context of the operations of an InMemoryStore is only checked before
+// they start, as they never block.
+
+func (c *InMemoryStore) GetContext(ctx context.Context, key string, value interface{}) error {
+	if err := ctx.Err(); err != nil {
+		return err
+	}
+	return c.Get(key, value)
+}
+
+func (c *InMemoryStore) SetContext(ctx context.Context, key string, value interface{}, expires time.Duration) error {
+	if err := ctx.Err(); err != nil {
+		return err
+	}
+	return c.Set(key, value, expires)
+}
+
+func (c *InMemoryStore) AddContext(ctx context.Context, key string, value interface{}, expires time.Duration) error {
+	if err := ctx.Err(); err != nil {
+		return err
+	}
+	return c.Add(key, value, expires)
+}
+
+func (c *InMemoryStore) ReplaceContext(ctx context.Context, key string, value interface{}, expires time.Duration) error {
+	if err := ctx.Err(); err != nil {
+		return err
+	}
+	return c.Replace(key, value, expires)
+}
+
+func (c *InMemoryStore) DeleteContext(ctx context.Context, key string) error {
+	if err := ctx.Err(); err != nil {
+		return err
+	}
+	return c.Delete(key)
+}
+
+func (c *InMemoryStore) IncrementContext(ctx context.Context, key string, n uint64) (uint64, error) {
+	if err := ctx.Err(); err != nil {
+		return 0, err
+	}
+	return c.Increment(key, n)
+}
+
+func (c *InMemoryStore) DecrementContext(ctx context.Context, key string, n uint64) (uint64, error) {
+	if err := ctx.Err(); err != nil {
+		return 0, err
+	}
+	return c.Decrement(key, n)
+}
+
+func (c *InMemoryStore) FlushContext(ctx context.Context) error {
+	if err := ctx.Err(); err != nil {
+		return err
+	}
+	return c.Flush()
+}
+
+func (c *InMemoryStore) GetMulti(ctx context.Context, values map[string]interface{}) error {
+	if err := ctx.Err(); err != nil {
+		return err
+	}
+	for key, value := range values {
+		err := c.Get(key, value)
+		if err == ErrCacheMiss {
+			delete(values, key)
+		} else if err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+func (c *InMemoryStore) SetMulti(ctx context.Context, values map[string]interface{}, expires time.Duration) error {
+	if err := ctx.Err(); err != nil {
+		return err
+	}
+	for key, value := range values {
+		c.Cache.Set(key, value, expires)
+	}
+	return nil
+}
+
+func (c *InMemoryStore) DeleteMulti(ctx context.Context, keys ...string) error {
+	if err := ctx.Err(); err != nil {
+		return err
+	}
+	for _, key := range keys {
+		c.Cache.Delete(key)
+	}
+	return nil
+}
+
+// TTL is not supported: go-cache does not expose the expiration of items.
+func (c *InMemoryStore) TTL(ctx context.Context, key string) (time.Duration, error) {
+	return 0, ErrNotSupport
+}
+
+// Touch replaces the item with itself, which is not atomic: a concurrent
+// write of key may be lost.
+func (c *InMemoryStore) Touch(ctx context.Context, key string, expires time.Duration) error {
+	if err := ctx.Err(); err != nil {
+		return err
+	}
+	val, found := c.Cache.Get(key)
+	if !found {
+		return ErrCacheMiss
+	}
+	if err := c.Cache.Replace(key, val, expires); err != nil {
+		return ErrCacheMiss
+	}
+	return nil
+}
@@ -33,3 +33,19 @@ func TestInMemoryCache_Replace(t *testing.T) {
 func TestInMemoryCache_Add(t *testing.T) {
 	testAdd(t, newInMemoryStore)
 }
+
+func TestInMemoryCache_Concurrency(t *testing.T) {
+	concurrency(t, newInMemoryStore)
+}
+
+func TestInMemoryCache_CachePage(t *testing.T) {
+	cachePage(t, NewInMemoryStore(time.Hour))
+}
+
+func TestInMemoryCache_TagInvalidation(t *testing.T) {
+	tagInvalidation(t, NewInMemoryStore(time.Hour))
+}
+
+func TestInMemoryCache_Context(t *testing.T) {
+	contextContract(t, NewInMemoryStore(time.Hour))
+}
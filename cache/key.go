@@ -0,0 +1,100 @@
+package cache
+
+import (
+	"net/http"
+	"net/url"
+	"strings"
+
+	"github.com/gin-gonic/gin"
+)
+
+// KeyFunc returns the string identifying the cached page of a request.
+// Requests with the same key share the same cache entry. Custom functions can
+// build on the helpers below, e.g. to add the logged-in user to the key.
+type KeyFunc func(c *gin.Context) string
+
+// DefaultKey identifies a page by its request URI, path and raw query
+// included. It is the historical key of SiteCache and CachePage.
+func DefaultKey(c *gin.Context) string {
+	return c.Request.URL.RequestURI()
+}
+
+// SortedQueryKey identifies a page by its path and its query parameters sorted
+// by name, so that "?a=1&b=2" and "?b=2&a=1" share an entry. Parameters
+// matching one of the ignore patterns are left out of the key. A pattern
+// ending with "*" matches every parameter starting with what precedes it,
+// e.g. "utm_*".
+func SortedQueryKey(ignore ...string) KeyFunc {
+	return func(c *gin.Context) string {
+		return queryKey(c.Request.URL, func(name string) bool {
+			return !matchAny(ignore, name)
+		})
+	}
+}
+
+// AllowedQueryKey identifies a page by its path and the listed query
+// parameters only, sorted by name. Any other parameter is ignored.
+func AllowedQueryKey(params ...string) KeyFunc {
+	return func(c *gin.Context) string {
+		return queryKey(c.Request.URL, func(name string) bool {
+			return matchAny(params, name)
+		})
+	}
+}
+
+// HeaderKey extends the key returned by next with the values of the given
+// request headers, the way a Vary response header would. Use it to keep
+// separate entries per Accept-Encoding, Accept-Language, tenant header...
+// A nil next means DefaultKey.
+func HeaderKey(next KeyFunc, headers ...string) KeyFunc {
+	if next == nil {
+		next = DefaultKey
+	}
+	return func(c *gin.Context) string {
+		key := next(c)
+		for _, name := range headers {
+			name = http.CanonicalHeaderKey(name)
+			key += "|" + name + "=" + strings.Join(c.Request.Header[name], ",")
+		}
+		return key
+	}
+}
+
+// MethodKey prefixes the key returned by next with the request method, so
+// that e.g. GET and HEAD requests are cached separately.
+// A nil next means DefaultKey.
+func MethodKey(next KeyFunc) KeyFunc {
+	if next == nil {
+		next = DefaultKey
+	}
+	return func(c *gin.Context) string {
+		return c.Request.Method + " " + next(c)
+	}
+}
+
+func queryKey(u *url.URL, keep func(name string) bool) string {
+	query := u.Query()
+	for name := range query {
+		if !keep(name) {
+			delete(query, name)
+		}
+	}
+	if len(query) == 0 {
+		return u.EscapedPath()
+	}
+	// Encode sorts by name, preserving the order of repeated values.
+	return u.EscapedPath() + "?" + query.Encode()
+}
+
+func matchAny(patterns []string, name string) bool {
+	for _, pattern := range patterns {
+		if strings.HasSuffix(pattern, "*") {
+			if strings.HasPrefix(name, pattern[:len(pattern)-1]) {
+				return true
+			}
+		} else if pattern == name {
+			return true
+		}
+	}
+	return false
+}
@@ -0,0 +1,100 @@
+package cache
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"testing"
+	"time"
+
+	"github.com/gin-gonic/gin"
+)
+
+func keyOf(keyFunc KeyFunc, method, target string, header http.Header) string {
+	req, _ := http.NewRequest(method, target, nil)
+	for k, vals := range header {
+		req.Header[k] = vals
+	}
+	return keyFunc(&gin.Context{Request: req})
+}
+
+func TestKey_Default(t *testing.T) {
+	if key := keyOf(DefaultKey, "GET", "/a?b=1&a=2", nil); key != "/a?b=1&a=2" {
+		t.Errorf("Expected the request URI, got %q", key)
+	}
+}
+
+func TestKey_SortedQuery(t *testing.T) {
+	keyFunc := SortedQueryKey("utm_*", "debug")
+	a := keyOf(keyFunc, "GET", "/list?page=2&sort=name&utm_source=mail&debug=1", nil)
+	b := keyOf(keyFunc, "GET", "/list?utm_campaign=x&sort=name&page=2", nil)
+	if a != b || a != "/list?page=2&sort=name" {
+		t.Errorf("Expected both keys to be /list?page=2&sort=name, got %q and %q", a, b)
+	}
+	if key := keyOf(keyFunc, "GET", "/list?utm_source=mail", nil); key != "/list" {
+		t.Errorf("Expected /list, got %q", key)
+	}
+	if key := keyOf(keyFunc, "GET", "/list?a=2&a=1", nil); key != "/list?a=2&a=1" {
+		t.Errorf("Expected repeated values to keep their order, got %q", key)
+	}
+}
+
+func TestKey_AllowedQuery(t *testing.T) {
+	keyFunc := AllowedQueryKey("q", "page")
+	if key := keyOf(keyFunc, "GET", "/search?session=42&q=go&page=3", nil); key != "/search?page=3&q=go" {
+		t.Errorf("Expected /search?page=3&q=go, got %q", key)
+	}
+}
+
+func TestKey_HeaderAndMethod(t *testing.T) {
+	keyFunc := MethodKey(HeaderKey(nil, "accept-language", "X-Tenant"))
+	en := keyOf(keyFunc, "GET", "/", http.Header{"Accept-Language": {"en"}, "X-Tenant": {"acme"}})
+	fr := keyOf(keyFunc, "GET", "/", http.Header{"Accept-Language": {"fr"}, "X-Tenant": {"acme"}})
+	head := keyOf(keyFunc, "HEAD", "/", http.Header{"Accept-Language": {"en"}, "X-Tenant": {"acme"}})
+	if en == fr || en == head || fr == head {
+		t.Errorf("Expected distinct keys, got %q, %q and %q", en, fr, head)
+	}
+	if en != "GET /|Accept-Language=en|X-Tenant=acme" {
+		t.Errorf("Unexpected key %q", en)
+	}
+}
+
+func TestCachePage_KeyFunc(t *testing.T) {
+	store := NewInMemoryStore(time.Minute)
+	calls := 0
+	router := gin.New()
+	options := Options{KeyFunc: HeaderKey(SortedQueryKey("utm_*"), "Accept-Language")}
+	router.GET("/page", CachePageWithOptions(store, time.Minute, options, func(c *gin.Context) {
+		calls++
+		c.String(http.StatusOK, c.GetHeader("Accept-Language"))
+	}))
+
+	request := func(target, lang string) string {
+		req, _ := http.NewRequest("GET", target, nil)
+		req.Header.Set("Accept-Language", lang)
+		w := httptest.NewRecorder()
+		router.ServeHTTP(w, req)
+		return w.Body.String()
+	}
+
+	request("/page?a=1&b=2", "en")
+	if body := request("/page?b=2&a=1&utm_source=x", "en"); body != "en" || calls != 1 {
+		t.Errorf("Expected a cache hit, got %q after %d calls", body, calls)
+	}
+	if body := request("/page?a=1&b=2", "fr"); body != "fr" || calls != 2 {
+		t.Errorf("Expected a cache miss for another language, got %q after %d calls", body, calls)
+	}
+}
+
+func TestSiteCache_KeyFunc(t *testing.T) {
+	store := NewInMemoryStore(time.Minute)
+	options := Options{KeyFunc: SortedQueryKey()}
+	store.Set(urlEscape(PageCachePrefix, "/page?a=1&b=2"), responseCache{status: http.StatusOK, header: http.Header{}, data: []byte("cached")}, time.Minute)
+
+	router := gin.New()
+	router.Use(SiteCacheWithOptions(store, time.Minute, options))
+	router.GET("/page", func(c *gin.Context) {})
+
+	if w := performRequest(router, "GET", "/page?b=2&a=1"); w.Body.String() != "cached" {
+		t.Errorf("Expected the cached page, got %q", w.Body.String())
+	}
+}
@@ -1,17 +1,65 @@
 package cache
 
 import (
+	"context"
+	"crypto/sha1"
+	"encoding/hex"
 	"github.com/bradfitz/gomemcache/memcache"
+	"strconv"
+	"sync"
 	"time"
 )
 
+// memcachedGenerationTTL is how long a store reuses the generation of its
+// namespace before looking it up again, and so how long the other stores may
+// keep using the keys of a namespace flushed elsewhere.
+const memcachedGenerationTTL = time.Second
+
+// memcachedMaxKeyLength is the longest key memcached accepts.
+const memcachedMaxKeyLength = 250
+
 type MemcachedStore struct {
 	*memcache.Client
 	defaultExpiration time.Duration
+	namespace         string
+	serializer        Serializer
+
+	// generation is the generation of the namespace looked up at loaded.
+	// flushes counts the flushes made by the store, so that a generation
+	// looked up during one is not kept.
+	mu         sync.Mutex
+	generation string
+	loaded     time.Time
+	flushes    uint64
+}
+
+// MemcachedOptions holds the optional settings of a MemcachedStore.
+type MemcachedOptions struct {
+	// Namespace is prepended to every key, followed by a colon and the
+	// generation of the namespace. Stores with distinct namespaces can be
+	// flushed independently; other stores sharing the namespace notice the
+	// flush within a second. Without a namespace, Flush returns
+	// ErrNotSupport.
+	Namespace string
+
+	// Serializer encodes the values. Without one, values are encoded with
+	// gob and no header, as in earlier releases.
+	Serializer Serializer
 }
 
 func NewMemcachedStore(hostList []string, defaultExpiration time.Duration) *MemcachedStore {
-	return &MemcachedStore{memcache.New(hostList...), defaultExpiration}
+	return NewMemcachedStoreWithOptions(hostList, defaultExpiration, MemcachedOptions{})
+}
+
+// NewMemcachedStoreWithOptions is like NewMemcachedStore but accepts
+// MemcachedOptions.
+func NewMemcachedStoreWithOptions(hostList []string, defaultExpiration time.Duration, options MemcachedOptions) *MemcachedStore {
+	return &MemcachedStore{
+		Client:            memcache.New(hostList...),
+		defaultExpiration: defaultExpiration,
+		namespace:         options.Namespace,
+		serializer:        options.Serializer,
+	}
 }
 
 func (c *MemcachedStore) Set(key string, value interface{}, expires time.Duration) error {
@@ -27,42 +75,273 @@ func (c *MemcachedStore) Replace(key string, value interface{}, expires time.Dur
 }
 
 func (c *MemcachedStore) Get(key string, value interface{}) error {
+	key, err := c.key(key)
+	if err != nil {
+		return err
+	}
 	item, err := c.Client.Get(key)
 	if err != nil {
 		return convertMemcacheError(err)
 	}
-	return deserialize(item.Value, value)
+	return deserialize(c.serializer, item.Value, value)
 }
 
 func (c *MemcachedStore) Delete(key string) error {
+	key, err := c.key(key)
+	if err != nil {
+		return err
+	}
 	return convertMemcacheError(c.Client.Delete(key))
 }
 
 func (c *MemcachedStore) Increment(key string, delta uint64) (uint64, error) {
+	key, err := c.key(key)
+	if err != nil {
+		return 0, err
+	}
 	newValue, err := c.Client.Increment(key, delta)
 	return newValue, convertMemcacheError(err)
 }
 
 func (c *MemcachedStore) Decrement(key string, delta uint64) (uint64, error) {
+	key, err := c.key(key)
+	if err != nil {
+		return 0, err
+	}
 	newValue, err := c.Client.Decrement(key, delta)
 	return newValue, convertMemcacheError(err)
 }
 
+func (c *MemcachedStore) GetContext(ctx context.Context, key string, value interface{}) error {
+	return getContext(ctx, value, func(value interface{}) error { return c.Get(key, value) })
+}
+
+func (c *MemcachedStore) SetContext(ctx context.Context, key string, value interface{}, expires time.Duration) error {
+	return runContext(ctx, func() error { return c.Set(key, value, expires) })
+}
+
+func (c *MemcachedStore) AddContext(ctx context.Context, key string, value interface{}, expires time.Duration) error {
+	return runContext(ctx, func() error { return c.Add(key, value, expires) })
+}
+
+func (c *MemcachedStore) ReplaceContext(ctx context.Context, key string, value interface{}, expires time.Duration) error {
+	return runContext(ctx, func() error { return c.Replace(key, value, expires) })
+}
+
+func (c *MemcachedStore) DeleteContext(ctx context.Context, key string) error {
+	return runContext(ctx, func() error { return c.Delete(key) })
+}
+
+func (c *MemcachedStore) IncrementContext(ctx context.Context, key string, delta uint64) (uint64, error) {
+	return countContext(ctx, func() (uint64, error) { return c.Increment(key, delta) })
+}
+
+func (c *MemcachedStore) DecrementContext(ctx context.Context, key string, delta uint64) (uint64, error) {
+	return countContext(ctx, func() (uint64, error) { return c.Decrement(key, delta) })
+}
+
+func (c *MemcachedStore) FlushContext(ctx context.Context) error {
+	return runContext(ctx, c.Flush)
+}
+
+// GetMulti looks up all the keys with a single get per server. The items are
+// decoded once they are all received.
+func (c *MemcachedStore) GetMulti(ctx context.Context, values map[string]interface{}) error {
+	keys := make([]string, 0, len(values))
+	for key := range values {
+		keys = append(keys, key)
+	}
+	var prefix string
+	var items map[string]*memcache.Item
+	err := runContext(ctx, func() (err error) {
+		if prefix, err = c.prefix(); err != nil {
+			return err
+		}
+		names := make([]string, len(keys))
+		for i, key := range keys {
+			names[i] = memcachedKey(prefix, key)
+		}
+		items, err = c.Client.GetMulti(names)
+		return convertMemcacheError(err)
+	})
+	if err != nil {
+		return err
+	}
+	for _, key := range keys {
+		item, ok := items[memcachedKey(prefix, key)]
+		if !ok {
+			delete(values, key)
+			continue
+		}
+		if err = deserialize(c.serializer, item.Value, values[key]); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// SetMulti stores the items one at a time, as memcached has no batch set.
+func (c *MemcachedStore) SetMulti(ctx context.Context, values map[string]interface{}, expires time.Duration) error {
+	encoded := make(map[string][]byte, len(values))
+	for key, value := range values {
+		b, err := serialize(c.serializer, value)
+		if err != nil {
+			return err
+		}
+		encoded[key] = b
+	}
+	return runContext(ctx, func() error {
+		prefix, err := c.prefix()
+		if err != nil {
+			return err
+		}
+		for key, b := range encoded {
+			err = c.Client.Set(&memcache.Item{
+				Key:        memcachedKey(prefix, key),
+				Value:      b,
+				Expiration: int32(c.expiration(expires) / time.Second),
+			})
+			if err != nil {
+				return convertMemcacheError(err)
+			}
+		}
+		return nil
+	})
+}
+
+func (c *MemcachedStore) DeleteMulti(ctx context.Context, keys ...string) error {
+	keys = append([]string(nil), keys...)
+	return runContext(ctx, func() error {
+		prefix, err := c.prefix()
+		if err != nil {
+			return err
+		}
+		for _, key := range keys {
+			err := c.Client.Delete(memcachedKey(prefix, key))
+			if err != nil && err != memcache.ErrCacheMiss {
+				return convertMemcacheError(err)
+			}
+		}
+		return nil
+	})
+}
+
+// TTL is not supported: memcached does not tell the expiration of items.
+func (c *MemcachedStore) TTL(ctx context.Context, key string) (time.Duration, error) {
+	return 0, ErrNotSupport
+}
+
+func (c *MemcachedStore) Touch(ctx context.Context, key string, expires time.Duration) error {
+	return runContext(ctx, func() error {
+		key, err := c.key(key)
+		if err != nil {
+			return err
+		}
+		return convertMemcacheError(c.Client.Touch(key, int32(c.expiration(expires)/time.Second)))
+	})
+}
+
+// Flush invalidates every key of the namespace of the store by moving it to a
+// new generation. memcached evicts the keys of older generations as they
+// are no longer used. Without a namespace the store cannot tell its keys
+// from those of other applications sharing the servers, so Flush returns
+// ErrNotSupport.
 func (c *MemcachedStore) Flush() error {
-	return ErrNotSupport
+	if c.namespace == "" {
+		return ErrNotSupport
+	}
+	_, err := c.Client.Increment(c.generationKey(), 1)
+	if err == memcache.ErrCacheMiss {
+		err = c.newGeneration()
+	}
+	c.mu.Lock()
+	c.generation = ""
+	c.flushes++
+	c.mu.Unlock()
+	return convertMemcacheError(err)
+}
+
+// key returns the name of key in the current generation of the namespace.
+func (c *MemcachedStore) key(key string) (string, error) {
+	prefix, err := c.prefix()
+	if err != nil {
+		return "", err
+	}
+	return memcachedKey(prefix, key), nil
+}
+
+// memcachedKey joins prefix and key. Keys that would exceed the length
+// memcached accepts are replaced by their SHA-1.
+func memcachedKey(prefix, key string) string {
+	if len(prefix)+len(key) <= memcachedMaxKeyLength {
+		return prefix + key
+	}
+	sum := sha1.Sum([]byte(key))
+	return prefix + hex.EncodeToString(sum[:])
+}
+
+// prefix returns the prefix of the keys in the current generation of the
+// namespace, or nothing without a namespace. The generation is looked up
+// at most once per memcachedGenerationTTL.
+func (c *MemcachedStore) prefix() (string, error) {
+	if c.namespace == "" {
+		return "", nil
+	}
+	c.mu.Lock()
+	generation, flushes := c.generation, c.flushes
+	if time.Since(c.loaded) >= memcachedGenerationTTL {
+		generation = ""
+	}
+	c.mu.Unlock()
+
+	if generation == "" {
+		item, err := c.Client.Get(c.generationKey())
+		if err == memcache.ErrCacheMiss {
+			if err = c.newGeneration(); err == nil {
+				item, err = c.Client.Get(c.generationKey())
+			}
+		}
+		if err != nil {
+			return "", convertMemcacheError(err)
+		}
+		generation = string(item.Value)
+		c.mu.Lock()
+		if c.flushes == flushes {
+			c.generation, c.loaded = generation, time.Now()
+		}
+		c.mu.Unlock()
+	}
+	return c.namespace + ":" + generation + ":", nil
+}
+
+func (c *MemcachedStore) generationKey() string {
+	return c.namespace + ":generation"
+}
+
+// newGeneration creates the generation counter. It starts from the current
+// time so that an evicted counter never brings back an older generation.
+func (c *MemcachedStore) newGeneration() error {
+	err := c.Client.Add(&memcache.Item{
+		Key:   c.generationKey(),
+		Value: []byte(strconv.FormatInt(time.Now().UnixNano(), 10)),
+	})
+	if err == memcache.ErrNotStored {
+		// Created concurrently.
+		return nil
+	}
+	return convertMemcacheError(err)
 }
 
 func (c *MemcachedStore) invoke(storeFn func(*memcache.Client, *memcache.Item) error,
 	key string, value interface{}, expire time.Duration) error {
 
-	switch expire {
-	case DEFAULT:
-		expire = c.defaultExpiration
-	case FOREVER:
-		expire = time.Duration(0)
-	}
+	expire = c.expiration(expire)
 
-	b, err := serialize(value)
+	b, err := serialize(c.serializer, value)
+	if err != nil {
+		return err
+	}
+	key, err = c.key(key)
 	if err != nil {
 		return err
 	}
@@ -73,6 +352,17 @@ func (c *MemcachedStore) invoke(storeFn func(*memcache.Client, *memcache.Item) e
 	}))
 }
 
+// expiration resolves DEFAULT and FOREVER.
+func (c *MemcachedStore) expiration(expire time.Duration) time.Duration {
+	switch expire {
+	case DEFAULT:
+		return c.defaultExpiration
+	case FOREVER:
+		return time.Duration(0)
+	}
+	return expire
+}
+
 func convertMemcacheError(err error) error {
 	switch err {
 	case nil:
@@ -1,7 +1,15 @@
 package cache
 
 import (
+	"bufio"
+	"bytes"
+	"context"
+	"fmt"
+	"io"
 	"net"
+	"strconv"
+	"strings"
+	"sync"
 	"testing"
 	"time"
 )
@@ -44,3 +52,223 @@ func TestMemcachedCache_Replace(t *testing.T) {
 func TestMemcachedCache_Add(t *testing.T) {
 	testAdd(t, newMemcachedStore)
 }
+
+func TestMemcachedCache_Concurrency(t *testing.T) {
+	concurrency(t, newMemcachedStore)
+}
+
+// fakeMemcached is a tiny in-process server speaking enough of the memcached
+// text protocol for MemcachedStore, so that page caching can be tested
+// without a real server.
+type fakeMemcached struct {
+	net.Listener
+	mu      sync.Mutex
+	data    map[string][]byte
+	lookups map[string]int
+}
+
+func newFakeMemcached(t *testing.T) *fakeMemcached {
+	l, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatalf("couldn't start fake memcached: %s", err)
+	}
+	s := &fakeMemcached{Listener: l, data: make(map[string][]byte), lookups: make(map[string]int)}
+	go s.serve()
+	return s
+}
+
+func (s *fakeMemcached) serve() {
+	for {
+		conn, err := s.Accept()
+		if err != nil {
+			return
+		}
+		go s.handle(conn)
+	}
+}
+
+func (s *fakeMemcached) handle(conn net.Conn) {
+	defer conn.Close()
+	r := bufio.NewReader(conn)
+	for {
+		line, err := r.ReadString('\n')
+		if err != nil {
+			return
+		}
+		fields := strings.Fields(line)
+		if len(fields) == 0 {
+			return
+		}
+		var data []byte
+		switch fields[0] {
+		case "set", "add", "replace":
+			size, _ := strconv.Atoi(fields[4])
+			data = make([]byte, size+2)
+			if _, err := io.ReadFull(r, data); err != nil {
+				return
+			}
+			data = data[:size]
+		}
+		conn.Write(s.do(fields[0], fields[1:], data))
+	}
+}
+
+func (s *fakeMemcached) do(cmd string, args []string, data []byte) []byte {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	switch cmd {
+	case "get", "gets":
+		var b bytes.Buffer
+		for _, key := range args {
+			s.lookups[key]++
+			if v, ok := s.data[key]; ok {
+				fmt.Fprintf(&b, "VALUE %s 0 %d 0\r\n%s\r\n", key, len(v), v)
+			}
+		}
+		b.WriteString("END\r\n")
+		return b.Bytes()
+	case "set", "add", "replace":
+		_, exists := s.data[args[0]]
+		if (cmd == "add" && exists) || (cmd == "replace" && !exists) {
+			return []byte("NOT_STORED\r\n")
+		}
+		s.data[args[0]] = data
+		return []byte("STORED\r\n")
+	case "delete":
+		if _, ok := s.data[args[0]]; !ok {
+			return []byte("NOT_FOUND\r\n")
+		}
+		delete(s.data, args[0])
+		return []byte("DELETED\r\n")
+	case "incr", "decr":
+		v, ok := s.data[args[0]]
+		if !ok {
+			return []byte("NOT_FOUND\r\n")
+		}
+		n, _ := strconv.ParseUint(string(v), 10, 64)
+		delta, _ := strconv.ParseUint(args[1], 10, 64)
+		if cmd == "incr" {
+			n += delta
+		} else if delta > n {
+			n = 0
+		} else {
+			n -= delta
+		}
+		s.data[args[0]] = []byte(strconv.FormatUint(n, 10))
+		return []byte(strconv.FormatUint(n, 10) + "\r\n")
+	case "touch":
+		if _, ok := s.data[args[0]]; !ok {
+			return []byte("NOT_FOUND\r\n")
+		}
+		return []byte("TOUCHED\r\n")
+	case "flush_all":
+		s.data = make(map[string][]byte)
+		return []byte("OK\r\n")
+	}
+	return []byte("ERROR\r\n")
+}
+
+func TestMemcachedCache_CachePage(t *testing.T) {
+	server := newFakeMemcached(t)
+	defer server.Close()
+	cachePage(t, NewMemcachedStore([]string{server.Addr().String()}, time.Hour))
+}
+
+func TestMemcachedCache_TagInvalidation(t *testing.T) {
+	server := newFakeMemcached(t)
+	defer server.Close()
+	tagInvalidation(t, NewMemcachedStore([]string{server.Addr().String()}, time.Hour))
+}
+
+func TestMemcachedCache_NamespaceFlush(t *testing.T) {
+	server := newFakeMemcached(t)
+	defer server.Close()
+	hosts := []string{server.Addr().String()}
+	sessions := NewMemcachedStoreWithOptions(hosts, time.Hour, MemcachedOptions{Namespace: "sessions"})
+	pages := NewMemcachedStoreWithOptions(hosts, time.Hour, MemcachedOptions{Namespace: "pages"})
+	namespaceFlush(t, sessions, pages, NewMemcachedStore(hosts, time.Hour))
+}
+
+func TestMemcachedCache_FlushWithoutNamespace(t *testing.T) {
+	server := newFakeMemcached(t)
+	defer server.Close()
+	hosts := []string{server.Addr().String()}
+
+	store := NewMemcachedStore(hosts, time.Hour)
+	store.Set("key", "value", DEFAULT)
+	if err := store.Flush(); err != ErrNotSupport {
+		t.Errorf("Expected ErrNotSupport without a namespace, got %v", err)
+	}
+	var value string
+	if err := store.Get("key", &value); err != nil || value != "value" {
+		t.Errorf("Expected the keys to survive, got %q: %v", value, err)
+	}
+}
+
+func TestMemcachedCache_Keys(t *testing.T) {
+	server := newFakeMemcached(t)
+	defer server.Close()
+	hosts := []string{server.Addr().String()}
+
+	NewMemcachedStore(hosts, time.Hour).Set("plain", "value", DEFAULT)
+	namespaced := NewMemcachedStoreWithOptions(hosts, time.Hour, MemcachedOptions{Namespace: "ns"})
+	namespaced.Set("key", "value", DEFAULT)
+	server.mu.Lock()
+	lookups := server.lookups["ns:generation"]
+	server.mu.Unlock()
+	var value string
+	for i := 0; i < 3; i++ {
+		namespaced.Get("key", &value)
+	}
+
+	server.mu.Lock()
+	defer server.mu.Unlock()
+	if _, ok := server.data["plain"]; !ok {
+		t.Errorf("Expected keys without a namespace to be stored as is, got %v", server.data)
+	}
+	if _, ok := server.data["generation"]; ok {
+		t.Errorf("Expected no generation without a namespace")
+	}
+	if n := server.lookups["ns:generation"] - lookups; n != 0 {
+		t.Errorf("Expected the generation to be reused, got %d more lookups", n)
+	}
+}
+
+func TestMemcachedCache_LongKeys(t *testing.T) {
+	server := newFakeMemcached(t)
+	defer server.Close()
+	options := MemcachedOptions{Namespace: "long-namespace"}
+	store := NewMemcachedStoreWithOptions([]string{server.Addr().String()}, time.Hour, options)
+
+	key := urlEscape(PageCachePrefix, "/"+strings.Repeat("a", 197))
+	if err := store.Set(key, "value", DEFAULT); err != nil {
+		t.Fatalf("Error setting a long key: %s", err)
+	}
+	var value string
+	if err := store.Get(key, &value); err != nil || value != "value" {
+		t.Errorf("Expected value for a long key, got %q: %v", value, err)
+	}
+	values := map[string]interface{}{key: &value}
+	if err := store.GetMulti(context.Background(), values); err != nil || len(values) != 1 {
+		t.Errorf("Expected GetMulti to find a long key, got %v: %v", values, err)
+	}
+	if err := store.Delete(key); err != nil {
+		t.Errorf("Error deleting a long key: %s", err)
+	}
+}
+
+func TestMemcachedCache_Context(t *testing.T) {
+	server := newFakeMemcached(t)
+	defer server.Close()
+	options := MemcachedOptions{Namespace: "ctx"}
+	contextContract(t, NewMemcachedStoreWithOptions([]string{server.Addr().String()}, time.Hour, options))
+}
+
+func TestMemcachedCache_Serializer(t *testing.T) {
+	server := newFakeMemcached(t)
+	defer server.Close()
+	options := MemcachedOptions{Namespace: "msgpack", Serializer: MsgpackSerializer}
+	store := NewMemcachedStoreWithOptions([]string{server.Addr().String()}, time.Hour, options)
+	cachePage(t, store)
+	contextContract(t, store)
+}
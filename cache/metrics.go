@@ -0,0 +1,255 @@
+package cache
+
+import (
+	"bytes"
+	"expvar"
+	"fmt"
+	"io"
+	"net/http"
+	"sort"
+	"strconv"
+	"sync"
+	"time"
+)
+
+// Results of the operations reported to an Observer.
+const (
+	ResultHit       = "hit"
+	ResultMiss      = "miss"
+	ResultOK        = "ok"
+	ResultNotStored = "not_stored"
+	ResultError     = "error"
+)
+
+// Observer receives the outcome of every operation of an InstrumentedStore.
+// op is the lower-case name of the method, such as "get" or "set", and
+// result one of the Result constants: hit or miss for Get, miss for the
+// other operations on a missing key, not_stored when Add or Replace do not
+// apply, ok or error otherwise.
+//
+// Observers are called concurrently.
+type Observer interface {
+	Observe(op string, result string, duration time.Duration)
+}
+
+// InstrumentedStore reports the operations of a store to an Observer.
+type InstrumentedStore struct {
+	store    CacheStore
+	observer Observer
+}
+
+func NewInstrumentedStore(store CacheStore, observer Observer) *InstrumentedStore {
+	return &InstrumentedStore{store, observer}
+}
+
+func (c *InstrumentedStore) Get(key string, value interface{}) error {
+	start := time.Now()
+	err := c.store.Get(key, value)
+	result := ResultHit
+	if err == ErrCacheMiss {
+		result = ResultMiss
+	} else if err != nil {
+		result = ResultError
+	}
+	c.observer.Observe("get", result, time.Since(start))
+	return err
+}
+
+func (c *InstrumentedStore) Set(key string, value interface{}, expires time.Duration) error {
+	start := time.Now()
+	err := c.store.Set(key, value, expires)
+	c.observe("set", start, err)
+	return err
+}
+
+func (c *InstrumentedStore) Add(key string, value interface{}, expires time.Duration) error {
+	start := time.Now()
+	err := c.store.Add(key, value, expires)
+	c.observe("add", start, err)
+	return err
+}
+
+func (c *InstrumentedStore) Replace(key string, value interface{}, expires time.Duration) error {
+	start := time.Now()
+	err := c.store.Replace(key, value, expires)
+	c.observe("replace", start, err)
+	return err
+}
+
+func (c *InstrumentedStore) Delete(key string) error {
+	start := time.Now()
+	err := c.store.Delete(key)
+	c.observe("delete", start, err)
+	return err
+}
+
+func (c *InstrumentedStore) Increment(key string, delta uint64) (uint64, error) {
+	start := time.Now()
+	newValue, err := c.store.Increment(key, delta)
+	c.observe("increment", start, err)
+	return newValue, err
+}
+
+func (c *InstrumentedStore) Decrement(key string, delta uint64) (uint64, error) {
+	start := time.Now()
+	newValue, err := c.store.Decrement(key, delta)
+	c.observe("decrement", start, err)
+	return newValue, err
+}
+
+func (c *InstrumentedStore) Flush() error {
+	start := time.Now()
+	err := c.store.Flush()
+	c.observe("flush", start, err)
+	return err
+}
+
+func (c *InstrumentedStore) observe(op string, start time.Time, err error) {
+	result := ResultOK
+	switch err {
+	case nil:
+	case ErrCacheMiss:
+		result = ResultMiss
+	case ErrNotStored:
+		result = ResultNotStored
+	default:
+		result = ResultError
+	}
+	c.observer.Observe(op, result, time.Since(start))
+}
+
+// ExpvarObserver publishes the operations of a store with expvar, as a map
+// of counters named "<op>.<result>" and of total latencies in nanoseconds
+// named "<op>.nanoseconds".
+type ExpvarObserver struct {
+	vars *expvar.Map
+}
+
+// expvarMu serializes the lookup and the creation of the expvar maps.
+var expvarMu sync.Mutex
+
+// NewExpvarObserver publishes the counters under name. Observers created
+// with the same name share their counters. Like expvar.NewMap, it panics if
+// name is already published as something other than a map.
+func NewExpvarObserver(name string) *ExpvarObserver {
+	expvarMu.Lock()
+	defer expvarMu.Unlock()
+	if vars, ok := expvar.Get(name).(*expvar.Map); ok {
+		return &ExpvarObserver{vars}
+	}
+	return &ExpvarObserver{expvar.NewMap(name)}
+}
+
+func (o *ExpvarObserver) Observe(op string, result string, duration time.Duration) {
+	o.vars.Add(op+"."+result, 1)
+	o.vars.Add(op+".nanoseconds", int64(duration))
+}
+
+// defaultLatencyBuckets are the upper bounds, in seconds, of the latency
+// histogram of a PrometheusObserver.
+var defaultLatencyBuckets = []float64{.0005, .001, .0025, .005, .01, .025, .05, .1, .25, .5, 1}
+
+// PrometheusObserver counts the operations of a store and exposes them in the
+// Prometheus text format, without depending on the Prometheus client:
+//
+//	<namespace>_cache_operations_total{op="get",result="hit"} 42
+//	<namespace>_cache_operation_duration_seconds_bucket{op="get",le="0.001"} 40
+//
+// It is an http.Handler serving the metrics.
+type PrometheusObserver struct {
+	namespace string
+	buckets   []float64
+
+	mu        sync.Mutex
+	counts    map[[2]string]uint64
+	latencies map[string]*latencyHistogram
+}
+
+type latencyHistogram struct {
+	buckets []uint64
+	count   uint64
+	sum     float64
+}
+
+// NewPrometheusObserver returns an observer prefixing its metrics with
+// namespace, if not empty. buckets are the upper bounds in seconds of the
+// latency histogram, which defaults to 0.5ms up to 1s.
+func NewPrometheusObserver(namespace string, buckets ...float64) *PrometheusObserver {
+	if len(buckets) == 0 {
+		buckets = defaultLatencyBuckets
+	}
+	buckets = append([]float64(nil), buckets...)
+	sort.Float64s(buckets)
+	return &PrometheusObserver{
+		namespace: namespace,
+		buckets:   buckets,
+		counts:    make(map[[2]string]uint64),
+		latencies: make(map[string]*latencyHistogram),
+	}
+}
+
+func (o *PrometheusObserver) Observe(op string, result string, duration time.Duration) {
+	seconds := duration.Seconds()
+	o.mu.Lock()
+	defer o.mu.Unlock()
+	o.counts[[2]string{op, result}]++
+	h := o.latencies[op]
+	if h == nil {
+		h = &latencyHistogram{buckets: make([]uint64, len(o.buckets))}
+		o.latencies[op] = h
+	}
+	for i, bound := range o.buckets {
+		if seconds <= bound {
+			h.buckets[i]++
+		}
+	}
+	h.count++
+	h.sum += seconds
+}
+
+// WriteTo writes the metrics in the Prometheus text format.
+func (o *PrometheusObserver) WriteTo(w io.Writer) (int64, error) {
+	prefix := "cache_"
+	if o.namespace != "" {
+		prefix = o.namespace + "_cache_"
+	}
+	var b bytes.Buffer
+	o.mu.Lock()
+	counts := make([][2]string, 0, len(o.counts))
+	for key := range o.counts {
+		counts = append(counts, key)
+	}
+	sort.Slice(counts, func(i, j int) bool {
+		return counts[i][0] < counts[j][0] || counts[i][0] == counts[j][0] && counts[i][1] < counts[j][1]
+	})
+	fmt.Fprintf(&b, "# HELP %soperations_total Cache operations by result.\n", prefix)
+	fmt.Fprintf(&b, "# TYPE %soperations_total counter\n", prefix)
+	for _, key := range counts {
+		fmt.Fprintf(&b, "%soperations_total{op=%q,result=%q} %d\n", prefix, key[0], key[1], o.counts[key])
+	}
+
+	ops := make([]string, 0, len(o.latencies))
+	for op := range o.latencies {
+		ops = append(ops, op)
+	}
+	sort.Strings(ops)
+	fmt.Fprintf(&b, "# HELP %soperation_duration_seconds Latency of cache operations.\n", prefix)
+	fmt.Fprintf(&b, "# TYPE %soperation_duration_seconds histogram\n", prefix)
+	for _, op := range ops {
+		h := o.latencies[op]
+		for i, bound := range o.buckets {
+			fmt.Fprintf(&b, "%soperation_duration_seconds_bucket{op=%q,le=%q} %d\n",
+				prefix, op, strconv.FormatFloat(bound, 'g', -1, 64), h.buckets[i])
+		}
+		fmt.Fprintf(&b, "%soperation_duration_seconds_bucket{op=%q,le=\"+Inf\"} %d\n", prefix, op, h.count)
+		fmt.Fprintf(&b, "%soperation_duration_seconds_sum{op=%q} %s\n", prefix, op, strconv.FormatFloat(h.sum, 'g', -1, 64))
+		fmt.Fprintf(&b, "%soperation_duration_seconds_count{op=%q} %d\n", prefix, op, h.count)
+	}
+	o.mu.Unlock()
+	return b.WriteTo(w)
+}
+
+func (o *PrometheusObserver) ServeHTTP(w http.ResponseWriter, req *http.Request) {
+	w.Header().Set("Content-Type", "text/plain; version=0.0.4")
+	o.WriteTo(w)
+}
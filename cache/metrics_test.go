@@ -0,0 +1,99 @@
+package cache
+
+import (
+	"fmt"
+	"net/http/httptest"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+)
+
+// recordingObserver records the operations as "op.result".
+type recordingObserver struct {
+	mu     sync.Mutex
+	events []string
+}
+
+func (o *recordingObserver) Observe(op string, result string, duration time.Duration) {
+	o.mu.Lock()
+	o.events = append(o.events, op+"."+result)
+	o.mu.Unlock()
+}
+
+var newInstrumentedStore = func(_ *testing.T, defaultExpiration time.Duration) CacheStore {
+	return NewInstrumentedStore(NewInMemoryStore(defaultExpiration), &recordingObserver{})
+}
+
+func TestInstrumentedCache_TypicalGetSet(t *testing.T) {
+	typicalGetSet(t, newInstrumentedStore)
+}
+
+func TestInstrumentedCache_IncrDecr(t *testing.T) {
+	incrDecr(t, newInstrumentedStore)
+}
+
+func TestInstrumentedCache_EmptyCache(t *testing.T) {
+	emptyCache(t, newInstrumentedStore)
+}
+
+func TestInstrumentedCache_Observer(t *testing.T) {
+	observer := &recordingObserver{}
+	store := NewInstrumentedStore(NewInMemoryStore(time.Hour), observer)
+	var value int
+	store.Get("value", &value)
+	store.Set("value", 1, DEFAULT)
+	store.Get("value", &value)
+	store.Add("value", 2, DEFAULT)
+	store.Replace("value", 3, DEFAULT)
+	store.Increment("value", 1)
+	store.Decrement("missing", 1)
+	store.Get("value", "not a pointer")
+	store.Delete("value")
+	store.Flush()
+	expected := "get.miss set.ok get.hit add.not_stored replace.ok increment.ok decrement.miss get.error delete.ok flush.ok"
+	if events := strings.Join(observer.events, " "); events != expected {
+		t.Errorf("Expected %s, got %s", expected, events)
+	}
+}
+
+func TestExpvarObserver(t *testing.T) {
+	// A name of its own, as expvar keeps the maps of the previous runs.
+	name := fmt.Sprintf("cache_test_%d", time.Now().UnixNano())
+	observer := NewExpvarObserver(name)
+	observer.Observe("get", ResultHit, time.Millisecond)
+	NewExpvarObserver(name).Observe("get", ResultHit, time.Millisecond)
+	if hits := observer.vars.Get("get.hit"); hits == nil || hits.String() != "2" {
+		t.Errorf("Expected 2 hits, got %v", hits)
+	}
+	if latency := observer.vars.Get("get.nanoseconds"); latency == nil || latency.String() != "2000000" {
+		t.Errorf("Expected a total latency of 2ms, got %v", latency)
+	}
+}
+
+func TestPrometheusObserver(t *testing.T) {
+	observer := NewPrometheusObserver("app", 0.001, 0.01)
+	observer.Observe("get", ResultHit, 500*time.Microsecond)
+	observer.Observe("get", ResultMiss, 5*time.Millisecond)
+	observer.Observe("set", ResultOK, 50*time.Millisecond)
+
+	w := httptest.NewRecorder()
+	observer.ServeHTTP(w, httptest.NewRequest("GET", "/metrics", nil))
+	for _, line := range []string{
+		"# TYPE app_cache_operations_total counter",
+		`app_cache_operations_total{op="get",result="hit"} 1`,
+		`app_cache_operations_total{op="get",result="miss"} 1`,
+		`app_cache_operations_total{op="set",result="ok"} 1`,
+		"# TYPE app_cache_operation_duration_seconds histogram",
+		`app_cache_operation_duration_seconds_bucket{op="get",le="0.001"} 1`,
+		`app_cache_operation_duration_seconds_bucket{op="get",le="0.01"} 2`,
+		`app_cache_operation_duration_seconds_bucket{op="get",le="+Inf"} 2`,
+		`app_cache_operation_duration_seconds_count{op="get"} 2`,
+		`app_cache_operation_duration_seconds_bucket{op="set",le="0.01"} 0`,
+		`app_cache_operation_duration_seconds_sum{op="set"} 0.05`,
+	} {
+		if !strings.Contains(w.Body.String(), line+"\n") {
+			t.Errorf("Expected %s in:\n%s", line, w.Body)
+		}
+	}
+}
@@ -0,0 +1,129 @@
+package cache
+
+import (
+	"net/http"
+	"strconv"
+	"strings"
+	"time"
+)
+
+var (
+	defaultMethods = []string{"GET", "HEAD"}
+
+	// defaultStatuses are the status codes cacheable by default per RFC 7231,
+	// partial content excepted.
+	defaultStatuses = []int{
+		http.StatusOK,
+		http.StatusNonAuthoritativeInfo,
+		http.StatusNoContent,
+		http.StatusMultipleChoices,
+		http.StatusMovedPermanently,
+		http.StatusNotFound,
+		http.StatusMethodNotAllowed,
+		http.StatusGone,
+		http.StatusRequestURITooLong,
+		http.StatusNotImplemented,
+	}
+)
+
+// cacheableRequest reports whether the response to req may be looked up in
+// and stored to the cache.
+func (o Options) cacheableRequest(req *http.Request) (lookup bool, store bool) {
+	methods := o.Methods
+	if methods == nil {
+		methods = defaultMethods
+	}
+	if !containsString(methods, req.Method) {
+		return false, false
+	}
+	cc := parseCacheControl(req.Header["Cache-Control"])
+	if _, ok := cc["no-store"]; ok {
+		return false, false
+	}
+	if _, ok := cc["no-cache"]; ok || req.Header.Get("Pragma") == "no-cache" {
+		return false, true
+	}
+	return true, true
+}
+
+// lifetime reports whether a response may be stored and for how long. The
+// Set-Cookie headers are removed from header when StripSetCookie is set.
+func (o Options) lifetime(status int, header http.Header, expire time.Duration) (time.Duration, bool) {
+	statuses := o.Statuses
+	if statuses == nil {
+		statuses = defaultStatuses
+	}
+	if !containsInt(statuses, status) {
+		return 0, false
+	}
+	if header.Get("Vary") == "*" {
+		return 0, false
+	}
+
+	cc := parseCacheControl(header["Cache-Control"])
+	for _, directive := range []string{"no-store", "no-cache", "private"} {
+		if _, ok := cc[directive]; ok {
+			return 0, false
+		}
+	}
+	maxAge, ok := cc["s-maxage"]
+	if !ok {
+		maxAge, ok = cc["max-age"]
+	}
+	if ok {
+		seconds, err := strconv.ParseInt(maxAge, 10, 64)
+		if err != nil || seconds <= 0 {
+			return 0, false
+		}
+		// The handler may shorten the lifetime, never extend it.
+		if d := time.Duration(seconds) * time.Second; expire <= 0 || d < expire {
+			expire = d
+		}
+	}
+
+	if _, ok := header["Set-Cookie"]; ok {
+		if !o.StripSetCookie {
+			return 0, false
+		}
+		header.Del("Set-Cookie")
+	}
+	return expire, true
+}
+
+// parseCacheControl returns the directives of Cache-Control header values,
+// keyed by their lower-cased name.
+func parseCacheControl(values []string) map[string]string {
+	directives := make(map[string]string)
+	for _, value := range values {
+		for _, part := range strings.Split(value, ",") {
+			part = strings.TrimSpace(part)
+			if part == "" {
+				continue
+			}
+			name, arg := part, ""
+			if i := strings.Index(part, "="); i >= 0 {
+				name, arg = part[:i], strings.Trim(part[i+1:], `"`)
+			}
+			directives[strings.ToLower(strings.TrimSpace(name))] = arg
+		}
+	}
+	return directives
+}
+
+func containsString(list []string, s string) bool {
+	for _, v := range list {
+		if v == s {
+			return true
+		}
+	}
+	return false
+}
+
+func containsInt(list []int, n int) bool {
+	for _, v := range list {
+		if v == n {
+			return true
+		}
+	}
+	return false
+}
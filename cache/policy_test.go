@@ -0,0 +1,142 @@
+package cache
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"testing"
+	"time"
+
+	"github.com/gin-gonic/gin"
+)
+
+func TestParseCacheControl(t *testing.T) {
+	cc := parseCacheControl([]string{`public, Max-Age=60`, `s-maxage="30", no-transform`})
+	if len(cc) != 4 || cc["max-age"] != "60" || cc["s-maxage"] != "30" {
+		t.Errorf("Unexpected directives %v", cc)
+	}
+	if _, ok := cc["public"]; !ok {
+		t.Errorf("Expected the public directive in %v", cc)
+	}
+}
+
+func TestPolicy_Lifetime(t *testing.T) {
+	var options Options
+	cases := []struct {
+		status int
+		header http.Header
+		expire time.Duration
+		ok     bool
+	}{
+		{http.StatusOK, http.Header{}, time.Hour, true},
+		{http.StatusNotFound, http.Header{}, time.Hour, true},
+		{http.StatusInternalServerError, http.Header{}, 0, false},
+		{http.StatusFound, http.Header{}, 0, false},
+		{http.StatusOK, http.Header{"Cache-Control": {"no-store"}}, 0, false},
+		{http.StatusOK, http.Header{"Cache-Control": {"private, max-age=60"}}, 0, false},
+		{http.StatusOK, http.Header{"Cache-Control": {"no-cache"}}, 0, false},
+		{http.StatusOK, http.Header{"Cache-Control": {"max-age=0"}}, 0, false},
+		{http.StatusOK, http.Header{"Cache-Control": {"max-age=60"}}, time.Minute, true},
+		{http.StatusOK, http.Header{"Cache-Control": {"max-age=60, s-maxage=30"}}, 30 * time.Second, true},
+		{http.StatusOK, http.Header{"Cache-Control": {"max-age=86400"}}, time.Hour, true},
+		{http.StatusOK, http.Header{"Vary": {"*"}}, 0, false},
+		{http.StatusOK, http.Header{"Set-Cookie": {"session=1"}}, 0, false},
+	}
+	for i, tc := range cases {
+		expire, ok := options.lifetime(tc.status, tc.header, time.Hour)
+		if ok != tc.ok || (ok && expire != tc.expire) {
+			t.Errorf("Case %d: expected (%s, %t), got (%s, %t)", i, tc.expire, tc.ok, expire, ok)
+		}
+	}
+
+	options.StripSetCookie = true
+	header := http.Header{"Set-Cookie": {"session=1"}, "Content-Type": {"text/plain"}}
+	if _, ok := options.lifetime(http.StatusOK, header, time.Hour); !ok {
+		t.Errorf("Expected responses setting cookies to be cached when StripSetCookie is set")
+	}
+	if _, ok := header["Set-Cookie"]; ok {
+		t.Errorf("Expected Set-Cookie to be stripped, got %v", header)
+	}
+}
+
+func TestPolicy_CacheableRequest(t *testing.T) {
+	var options Options
+	cases := []struct {
+		method string
+		header http.Header
+		lookup bool
+		store  bool
+	}{
+		{"GET", http.Header{}, true, true},
+		{"HEAD", http.Header{}, true, true},
+		{"POST", http.Header{}, false, false},
+		{"GET", http.Header{"Cache-Control": {"no-cache"}}, false, true},
+		{"GET", http.Header{"Pragma": {"no-cache"}}, false, true},
+		{"GET", http.Header{"Cache-Control": {"no-store"}}, false, false},
+	}
+	for i, tc := range cases {
+		req, _ := http.NewRequest(tc.method, "/", nil)
+		req.Header = tc.header
+		lookup, store := options.cacheableRequest(req)
+		if lookup != tc.lookup || store != tc.store {
+			t.Errorf("Case %d: expected (%t, %t), got (%t, %t)", i, tc.lookup, tc.store, lookup, store)
+		}
+	}
+
+	options.Methods = []string{"POST"}
+	req, _ := http.NewRequest("POST", "/", nil)
+	if lookup, store := options.cacheableRequest(req); !lookup || !store {
+		t.Errorf("Expected POST to be cacheable when listed in Methods")
+	}
+}
+
+func TestCachePage_Policy(t *testing.T) {
+	store := NewInMemoryStore(time.Minute)
+	calls := 0
+	router := gin.New()
+	handler := CachePage(store, time.Minute, func(c *gin.Context) {
+		calls++
+		switch c.Query("case") {
+		case "error":
+			c.String(http.StatusInternalServerError, "error")
+		case "cookie":
+			c.SetCookie("session", "secret", 3600, "/", "", false, true)
+			c.String(http.StatusOK, "cookie")
+		default:
+			c.String(http.StatusOK, "ok")
+		}
+	})
+	router.GET("/page", handler)
+	router.POST("/page", handler)
+
+	for _, target := range []string{"/page?case=error", "/page?case=cookie"} {
+		calls = 0
+		performRequest(router, "GET", target)
+		if w := performRequest(router, "GET", target); w.Header().Get("X-Cache") != "MISS" || calls != 2 {
+			t.Errorf("%s: expected no caching, got X-Cache %q after %d calls", target, w.Header().Get("X-Cache"), calls)
+		}
+	}
+
+	calls = 0
+	performRequest(router, "POST", "/page")
+	performRequest(router, "POST", "/page")
+	if calls != 2 {
+		t.Errorf("Expected POST requests not to be cached, handler ran %d times", calls)
+	}
+
+	calls = 0
+	if w := performRequest(router, "GET", "/page"); w.Header().Get("X-Cache") != "MISS" {
+		t.Errorf("Expected X-Cache MISS, got %q", w.Header().Get("X-Cache"))
+	}
+	w := performRequest(router, "GET", "/page")
+	if w.Header().Get("X-Cache") != "HIT" || w.Header().Get("Age") != "0" || len(w.Header()["X-Cache"]) != 1 {
+		t.Errorf("Expected X-Cache HIT and Age 0, got %v", w.Header())
+	}
+
+	req, _ := http.NewRequest("GET", "/page", nil)
+	req.Header.Set("Cache-Control", "no-cache")
+	w = httptest.NewRecorder()
+	router.ServeHTTP(w, req)
+	if w.Header().Get("X-Cache") != "MISS" || calls != 2 {
+		t.Errorf("Expected Cache-Control: no-cache to bypass the cache, handler ran %d times", calls)
+	}
+}
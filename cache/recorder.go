@@ -0,0 +1,92 @@
+package cache
+
+import (
+	"bufio"
+	"bytes"
+	"errors"
+	"net"
+	"net/http"
+
+	"github.com/gin-gonic/gin"
+)
+
+// responseRecorder is a gin.ResponseWriter keeping the response in memory,
+// for handlers whose output must not, or not yet, reach the client.
+type responseRecorder struct {
+	header http.Header
+	status int
+	size   int
+	body   bytes.Buffer
+}
+
+var _ gin.ResponseWriter = (*responseRecorder)(nil)
+
+func newResponseRecorder() *responseRecorder {
+	return &responseRecorder{header: make(http.Header), status: http.StatusOK, size: -1}
+}
+
+func (r *responseRecorder) Header() http.Header {
+	return r.header
+}
+
+func (r *responseRecorder) WriteHeader(code int) {
+	if code > 0 && !r.Written() {
+		r.status = code
+	}
+}
+
+func (r *responseRecorder) WriteHeaderNow() {
+	if !r.Written() {
+		r.size = 0
+	}
+}
+
+func (r *responseRecorder) Write(data []byte) (int, error) {
+	r.WriteHeaderNow()
+	n, err := r.body.Write(data)
+	r.size += n
+	return n, err
+}
+
+func (r *responseRecorder) WriteString(s string) (int, error) {
+	return r.Write([]byte(s))
+}
+
+func (r *responseRecorder) Status() int {
+	return r.status
+}
+
+func (r *responseRecorder) Size() int {
+	return r.size
+}
+
+func (r *responseRecorder) Written() bool {
+	return r.size != -1
+}
+
+func (r *responseRecorder) Flush() {}
+
+func (r *responseRecorder) CloseNotify() <-chan bool {
+	return make(chan bool)
+}
+
+func (r *responseRecorder) Hijack() (net.Conn, *bufio.ReadWriter, error) {
+	return nil, nil, errors.New("cache: the response recorder cannot be hijacked.")
+}
+
+func (r *responseRecorder) Pusher() http.Pusher {
+	return nil
+}
+
+// writeTo sends the recorded response to w.
+func (r *responseRecorder) writeTo(w gin.ResponseWriter) {
+	for k, vals := range r.header {
+		w.Header()[k] = vals
+	}
+	w.WriteHeader(r.status)
+	if r.body.Len() > 0 {
+		w.Write(r.body.Bytes())
+	} else if r.Written() {
+		w.WriteHeaderNow()
+	}
+}
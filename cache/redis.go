@@ -1,163 +1,757 @@
 package cache
 
 import (
+	"context"
+	"crypto/tls"
+	"errors"
+	"fmt"
 	"github.com/garyburd/redigo/redis"
+	"net"
+	"strconv"
+	"strings"
 	"time"
 )
 
 // Wraps the Redis client to meet the Cache interface.
 type RedisStore struct {
 	pool              *redis.Pool
+	cluster           *redisCluster
 	defaultExpiration time.Duration
+	namespace         string
+	serializer        Serializer
+	readTimeout       time.Duration
 }
 
-// until redigo supports sharding/clustering, only one host will be in hostList
+// RedisOptions holds the optional settings of a RedisStore.
+type RedisOptions struct {
+	// Namespace is prepended to every key, followed by a colon. When set,
+	// Flush only deletes the keys of the namespace.
+	Namespace string
+
+	// Database is the number of the database selected on every connection.
+	// Flush never deletes keys outside of it. Clusters only have database 0.
+	Database int
+
+	// Serializer encodes the values. Without one, values are encoded with
+	// gob and no header, as in earlier releases.
+	Serializer Serializer
+
+	// MaxIdle is the maximum number of idle connections kept, 5 by default.
+	// MaxActive is the maximum number of connections, unlimited if zero.
+	// When it is reached, commands fail unless Wait is set, in which case
+	// they wait for a connection to be released. Connections idle for more
+	// than IdleTimeout, 240 seconds by default, are closed. In a cluster,
+	// these apply to the connections to each node.
+	MaxIdle     int
+	MaxActive   int
+	Wait        bool
+	IdleTimeout time.Duration
+
+	// DialTimeout bounds the time taken to connect, ReadTimeout and
+	// WriteTimeout the time taken by each read and write. Zero means no
+	// timeout.
+	DialTimeout  time.Duration
+	ReadTimeout  time.Duration
+	WriteTimeout time.Duration
+
+	// TLSConfig enables TLS. Its ServerName defaults to the host dialed.
+	TLSConfig *tls.Config
+
+	// Network is "tcp", the default, or "unix", in which case host is the
+	// path of the socket.
+	Network string
+
+	// MasterName enables Sentinel: host then lists the addresses of the
+	// sentinels, separated by commas, which are asked for the address of
+	// the master named MasterName. SentinelPassword authenticates to the
+	// sentinels.
+	MasterName       string
+	SentinelPassword string
+
+	// Cluster enables Redis Cluster: host then lists the addresses of some
+	// nodes, separated by commas, from which the others are discovered.
+	// Keys are sent to the node serving their hash slot.
+	Cluster bool
+}
+
+// NewRedisCache returns a store using the redis server at host. See
+// RedisOptions for Sentinel and clusters.
 func NewRedisCache(host string, password string, defaultExpiration time.Duration) *RedisStore {
-	var pool = &redis.Pool{
-		MaxIdle:     5,
-		IdleTimeout: 240 * time.Second,
+	return NewRedisCacheWithOptions(host, password, defaultExpiration, RedisOptions{})
+}
+
+// NewRedisCacheWithOptions is like NewRedisCache but accepts RedisOptions.
+func NewRedisCacheWithOptions(host string, password string, defaultExpiration time.Duration, options RedisOptions) *RedisStore {
+	c := &RedisStore{
+		defaultExpiration: defaultExpiration,
+		namespace:         options.Namespace,
+		serializer:        options.Serializer,
+		readTimeout:       options.ReadTimeout,
+	}
+	if options.Cluster {
+		c.cluster = newRedisCluster(strings.Split(host, ","), password, options)
+	} else {
+		c.pool = newRedisPool(host, password, options)
+	}
+	return c
+}
+
+func newRedisPool(host string, password string, options RedisOptions) *redis.Pool {
+	if options.MaxIdle == 0 {
+		options.MaxIdle = 5
+	}
+	if options.IdleTimeout == 0 {
+		options.IdleTimeout = 240 * time.Second
+	}
+	return &redis.Pool{
+		MaxIdle:     options.MaxIdle,
+		MaxActive:   options.MaxActive,
+		Wait:        options.Wait,
+		IdleTimeout: options.IdleTimeout,
 		Dial: func() (redis.Conn, error) {
-			// the redis protocol should probably be made sett-able
-			c, err := redis.Dial("tcp", host)
-			if err != nil {
-				return nil, err
-			}
-			if len(password) > 0 {
-				if _, err := c.Do("AUTH", password); err != nil {
-					c.Close()
-					return nil, err
-				}
-			} else {
-				// check with PING
-				if _, err := c.Do("PING"); err != nil {
-					c.Close()
+			network, addr := options.Network, host
+			if options.MasterName != "" {
+				var err error
+				if addr, err = options.masterAddr(strings.Split(host, ",")); err != nil {
 					return nil, err
 				}
+				network = "tcp"
 			}
-			return c, err
+			return options.dial(network, addr, password, options.Database)
 		},
 		// custom connection test method
 		TestOnBorrow: func(c redis.Conn, t time.Time) error {
+			if options.MasterName != "" {
+				// After a failover, the former master becomes a replica.
+				return checkMaster(c)
+			}
 			if _, err := c.Do("PING"); err != nil {
 				return err
 			}
 			return nil
 		},
 	}
-	return &RedisStore{pool, defaultExpiration}
+}
+
+// dial connects to addr, authenticates and selects database.
+func (o RedisOptions) dial(network, addr string, password string, database int) (redis.Conn, error) {
+	if network == "" {
+		network = "tcp"
+	}
+	d := net.Dialer{Timeout: o.DialTimeout}
+	netConn, err := d.Dial(network, addr)
+	if err != nil {
+		return nil, err
+	}
+	if o.TLSConfig != nil {
+		config := o.TLSConfig.Clone()
+		if config.ServerName == "" {
+			if config.ServerName, _, err = net.SplitHostPort(addr); err != nil {
+				netConn.Close()
+				return nil, err
+			}
+		}
+		tlsConn := tls.Client(netConn, config)
+		if o.DialTimeout > 0 {
+			tlsConn.SetDeadline(time.Now().Add(o.DialTimeout))
+		}
+		if err = tlsConn.Handshake(); err != nil {
+			netConn.Close()
+			return nil, err
+		}
+		tlsConn.SetDeadline(time.Time{})
+		netConn = tlsConn
+	}
+
+	c := redis.NewConn(netConn, o.ReadTimeout, o.WriteTimeout)
+	if len(password) > 0 {
+		if _, err := c.Do("AUTH", password); err != nil {
+			c.Close()
+			return nil, err
+		}
+	} else {
+		// check with PING
+		if _, err := c.Do("PING"); err != nil {
+			c.Close()
+			return nil, err
+		}
+	}
+	if database != 0 {
+		if _, err := c.Do("SELECT", database); err != nil {
+			c.Close()
+			return nil, err
+		}
+	}
+	return c, nil
+}
+
+// masterAddr asks the sentinels for the address of the master, trying them
+// in turn.
+func (o RedisOptions) masterAddr(sentinels []string) (string, error) {
+	err := errors.New("cache: no redis sentinel")
+	for _, sentinel := range sentinels {
+		var c redis.Conn
+		if c, err = o.dial("tcp", sentinel, o.SentinelPassword, 0); err != nil {
+			continue
+		}
+		var addr []string
+		addr, err = redis.Strings(c.Do("SENTINEL", "get-master-addr-by-name", o.MasterName))
+		c.Close()
+		if err == redis.ErrNil {
+			return "", fmt.Errorf("cache: unknown redis master %q", o.MasterName)
+		}
+		if err == nil && len(addr) == 2 {
+			return net.JoinHostPort(addr[0], addr[1]), nil
+		}
+	}
+	return "", err
+}
+
+// checkMaster fails if c is not connected to a master.
+func checkMaster(c redis.Conn) error {
+	role, err := redis.Values(c.Do("ROLE"))
+	if err != nil {
+		return err
+	}
+	if len(role) == 0 {
+		return errors.New("cache: unexpected reply to ROLE")
+	}
+	if name, _ := redis.String(role[0], nil); name != "master" {
+		return fmt.Errorf("cache: redis server is a %s", name)
+	}
+	return nil
+}
+
+// conn returns a connection for the commands on key, the name of a key in the
+// namespace, bound to ctx. In a cluster, it is routed to the node serving key.
+func (c *RedisStore) conn(ctx context.Context, key string) redis.Conn {
+	if c.cluster != nil {
+		return c.withContext(ctx, c.cluster.conn(key))
+	}
+	return c.withContext(ctx, c.pool.Get())
+}
+
+// nodes returns a connection to every master, bound to ctx, to run commands
+// on all the keys.
+func (c *RedisStore) nodes(ctx context.Context) ([]redis.Conn, error) {
+	if c.cluster == nil {
+		return []redis.Conn{c.withContext(ctx, c.pool.Get())}, nil
+	}
+	conns, err := c.cluster.masters()
+	if err != nil {
+		return nil, err
+	}
+	for i, conn := range conns {
+		conns[i] = c.withContext(ctx, conn)
+	}
+	return conns, nil
+}
+
+// withContext returns conn bound to ctx, unless ctx can never be done.
+func (c *RedisStore) withContext(ctx context.Context, conn redis.Conn) redis.Conn {
+	if ctx.Done() == nil {
+		return conn
+	}
+	return redisContextConn{Conn: conn, ctx: ctx, readTimeout: c.readTimeout}
+}
+
+// redisContextConn fails the commands once ctx is done, and waits for their
+// replies until the deadline of ctx at most. A command interrupted by the
+// deadline breaks the connection, which the pool then discards.
+type redisContextConn struct {
+	redis.Conn
+	ctx         context.Context
+	readTimeout time.Duration
+}
+
+func (c redisContextConn) Do(command string, args ...interface{}) (interface{}, error) {
+	timeout, err := c.timeout()
+	if err != nil {
+		return nil, err
+	}
+	if timeout == 0 {
+		return c.Conn.Do(command, args...)
+	}
+	reply, err := redis.DoWithTimeout(c.Conn, timeout, command, args...)
+	return reply, c.check(err)
+}
+
+func (c redisContextConn) Send(command string, args ...interface{}) error {
+	if err := c.ctx.Err(); err != nil {
+		return err
+	}
+	return c.Conn.Send(command, args...)
+}
+
+func (c redisContextConn) Receive() (interface{}, error) {
+	timeout, err := c.timeout()
+	if err != nil {
+		return nil, err
+	}
+	if timeout == 0 {
+		return c.Conn.Receive()
+	}
+	reply, err := redis.ReceiveWithTimeout(c.Conn, timeout)
+	return reply, c.check(err)
+}
+
+// timeout returns the time left until the deadline of ctx, capped by the
+// read timeout of the store, or zero without a deadline. It returns the
+// error of ctx if it is done.
+func (c redisContextConn) timeout() (time.Duration, error) {
+	if err := c.ctx.Err(); err != nil {
+		return 0, err
+	}
+	deadline, ok := c.ctx.Deadline()
+	if !ok {
+		return 0, nil
+	}
+	timeout := time.Until(deadline)
+	if timeout <= 0 {
+		return 0, context.DeadlineExceeded
+	}
+	if c.readTimeout > 0 && c.readTimeout < timeout {
+		timeout = c.readTimeout
+	}
+	return timeout, nil
+}
+
+// check returns the error of ctx instead of err when the command failed
+// because ctx was done.
+func (c redisContextConn) check(err error) error {
+	if _, ok := err.(redis.Error); err == nil || ok {
+		return err
+	}
+	if ctxErr := c.ctx.Err(); ctxErr != nil {
+		return ctxErr
+	}
+	// The read may time out just before ctx notices its deadline.
+	if deadline, ok := c.ctx.Deadline(); ok && !time.Now().Before(deadline) {
+		return context.DeadlineExceeded
+	}
+	return err
+}
+
+// slots groups the indexes of keys, names of keys in the namespace, so that
+// multi-key commands never cross hash slots in a cluster.
+func (c *RedisStore) slots(keys []string) [][]int {
+	groups := make(map[uint16][]int)
+	var order []uint16
+	for i, key := range keys {
+		var slot uint16
+		if c.cluster != nil {
+			slot = keySlot(key)
+		}
+		if _, ok := groups[slot]; !ok {
+			order = append(order, slot)
+		}
+		groups[slot] = append(groups[slot], i)
+	}
+	indexes := make([][]int, len(order))
+	for i, slot := range order {
+		indexes[i] = groups[slot]
+	}
+	return indexes
+}
+
+// key returns the name of key in the namespace of the store.
+func (c *RedisStore) key(key string) string {
+	if c.namespace == "" {
+		return key
+	}
+	return c.namespace + ":" + key
 }
 
 func (c *RedisStore) Set(key string, value interface{}, expires time.Duration) error {
-	return c.invoke(c.pool.Get().Do, key, value, expires)
+	return c.invoke(context.Background(), key, value, expires, "")
 }
 
 func (c *RedisStore) Add(key string, value interface{}, expires time.Duration) error {
-	conn := c.pool.Get()
-	if exists(conn, key) {
-		return ErrNotStored
-	}
-	return c.invoke(conn.Do, key, value, expires)
+	return c.invoke(context.Background(), key, value, expires, "NX")
 }
 
 func (c *RedisStore) Replace(key string, value interface{}, expires time.Duration) error {
-	conn := c.pool.Get()
-	if !exists(conn, key) {
-		return ErrNotStored
+	return c.invoke(context.Background(), key, value, expires, "XX")
+}
+
+func (c *RedisStore) Get(key string, ptrValue interface{}) error {
+	return c.GetContext(context.Background(), key, ptrValue)
+}
+
+func (c *RedisStore) Delete(key string) error {
+	return c.DeleteContext(context.Background(), key)
+}
+
+// counterScript adds or subtracts ARGV[1] to the unsigned 64-bit integer at
+// KEYS[1], wrapping around on overflow and stopping at zero on underflow, as
+// per the cache contract. Missing keys are not created. Lua numbers are
+// doubles, so the numbers are handled as pairs of 10-digit halves to stay
+// exact. The expiration of the key is kept.
+var counterScript = redis.NewScript(1, `
+local v = redis.call('GET', KEYS[1])
+if not v then
+	return false
+end
+if not string.match(v, '^%d+$') or #v > 20 then
+	return redis.error_reply('cache: value is not an unsigned integer')
+end
+local B = 10000000000
+local function split(s)
+	if #s <= 10 then
+		return 0, tonumber(s)
+	end
+	return tonumber(string.sub(s, 1, #s - 10)), tonumber(string.sub(s, #s - 9))
+end
+local hi, lo = split(v)
+local dhi, dlo = split(ARGV[1])
+if ARGV[2] == 'incr' then
+	lo = lo + dlo
+	hi = hi + dhi + math.floor(lo / B)
+	lo = lo % B
+	-- 2^64 is 1844674407 3709551616
+	if hi > 1844674407 or (hi == 1844674407 and lo >= 3709551616) then
+		hi = hi - 1844674407
+		lo = lo - 3709551616
+		if lo < 0 then
+			lo = lo + B
+			hi = hi - 1
+		end
+	end
+elseif hi < dhi or (hi == dhi and lo < dlo) then
+	hi, lo = 0, 0
+else
+	hi = hi - dhi
+	lo = lo - dlo
+	if lo < 0 then
+		lo = lo + B
+		hi = hi - 1
+	end
+end
+local r
+if hi > 0 then
+	r = string.format('%.0f%010.0f', hi, lo)
+else
+	r = string.format('%.0f', lo)
+end
+local ttl = redis.call('PTTL', KEYS[1])
+if ttl > 0 then
+	redis.call('SET', KEYS[1], r, 'PX', ttl)
+else
+	redis.call('SET', KEYS[1], r)
+end
+return r
+`)
+
+func (c *RedisStore) Increment(key string, delta uint64) (uint64, error) {
+	return c.count(context.Background(), key, delta, "incr")
+}
+
+func (c *RedisStore) Decrement(key string, delta uint64) (uint64, error) {
+	return c.count(context.Background(), key, delta, "decr")
+}
+
+// count runs counterScript, so that the existence check, the arithmetic and
+// the update happen atomically.
+func (c *RedisStore) count(ctx context.Context, key string, delta uint64, op string) (uint64, error) {
+	conn := c.conn(ctx, c.key(key))
+	defer conn.Close()
+	reply, err := counterScript.Do(conn, c.key(key), strconv.FormatUint(delta, 10), op)
+	if err != nil {
+		return 0, err
 	}
-	err := c.invoke(conn.Do, key, value, expires)
-	if value == nil {
-		return ErrNotStored
-	} else {
+	if reply == nil {
+		return 0, ErrCacheMiss
+	}
+	s, err := redis.String(reply, nil)
+	if err != nil {
+		return 0, err
+	}
+	return strconv.ParseUint(s, 10, 64)
+}
+
+// Flush deletes the keys of the namespace of the store, or all the keys of
+// its database if it has no namespace. Other databases are left untouched.
+func (c *RedisStore) Flush() error {
+	return c.FlushContext(context.Background())
+}
+
+func (c *RedisStore) FlushContext(ctx context.Context) error {
+	conns, err := c.nodes(ctx)
+	if err != nil {
 		return err
 	}
+	for _, conn := range conns {
+		if err == nil {
+			err = c.flush(conn)
+		}
+		conn.Close()
+	}
+	return err
 }
 
-func (c *RedisStore) Get(key string, ptrValue interface{}) error {
-	conn := c.pool.Get()
+// flush deletes the keys of the store served by conn.
+func (c *RedisStore) flush(conn redis.Conn) error {
+	if c.namespace == "" {
+		_, err := conn.Do("FLUSHDB")
+		return err
+	}
+
+	// SCAN may return a key more than once, which DEL tolerates.
+	pattern := escapeGlob(c.namespace) + ":*"
+	cursor := "0"
+	for {
+		values, err := redis.Values(conn.Do("SCAN", cursor, "MATCH", pattern, "COUNT", 1000))
+		if err != nil {
+			return err
+		}
+		if len(values) != 2 {
+			return ErrNotSupport
+		}
+		if cursor, err = redis.String(values[0], nil); err != nil {
+			return err
+		}
+		keys, err := redis.Strings(values[1], nil)
+		if err != nil {
+			return err
+		}
+		for _, slot := range c.slots(keys) {
+			args := make([]interface{}, len(slot))
+			for i, j := range slot {
+				args[i] = keys[j]
+			}
+			if _, err = conn.Do("DEL", args...); err != nil {
+				return err
+			}
+		}
+		if cursor == "0" {
+			return nil
+		}
+	}
+}
+
+// escapeGlob escapes the characters having a meaning in redis patterns.
+func escapeGlob(s string) string {
+	return strings.NewReplacer(`\`, `\\`, "*", `\*`, "?", `\?`, "[", `\[`, "]", `\]`).Replace(s)
+}
+
+func (c *RedisStore) GetContext(ctx context.Context, key string, ptrValue interface{}) error {
+	conn := c.conn(ctx, c.key(key))
 	defer conn.Close()
-	raw, err := conn.Do("GET", key)
-	if raw == nil {
+	raw, err := conn.Do("GET", c.key(key))
+	if raw == nil && err == nil {
 		return ErrCacheMiss
 	}
 	item, err := redis.Bytes(raw, err)
 	if err != nil {
 		return err
 	}
-	return deserialize(item, ptrValue)
+	return deserialize(c.serializer, item, ptrValue)
 }
 
-func exists(conn redis.Conn, key string) bool {
-	retval, _ := redis.Bool(conn.Do("EXISTS", key))
-	return retval
+func (c *RedisStore) SetContext(ctx context.Context, key string, value interface{}, expires time.Duration) error {
+	return c.invoke(ctx, key, value, expires, "")
 }
 
-func (c *RedisStore) Delete(key string) error {
-	conn := c.pool.Get()
+func (c *RedisStore) AddContext(ctx context.Context, key string, value interface{}, expires time.Duration) error {
+	return c.invoke(ctx, key, value, expires, "NX")
+}
+
+func (c *RedisStore) ReplaceContext(ctx context.Context, key string, value interface{}, expires time.Duration) error {
+	return c.invoke(ctx, key, value, expires, "XX")
+}
+
+func (c *RedisStore) DeleteContext(ctx context.Context, key string) error {
+	conn := c.conn(ctx, c.key(key))
 	defer conn.Close()
-	if !exists(conn, key) {
+	n, err := redis.Int(conn.Do("DEL", c.key(key)))
+	if err == nil && n == 0 {
 		return ErrCacheMiss
 	}
-	_, err := conn.Do("DEL", key)
 	return err
 }
 
-func (c *RedisStore) Increment(key string, delta uint64) (uint64, error) {
-	conn := c.pool.Get()
-	defer conn.Close()
-	// Check for existence *before* increment as per the cache contract.
-	// redis will auto create the key, and we don't want that. Since we need to do increment
-	// ourselves instead of natively via INCRBY (redis doesn't support wrapping), we get the value
-	// and do the exists check this way to minimize calls to Redis
-	val, err := conn.Do("GET", key)
-	if val == nil {
-		return 0, ErrCacheMiss
+func (c *RedisStore) IncrementContext(ctx context.Context, key string, delta uint64) (uint64, error) {
+	return c.count(ctx, key, delta, "incr")
+}
+
+func (c *RedisStore) DecrementContext(ctx context.Context, key string, delta uint64) (uint64, error) {
+	return c.count(ctx, key, delta, "decr")
+}
+
+// GetMulti looks up all the keys with a single MGET, or one per hash slot in
+// a cluster.
+func (c *RedisStore) GetMulti(ctx context.Context, values map[string]interface{}) error {
+	if len(values) == 0 {
+		return ctx.Err()
+	}
+	keys := make([]string, 0, len(values))
+	names := make([]string, 0, len(values))
+	for key := range values {
+		keys = append(keys, key)
+		names = append(names, c.key(key))
 	}
-	if err == nil {
-		currentVal, err := redis.Int64(val, nil)
+	replies := make([]interface{}, len(keys))
+	for _, slot := range c.slots(names) {
+		args := make([]interface{}, len(slot))
+		for i, j := range slot {
+			args[i] = names[j]
+		}
+		conn := c.conn(ctx, names[slot[0]])
+		values, err := redis.Values(conn.Do("MGET", args...))
+		conn.Close()
 		if err != nil {
-			return 0, err
+			return err
+		}
+		if len(values) != len(slot) {
+			return ErrNotSupport
+		}
+		for i, j := range slot {
+			replies[j] = values[i]
 		}
-		var sum int64 = currentVal + int64(delta)
-		_, err = conn.Do("SET", key, sum)
+	}
+	for i, key := range keys {
+		if replies[i] == nil {
+			delete(values, key)
+			continue
+		}
+		item, err := redis.Bytes(replies[i], nil)
 		if err != nil {
-			return 0, err
+			return err
+		}
+		if err = deserialize(c.serializer, item, values[key]); err != nil {
+			return err
 		}
-		return uint64(sum), nil
-	} else {
-		return 0, err
 	}
+	return nil
 }
 
-func (c *RedisStore) Decrement(key string, delta uint64) (newValue uint64, err error) {
-	conn := c.pool.Get()
+// SetMulti pipelines one SET per key, sent in a single round trip, or one
+// per hash slot in a cluster.
+func (c *RedisStore) SetMulti(ctx context.Context, values map[string]interface{}, expires time.Duration) error {
+	commands := make([][]interface{}, 0, len(values))
+	names := make([]string, 0, len(values))
+	for key, value := range values {
+		args, err := c.setArgs(key, value, expires, "")
+		if err != nil {
+			return err
+		}
+		commands = append(commands, args)
+		names = append(names, c.key(key))
+	}
+	for _, slot := range c.slots(names) {
+		if err := c.pipeline(ctx, names[slot[0]], "SET", commands, slot); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// pipeline sends the commands of indexes at once on the connection for key,
+// returning the first error.
+func (c *RedisStore) pipeline(ctx context.Context, key string, command string, commands [][]interface{}, indexes []int) error {
+	conn := c.conn(ctx, key)
 	defer conn.Close()
-	// Check for existence *before* increment as per the cache contract.
-	// redis will auto create the key, and we don't want that, hence the exists call
-	if !exists(conn, key) {
-		return 0, ErrCacheMiss
+	for _, i := range indexes {
+		if err := conn.Send(command, commands[i]...); err != nil {
+			return err
+		}
+	}
+	if err := conn.Flush(); err != nil {
+		return err
 	}
-	// Decrement contract says you can only go to 0
-	// so we go fetch the value and if the delta is greater than the amount,
-	// 0 out the value
-	currentVal, err := redis.Int64(conn.Do("GET", key))
-	if err == nil && delta > uint64(currentVal) {
-		tempint, err := redis.Int64(conn.Do("DECRBY", key, currentVal))
-		return uint64(tempint), err
+	var first error
+	for range indexes {
+		if _, err := conn.Receive(); err != nil && first == nil {
+			first = err
+		}
 	}
-	tempint, err := redis.Int64(conn.Do("DECRBY", key, delta))
-	return uint64(tempint), err
+	return first
 }
 
-func (c *RedisStore) Flush() error {
-	conn := c.pool.Get()
+// DeleteMulti deletes all the keys with a single DEL, or one per hash slot in
+// a cluster.
+func (c *RedisStore) DeleteMulti(ctx context.Context, keys ...string) error {
+	if len(keys) == 0 {
+		return ctx.Err()
+	}
+	names := make([]string, len(keys))
+	for i, key := range keys {
+		names[i] = c.key(key)
+	}
+	for _, slot := range c.slots(names) {
+		args := make([]interface{}, len(slot))
+		for i, j := range slot {
+			args[i] = names[j]
+		}
+		conn := c.conn(ctx, names[slot[0]])
+		_, err := conn.Do("DEL", args...)
+		conn.Close()
+		if err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+func (c *RedisStore) TTL(ctx context.Context, key string) (time.Duration, error) {
+	conn := c.conn(ctx, c.key(key))
 	defer conn.Close()
-	_, err := conn.Do("FLUSHALL")
+	ms, err := redis.Int64(conn.Do("PTTL", c.key(key)))
+	switch {
+	case err != nil:
+		return 0, err
+	case ms == -2:
+		return 0, ErrCacheMiss
+	case ms < 0:
+		return FOREVER, nil
+	}
+	return time.Duration(ms) * time.Millisecond, nil
+}
+
+// Touch sets the expiration of key with PEXPIRE, or removes it with PERSIST
+// for FOREVER.
+func (c *RedisStore) Touch(ctx context.Context, key string, expires time.Duration) error {
+	if expires == DEFAULT {
+		expires = c.defaultExpiration
+	}
+	conn := c.conn(ctx, c.key(key))
+	defer conn.Close()
+	var n int
+	var err error
+	if expires > 0 {
+		n, err = redis.Int(conn.Do("PEXPIRE", c.key(key), milliseconds(expires)))
+	} else {
+		if n, err = redis.Int(conn.Do("EXISTS", c.key(key))); err == nil && n == 1 {
+			_, err = conn.Do("PERSIST", c.key(key))
+		}
+	}
+	if err == nil && n == 0 {
+		return ErrCacheMiss
+	}
 	return err
 }
 
-func (c *RedisStore) invoke(f func(string, ...interface{}) (interface{}, error),
-	key string, value interface{}, expires time.Duration) error {
+// invoke stores value with a single SET. condition is "NX" to only set
+// missing keys, "XX" to only set existing ones, or empty.
+func (c *RedisStore) invoke(ctx context.Context, key string, value interface{}, expires time.Duration, condition string) error {
+	args, err := c.setArgs(key, value, expires, condition)
+	if err != nil {
+		return err
+	}
+	conn := c.conn(ctx, c.key(key))
+	defer conn.Close()
+	reply, err := conn.Do("SET", args...)
+	if err != nil {
+		return err
+	}
+	if reply == nil {
+		return ErrNotStored
+	}
+	return nil
+}
 
+// setArgs returns the arguments of the SET storing value.
+func (c *RedisStore) setArgs(key string, value interface{}, expires time.Duration, condition string) ([]interface{}, error) {
 	switch expires {
 	case DEFAULT:
 		expires = c.defaultExpiration
@@ -165,17 +759,25 @@ func (c *RedisStore) invoke(f func(string, ...interface{}) (interface{}, error),
 		expires = time.Duration(0)
 	}
 
-	b, err := serialize(value)
+	b, err := serialize(c.serializer, value)
 	if err != nil {
-		return err
+		return nil, err
 	}
-	conn := c.pool.Get()
-	defer conn.Close()
+	args := []interface{}{c.key(key), b}
 	if expires > 0 {
-		_, err := f("SETEX", key, int32(expires/time.Second), b)
-		return err
-	} else {
-		_, err := f("SET", key, b)
-		return err
+		args = append(args, "PX", milliseconds(expires))
+	}
+	if condition != "" {
+		args = append(args, condition)
+	}
+	return args, nil
+}
+
+// milliseconds rounds d down to milliseconds, keeping at least one.
+func milliseconds(d time.Duration) int64 {
+	ms := int64(d / time.Millisecond)
+	if ms == 0 {
+		ms = 1
 	}
+	return ms
 }
@@ -0,0 +1,352 @@
+package cache
+
+import (
+	"errors"
+	"net"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/garyburd/redigo/redis"
+)
+
+// redisClusterSlots is the number of hash slots of a redis cluster.
+const redisClusterSlots = 16384
+
+// redisClusterRedirects bounds the MOVED and ASK redirections followed by a
+// command.
+const redisClusterRedirects = 5
+
+var errNoClusterNode = errors.New("cache: no redis cluster node serves the key")
+
+// redisCluster routes the commands to the nodes of a redis cluster according
+// to the hash slot of their key.
+type redisCluster struct {
+	seeds    []string
+	password string
+	options  RedisOptions
+
+	mu    sync.RWMutex
+	slots [redisClusterSlots]string
+	pools map[string]*redis.Pool
+}
+
+func newRedisCluster(seeds []string, password string, options RedisOptions) *redisCluster {
+	options.Database = 0
+	options.Network = "tcp"
+	options.MasterName = ""
+	return &redisCluster{
+		seeds:    seeds,
+		password: password,
+		options:  options,
+		pools:    make(map[string]*redis.Pool),
+	}
+}
+
+// conn returns a connection routing the commands to the node serving key.
+func (c *redisCluster) conn(key string) redis.Conn {
+	return &redisClusterConn{cluster: c, slot: keySlot(key)}
+}
+
+// masters returns a connection to every master of the cluster.
+func (c *redisCluster) masters() ([]redis.Conn, error) {
+	if err := c.refresh(); err != nil {
+		return nil, err
+	}
+	c.mu.RLock()
+	seen := make(map[string]bool)
+	var addrs []string
+	for _, addr := range c.slots {
+		if addr != "" && !seen[addr] {
+			seen[addr] = true
+			addrs = append(addrs, addr)
+		}
+	}
+	c.mu.RUnlock()
+	conns := make([]redis.Conn, len(addrs))
+	for i, addr := range addrs {
+		conns[i] = c.get(addr)
+	}
+	return conns, nil
+}
+
+// addr returns the address of the node serving slot, loading the slots if
+// unknown.
+func (c *redisCluster) addr(slot uint16) (string, error) {
+	c.mu.RLock()
+	addr := c.slots[slot]
+	c.mu.RUnlock()
+	if addr != "" {
+		return addr, nil
+	}
+	if err := c.refresh(); err != nil {
+		return "", err
+	}
+	c.mu.RLock()
+	addr = c.slots[slot]
+	c.mu.RUnlock()
+	if addr == "" {
+		return "", errNoClusterNode
+	}
+	return addr, nil
+}
+
+// pool returns the pool of connections to addr, creating it if needed.
+func (c *redisCluster) pool(addr string) *redis.Pool {
+	c.mu.RLock()
+	p, ok := c.pools[addr]
+	c.mu.RUnlock()
+	if ok {
+		return p
+	}
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	if p, ok = c.pools[addr]; !ok {
+		p = newRedisPool(addr, c.password, c.options)
+		c.pools[addr] = p
+	}
+	return p
+}
+
+// get returns a connection to addr. Dialing happens without the lock held.
+func (c *redisCluster) get(addr string) redis.Conn {
+	return c.pool(addr).Get()
+}
+
+// refresh loads the slots served by each node with CLUSTER SLOTS, asking the
+// known nodes in turn.
+func (c *redisCluster) refresh() error {
+	c.mu.RLock()
+	addrs := append([]string(nil), c.seeds...)
+	for addr := range c.pools {
+		addrs = append(addrs, addr)
+	}
+	c.mu.RUnlock()
+
+	err := errNoClusterNode
+	for _, addr := range addrs {
+		conn := c.get(addr)
+		var ranges []interface{}
+		ranges, err = redis.Values(conn.Do("CLUSTER", "SLOTS"))
+		conn.Close()
+		if err == nil {
+			return c.load(addr, ranges)
+		}
+	}
+	return err
+}
+
+// load records the reply of CLUSTER SLOTS made to addr, which is an array of
+// [start, end, [ip, port, ...] of the master, replicas...].
+func (c *redisCluster) load(addr string, ranges []interface{}) error {
+	host, _, _ := net.SplitHostPort(addr)
+	var slots [redisClusterSlots]string
+	for _, r := range ranges {
+		values, err := redis.Values(r, nil)
+		if err != nil || len(values) < 3 {
+			return errors.New("cache: unexpected reply to CLUSTER SLOTS")
+		}
+		start, err1 := redis.Int(values[0], nil)
+		end, err2 := redis.Int(values[1], nil)
+		node, err3 := redis.Values(values[2], nil)
+		if err1 != nil || err2 != nil || err3 != nil || len(node) < 2 ||
+			start < 0 || end >= redisClusterSlots || start > end {
+			return errors.New("cache: unexpected reply to CLUSTER SLOTS")
+		}
+		ip, _ := redis.String(node[0], nil)
+		port, _ := redis.Int(node[1], nil)
+		if ip == "" {
+			// The node asked does not know its own address.
+			ip = host
+		}
+		for slot := start; slot <= end; slot++ {
+			slots[slot] = net.JoinHostPort(ip, strconv.Itoa(port))
+		}
+	}
+	c.mu.Lock()
+	c.slots = slots
+	c.mu.Unlock()
+	return nil
+}
+
+// failover reloads the slots after the node at addr failed, and returns the
+// node now serving slot if another one took it over.
+func (c *redisCluster) failover(slot uint16, addr string) (string, bool) {
+	if c.refresh() != nil {
+		return "", false
+	}
+	c.mu.RLock()
+	next := c.slots[slot]
+	c.mu.RUnlock()
+	return next, next != "" && next != addr
+}
+
+// moved records that slot moved to addr.
+func (c *redisCluster) moved(slot uint16, addr string) {
+	c.mu.Lock()
+	c.slots[slot] = addr
+	c.mu.Unlock()
+}
+
+// redisClusterConn sends the commands on a key to the node serving its slot.
+// Do follows the redirections of the cluster, and reloads the slots when the
+// node fails; pipelined commands go to the node serving the slot when the
+// first one is sent.
+type redisClusterConn struct {
+	cluster *redisCluster
+	slot    uint16
+	node    redis.Conn
+	err     error
+}
+
+func (c *redisClusterConn) Do(command string, args ...interface{}) (interface{}, error) {
+	return c.do(0, command, args...)
+}
+
+// DoWithTimeout is like Do but waits for each reply for timeout at most.
+func (c *redisClusterConn) DoWithTimeout(timeout time.Duration, command string, args ...interface{}) (interface{}, error) {
+	return c.do(timeout, command, args...)
+}
+
+// do runs the command, waiting for each reply for timeout at most, or for
+// the read timeout of the connections if zero.
+func (c *redisClusterConn) do(timeout time.Duration, command string, args ...interface{}) (interface{}, error) {
+	if command == "" {
+		// Flushing the pipeline.
+		if c.node == nil {
+			return nil, nil
+		}
+		return doWithTimeout(c.node, timeout, "")
+	}
+	addr, err := c.cluster.addr(c.slot)
+	if err != nil {
+		return nil, err
+	}
+	asking, failedOver := false, false
+	for i := 0; ; i++ {
+		conn := c.cluster.get(addr)
+		if asking {
+			conn.Send("ASKING")
+		}
+		reply, err := doWithTimeout(conn, timeout, command, args...)
+		broken := err != nil && conn.Err() != nil
+		conn.Close()
+		if broken && !failedOver {
+			// The node may be down, with no node left to send a MOVED:
+			// try once more on the node now serving the slot, if any.
+			next, ok := c.cluster.failover(c.slot, addr)
+			if ok {
+				addr, asking, failedOver = next, false, true
+				continue
+			}
+		}
+		redirect, ok := err.(redis.Error)
+		if !ok || i == redisClusterRedirects {
+			return reply, err
+		}
+		fields := strings.Fields(string(redirect))
+		switch {
+		case len(fields) == 3 && fields[0] == "MOVED":
+			c.cluster.moved(c.slot, fields[2])
+			addr, asking = fields[2], false
+		case len(fields) == 3 && fields[0] == "ASK":
+			addr, asking = fields[2], true
+		default:
+			return reply, err
+		}
+	}
+}
+
+func (c *redisClusterConn) Send(command string, args ...interface{}) error {
+	if c.node == nil {
+		addr, err := c.cluster.addr(c.slot)
+		if err != nil {
+			c.err = err
+			return err
+		}
+		c.node = c.cluster.get(addr)
+		if c.node.Err() != nil {
+			if next, ok := c.cluster.failover(c.slot, addr); ok {
+				c.node.Close()
+				c.node = c.cluster.get(next)
+			}
+		}
+	}
+	return c.node.Send(command, args...)
+}
+
+func (c *redisClusterConn) Flush() error {
+	if c.node == nil {
+		return c.err
+	}
+	return c.node.Flush()
+}
+
+func (c *redisClusterConn) Receive() (interface{}, error) {
+	if c.node == nil {
+		if c.err == nil {
+			return nil, errors.New("cache: nothing sent to the redis cluster")
+		}
+		return nil, c.err
+	}
+	return c.node.Receive()
+}
+
+// ReceiveWithTimeout is like Receive but waits for timeout at most.
+func (c *redisClusterConn) ReceiveWithTimeout(timeout time.Duration) (interface{}, error) {
+	if c.node == nil {
+		return c.Receive()
+	}
+	return redis.ReceiveWithTimeout(c.node, timeout)
+}
+
+func (c *redisClusterConn) Err() error {
+	if c.node == nil {
+		return c.err
+	}
+	return c.node.Err()
+}
+
+func (c *redisClusterConn) Close() error {
+	if c.node == nil {
+		return nil
+	}
+	return c.node.Close()
+}
+
+// doWithTimeout runs the command on conn, waiting for the reply for timeout
+// at most, or for the read timeout of conn if zero.
+func doWithTimeout(conn redis.Conn, timeout time.Duration, command string, args ...interface{}) (interface{}, error) {
+	if timeout == 0 {
+		return conn.Do(command, args...)
+	}
+	return redis.DoWithTimeout(conn, timeout, command, args...)
+}
+
+// keySlot returns the hash slot of key: the CRC16 of its hash tag, the part
+// between the first { and the next }, if not empty, or of the whole key.
+func keySlot(key string) uint16 {
+	if start := strings.IndexByte(key, '{'); start >= 0 {
+		if end := strings.IndexByte(key[start+1:], '}'); end > 0 {
+			key = key[start+1 : start+1+end]
+		}
+	}
+	return crc16(key) % redisClusterSlots
+}
+
+// crc16 is the CRC-16/XMODEM used by redis cluster.
+func crc16(s string) uint16 {
+	var crc uint16
+	for i := 0; i < len(s); i++ {
+		crc ^= uint16(s[i]) << 8
+		for j := 0; j < 8; j++ {
+			if crc&0x8000 != 0 {
+				crc = crc<<1 ^ 0x1021
+			} else {
+				crc <<= 1
+			}
+		}
+	}
+	return crc
+}
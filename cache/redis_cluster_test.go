@@ -0,0 +1,240 @@
+package cache
+
+import (
+	"fmt"
+	"net"
+	"strconv"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/alicebob/miniredis/v2"
+	"github.com/alicebob/miniredis/v2/server"
+)
+
+func TestKeySlot(t *testing.T) {
+	for key, slot := range map[string]uint16{
+		"123456789":            12739,
+		"foo":                  12182,
+		"{user1000}.following": keySlot("user1000"),
+		"{user1000}.followers": keySlot("user1000"),
+		"foo{}{bar}":           keySlot("foo{}{bar}"),
+		"foo{{bar}}zap":        keySlot("{bar"),
+	} {
+		if got := keySlot(key); got != slot {
+			t.Errorf("Expected slot %d for %q, got %d", slot, key, got)
+		}
+	}
+	if keySlot("foo{}{bar}") == keySlot("bar") {
+		t.Errorf("Expected an empty hash tag to be ignored")
+	}
+}
+
+// testCluster is a cluster of three redis nodes sharing the hash slots.
+type testCluster struct {
+	nodes []*miniredis.Miniredis
+
+	mu    sync.Mutex
+	slots []clusterSlots
+}
+
+// clusterSlots is a range of hash slots served by the node at addr.
+type clusterSlots struct {
+	start, end int
+	addr       string
+}
+
+func newTestCluster(t *testing.T) *testCluster {
+	c := &testCluster{}
+	for i := 0; i < 3; i++ {
+		node := newTestRedis(t, nil)
+		setHook(node, c.hook(node.Addr()))
+		c.nodes = append(c.nodes, node)
+	}
+	c.slots = []clusterSlots{
+		{0, 5460, c.nodes[0].Addr()},
+		{5461, 10922, c.nodes[1].Addr()},
+		{10923, 16383, c.nodes[2].Addr()},
+	}
+	return c
+}
+
+func (c *testCluster) Close() {
+	for _, node := range c.nodes {
+		node.Close()
+	}
+}
+
+// hook makes the node at addr answer CLUSTER SLOTS, and redirect the commands
+// on the keys it does not serve.
+func (c *testCluster) hook(addr string) server.Hook {
+	return func(p *server.Peer, cmd string, args ...string) bool {
+		c.mu.Lock()
+		defer c.mu.Unlock()
+		var keys []string
+		switch cmd {
+		case "CLUSTER":
+			p.WriteLen(len(c.slots))
+			for _, r := range c.slots {
+				host, port, _ := net.SplitHostPort(r.addr)
+				n, _ := strconv.Atoi(port)
+				p.WriteLen(3)
+				p.WriteInt(r.start)
+				p.WriteInt(r.end)
+				p.WriteLen(2)
+				p.WriteBulk(host)
+				p.WriteInt(n)
+			}
+			return true
+		case "GET", "SET", "EXISTS", "PTTL", "PEXPIRE", "PERSIST":
+			keys = args[:1]
+		case "DEL", "MGET":
+			keys = args
+		case "EVAL", "EVALSHA":
+			keys = args[2:3]
+		default:
+			return false
+		}
+		for _, key := range keys {
+			if keySlot(key) != keySlot(keys[0]) {
+				p.WriteError("CROSSSLOT Keys in request don't hash to the same slot")
+				return true
+			}
+		}
+		slot := int(keySlot(keys[0]))
+		for _, r := range c.slots {
+			if slot >= r.start && slot <= r.end && r.addr != addr {
+				p.WriteError(fmt.Sprintf("MOVED %d %s", slot, r.addr))
+				return true
+			}
+		}
+		return false
+	}
+}
+
+func TestRedisCache_Cluster(t *testing.T) {
+	cluster := newTestCluster(t)
+	defer cluster.Close()
+	nodes := cluster.nodes
+
+	// Only one node is known, the others are discovered.
+	newStore := func(_ *testing.T, defaultExpiration time.Duration) CacheStore {
+		return NewRedisCacheWithOptions(nodes[1].Addr(), "", defaultExpiration, RedisOptions{Cluster: true})
+	}
+	typicalGetSet(t, newStore)
+	incrDecr(t, newStore)
+	emptyCache(t, newStore)
+	cachePage(t, newStore(t, time.Hour))
+	tagInvalidation(t, newStore(t, time.Hour))
+	store := NewRedisCacheWithOptions(nodes[0].Addr(), "", time.Hour, RedisOptions{Cluster: true, Namespace: "ns"})
+	contextContract(t, store)
+
+	// The keys are spread over the nodes.
+	for i := 0; i < 30; i++ {
+		store.Set(fmt.Sprint(i), i, DEFAULT)
+	}
+	for i, node := range nodes {
+		if n := len(node.Keys()); n < 5 {
+			t.Errorf("Expected keys on node %d, got %d", i, n)
+		}
+	}
+	if err := store.Flush(); err != nil {
+		t.Fatalf("Error flushing: %s", err)
+	}
+	for i := 0; i < 30; i++ {
+		var value int
+		if err := store.Get(fmt.Sprint(i), &value); err != ErrCacheMiss {
+			t.Errorf("Expected ErrCacheMiss for %d after a flush, got %v", i, err)
+		}
+	}
+}
+
+func TestRedisCache_ClusterMoved(t *testing.T) {
+	cluster := newTestCluster(t)
+	defer cluster.Close()
+	nodes := cluster.nodes
+	store := NewRedisCacheWithOptions(nodes[0].Addr(), "", time.Hour, RedisOptions{Cluster: true})
+	if err := store.Set("foo", "bar", DEFAULT); err != nil {
+		t.Fatalf("Error setting a value: %s", err)
+	}
+
+	// The slot of foo moves from node 2 to node 0.
+	slot := int(keySlot("foo"))
+	cluster.mu.Lock()
+	cluster.slots = []clusterSlots{
+		{0, 5460, nodes[0].Addr()},
+		{5461, 10922, nodes[1].Addr()},
+		{10923, slot, nodes[0].Addr()},
+		{slot + 1, 16383, nodes[2].Addr()},
+	}
+	cluster.mu.Unlock()
+	moved, _ := nodes[2].Get("foo")
+	nodes[0].Set("foo", moved)
+
+	var value string
+	if err := store.Get("foo", &value); err != nil || value != "bar" {
+		t.Errorf("Expected bar after a redirection, got %q: %v", value, err)
+	}
+	if addr, _ := store.cluster.addr(keySlot("foo")); addr != nodes[0].Addr() {
+		t.Errorf("Expected the new node of the slot to be remembered, got %s", addr)
+	}
+}
+
+func TestRedisCache_ClusterFailover(t *testing.T) {
+	cluster := newTestCluster(t)
+	defer cluster.Close()
+	nodes := cluster.nodes
+	store := NewRedisCacheWithOptions(nodes[0].Addr(), "", time.Hour, RedisOptions{Cluster: true})
+	if err := store.Set("foo", "bar", DEFAULT); err != nil {
+		t.Fatalf("Error setting a value: %s", err)
+	}
+
+	// Node 2 fails and node 0 takes over its slots, no node sending a MOVED.
+	replica, _ := nodes[2].Get("foo")
+	nodes[0].Set("foo", replica)
+	cluster.mu.Lock()
+	cluster.slots[2].addr = nodes[0].Addr()
+	cluster.mu.Unlock()
+	nodes[2].Close()
+
+	for i := 0; i < 2; i++ {
+		var value string
+		if err := store.Get("foo", &value); err != nil || value != "bar" {
+			t.Errorf("Expected bar after a failover, got %q: %v", value, err)
+		}
+	}
+	if addr, _ := store.cluster.addr(keySlot("foo")); addr != nodes[0].Addr() {
+		t.Errorf("Expected the new node of the slot to be remembered, got %s", addr)
+	}
+}
+
+func TestRedisCache_ClusterSlowNode(t *testing.T) {
+	// A node accepting connections but never answering.
+	slow, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatalf("couldn't listen: %s", err)
+	}
+	defer slow.Close()
+	node := newTestRedis(t, nil)
+	defer node.Close()
+
+	cluster := newRedisCluster(nil, "", RedisOptions{})
+	go cluster.get(slow.Addr().String())
+	time.Sleep(50 * time.Millisecond)
+
+	done := make(chan error, 1)
+	go func() {
+		conn := cluster.get(node.Addr())
+		_, err := conn.Do("PING")
+		conn.Close()
+		done <- err
+	}()
+	select {
+	case err := <-done:
+		if err != nil {
+			t.Errorf("Error pinging the node: %s", err)
+		}
+	case <-time.After(time.Second):
+		t.Errorf("Expected a node dialing slowly not to block the others")
+	}
+}
@@ -1,26 +1,39 @@
 package cache
 
 import (
+	"context"
+	"crypto/tls"
+	"crypto/x509"
+	"io/ioutil"
+	"math"
 	"net"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"strings"
+	"sync"
+	"sync/atomic"
 	"testing"
 	"time"
+
+	"github.com/alicebob/miniredis/v2"
+	"github.com/alicebob/miniredis/v2/server"
+	"github.com/garyburd/redigo/redis"
 )
 
-// These tests require redis server running on localhost:6379 (the default)
-const redisTestServer = "localhost:6379"
+// redisTestServer is shared by the tests of the CacheStore contract, and
+// flushed by each.
+var (
+	redisTestOnce   sync.Once
+	redisTestServer *miniredis.Miniredis
+)
 
 var newRedisStore = func(t *testing.T, defaultExpiration time.Duration) CacheStore {
-	c, err := net.Dial("tcp", redisTestServer)
-	if err == nil {
-		c.Write([]byte("flush_all\r\n"))
-		c.Close()
-		redisCache := NewRedisCache(redisTestServer, "", defaultExpiration)
-		redisCache.Flush()
-		return redisCache
-	}
-	t.Errorf("couldn't connect to redis on %s", redisTestServer)
-	t.FailNow()
-	panic("")
+	redisTestOnce.Do(func() {
+		redisTestServer = newTestRedis(t, nil)
+	})
+	redisTestServer.FlushAll()
+	return NewRedisCache(redisTestServer.Addr(), "", defaultExpiration)
 }
 
 func TestRedisCache_TypicalGetSet(t *testing.T) {
@@ -46,3 +59,303 @@ func TestRedisCache_Replace(t *testing.T) {
 func TestRedisCache_Add(t *testing.T) {
 	testAdd(t, newRedisStore)
 }
+
+// newTestRedis starts an in-memory redis server, which runs Lua scripts like
+// a real one. hook, if not nil, runs before each command and reports whether
+// it answered it, to play the part of a sentinel or of a cluster node.
+func newTestRedis(t *testing.T, hook server.Hook) *miniredis.Miniredis {
+	s := miniredis.NewMiniRedis()
+	if err := s.Start(); err != nil {
+		t.Fatalf("couldn't start redis: %s", err)
+	}
+	setHook(s, hook)
+	return s
+}
+
+// setHook installs hook on s, along with a clock making keys expire in real
+// time. Otherwise miniredis only expires them when told to.
+func setHook(s *miniredis.Miniredis, hook server.Hook) {
+	var mu sync.Mutex
+	last := time.Now()
+	// The commands run by scripts are dispatched with s locked, by peers
+	// created with a context. Clients have none until their first command.
+	clients := make(map[*server.Peer]bool)
+	s.Server().SetPreHook(func(c *server.Peer, cmd string, args ...string) bool {
+		mu.Lock()
+		if c.Ctx == nil && !clients[c] {
+			clients[c] = true
+			c.OnDisconnect(func() {
+				mu.Lock()
+				delete(clients, c)
+				mu.Unlock()
+			})
+		}
+		client := clients[c]
+		now := time.Now()
+		elapsed := now.Sub(last)
+		if client {
+			last = now
+		}
+		mu.Unlock()
+		if client {
+			s.FastForward(elapsed)
+		}
+		return hook != nil && hook(c, cmd, args...)
+	})
+}
+
+// waitSubscribers waits until channel has n subscribers on s.
+func waitSubscribers(t *testing.T, s *miniredis.Miniredis, channel string, n int) {
+	for deadline := time.Now().Add(5 * time.Second); time.Now().Before(deadline); {
+		if s.PubSubNumSub(channel)[channel] == n {
+			return
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+	t.Fatalf("Expected %d subscribers to %s", n, channel)
+}
+
+func TestRedisCache_CachePage(t *testing.T) {
+	server := newTestRedis(t, nil)
+	defer server.Close()
+	cachePage(t, NewRedisCache(server.Addr(), "", time.Hour))
+}
+
+func TestRedisCache_TagInvalidation(t *testing.T) {
+	server := newTestRedis(t, nil)
+	defer server.Close()
+	tagInvalidation(t, NewRedisCache(server.Addr(), "", time.Hour))
+}
+
+func TestRedisCache_NamespaceFlush(t *testing.T) {
+	server := newTestRedis(t, nil)
+	defer server.Close()
+	host := server.Addr()
+	sessions := NewRedisCacheWithOptions(host, "", time.Hour, RedisOptions{Namespace: "sessions"})
+	pages := NewRedisCacheWithOptions(host, "", time.Hour, RedisOptions{Namespace: "pages*"})
+	other := NewRedisCacheWithOptions(host, "", time.Hour, RedisOptions{Database: 2})
+	namespaceFlush(t, sessions, pages, other)
+
+	// Without a namespace, only the selected database is flushed.
+	if err := NewRedisCacheWithOptions(host, "", time.Hour, RedisOptions{Database: 3}).Flush(); err != nil {
+		t.Fatalf("Error flushing a database: %s", err)
+	}
+	var value string
+	if err := other.Get("value", &value); err != nil || value != "database" {
+		t.Errorf("Expected the value of another database to survive a flush, got %q: %v", value, err)
+	}
+}
+
+func TestRedisCache_Concurrency(t *testing.T) {
+	concurrency(t, newRedisStore)
+}
+
+func TestRedisCache_Counter(t *testing.T) {
+	server := newTestRedis(t, nil)
+	defer server.Close()
+	store := NewRedisCache(server.Addr(), "", time.Hour)
+
+	// The script handles the whole range of uint64, which Lua numbers cannot.
+	store.Set("n", uint64(math.MaxUint64-1), DEFAULT)
+	for _, step := range []struct {
+		incr     bool
+		delta    uint64
+		expected uint64
+	}{
+		{true, 1, math.MaxUint64},
+		{true, 3, 2},
+		{false, 3, 0},
+		{true, 12345678901234567890, 12345678901234567890},
+		{false, 2345678901234567890, 10000000000000000000},
+		{false, 1, 9999999999999999999},
+		{true, 8446744073709551617, 0},
+	} {
+		var n uint64
+		var err error
+		if step.incr {
+			n, err = store.Increment("n", step.delta)
+		} else {
+			n, err = store.Decrement("n", step.delta)
+		}
+		if err != nil || n != step.expected {
+			t.Errorf("Expected %d, got %d: %v", step.expected, n, err)
+		}
+	}
+
+	// The expiration is kept.
+	store.Set("ttl", 5, time.Hour)
+	store.Increment("ttl", 1)
+	if ttl := server.TTL("ttl"); ttl <= 0 {
+		t.Errorf("Expected the counter to keep its expiration, got %s", ttl)
+	}
+
+	store.Set("string", "abc", DEFAULT)
+	if _, err := store.Increment("string", 1); err == nil {
+		t.Errorf("Expected an error incrementing a string")
+	}
+}
+
+func TestRedisCache_Context(t *testing.T) {
+	server := newTestRedis(t, nil)
+	defer server.Close()
+	contextContract(t, NewRedisCacheWithOptions(server.Addr(), "", time.Hour, RedisOptions{Namespace: "ctx"}))
+}
+
+func TestRedisCache_ContextDeadline(t *testing.T) {
+	var slow int32
+	server := newTestRedis(t, func(c *server.Peer, cmd string, args ...string) bool {
+		if cmd == "GET" && atomic.LoadInt32(&slow) == 1 {
+			time.Sleep(200 * time.Millisecond)
+		}
+		return false
+	})
+	defer server.Close()
+	store := NewRedisCache(server.Addr(), "", time.Hour)
+	store.Set("string", "stored", DEFAULT)
+
+	atomic.StoreInt32(&slow, 1)
+	ctx, cancel := context.WithTimeout(context.Background(), 20*time.Millisecond)
+	defer cancel()
+	start := time.Now()
+	s := "unchanged"
+	if err := store.GetContext(ctx, "string", &s); err != context.DeadlineExceeded {
+		t.Errorf("Expected context.DeadlineExceeded, got %v", err)
+	}
+	if elapsed := time.Since(start); elapsed > 150*time.Millisecond {
+		t.Errorf("Expected the deadline to interrupt the command, took %s", elapsed)
+	}
+	if s != "unchanged" {
+		t.Errorf("Expected the value to be left alone, got %q", s)
+	}
+
+	// The interrupted connection is not reused.
+	atomic.StoreInt32(&slow, 0)
+	if err := store.Get("string", &s); err != nil || s != "stored" {
+		t.Errorf("Expected stored, got %q: %v", s, err)
+	}
+}
+
+func TestRedisCache_Serializer(t *testing.T) {
+	server := newTestRedis(t, nil)
+	defer server.Close()
+	options := RedisOptions{Serializer: CompressSerializer(JSONSerializer, 64)}
+	store := NewRedisCacheWithOptions(server.Addr(), "", time.Hour, options)
+	cachePage(t, store)
+	contextContract(t, store)
+}
+
+func TestRedisCache_Sentinel(t *testing.T) {
+	master := newTestRedis(t, func(c *server.Peer, cmd string, args ...string) bool {
+		if cmd != "ROLE" {
+			return false
+		}
+		c.WriteLen(3)
+		c.WriteBulk("master")
+		c.WriteInt(0)
+		c.WriteLen(0)
+		return true
+	})
+	defer master.Close()
+	sentinel := newTestRedis(t, func(c *server.Peer, cmd string, args ...string) bool {
+		if cmd != "SENTINEL" {
+			return false
+		}
+		if len(args) != 2 || args[1] != "mymaster" {
+			c.WriteNull()
+			return true
+		}
+		c.WriteLen(2)
+		c.WriteBulk(master.Host())
+		c.WriteBulk(master.Port())
+		return true
+	})
+	defer sentinel.Close()
+
+	// The first sentinel is down.
+	down, _ := net.Listen("tcp", "127.0.0.1:0")
+	down.Close()
+	hosts := down.Addr().String() + "," + sentinel.Addr()
+	store := NewRedisCacheWithOptions(hosts, "", time.Hour, RedisOptions{MasterName: "mymaster"})
+	if err := store.Set("value", "master", DEFAULT); err != nil {
+		t.Fatalf("Error setting a value: %s", err)
+	}
+	var value string
+	if err := NewRedisCache(master.Addr(), "", time.Hour).Get("value", &value); err != nil || value != "master" {
+		t.Errorf("Expected the value on the master, got %q: %v", value, err)
+	}
+
+	unknown := NewRedisCacheWithOptions(sentinel.Addr(), "", time.Hour, RedisOptions{MasterName: "other"})
+	if err := unknown.Set("value", "master", DEFAULT); err == nil || !strings.Contains(err.Error(), "unknown redis master") {
+		t.Errorf("Expected an unknown master, got %v", err)
+	}
+}
+
+func TestRedisCache_TLS(t *testing.T) {
+	server := httptest.NewTLSServer(nil)
+	defer server.Close()
+	secure := miniredis.NewMiniRedis()
+	if err := secure.StartTLS(server.TLS); err != nil {
+		t.Fatalf("couldn't start redis: %s", err)
+	}
+	defer secure.Close()
+
+	cert, err := x509.ParseCertificate(server.TLS.Certificates[0].Certificate[0])
+	if err != nil {
+		t.Fatalf("couldn't parse the certificate: %s", err)
+	}
+	roots := x509.NewCertPool()
+	roots.AddCert(cert)
+	options := RedisOptions{TLSConfig: &tls.Config{RootCAs: roots}, DialTimeout: time.Second}
+	cachePage(t, NewRedisCacheWithOptions(secure.Addr(), "", time.Hour, options))
+
+	// The certificate is checked.
+	options.TLSConfig = &tls.Config{}
+	if err := NewRedisCacheWithOptions(secure.Addr(), "", time.Hour, options).Set("value", 1, DEFAULT); err == nil {
+		t.Errorf("Expected an unknown certificate authority to fail")
+	}
+}
+
+func TestRedisCache_Unix(t *testing.T) {
+	dir, err := ioutil.TempDir("", "redis")
+	if err != nil {
+		t.Fatalf("couldn't create a directory: %s", err)
+	}
+	defer os.RemoveAll(dir)
+	socket := filepath.Join(dir, "redis.sock")
+	l, err := net.Listen("unix", socket)
+	if err != nil {
+		t.Skipf("unix sockets are not supported: %s", err)
+	}
+	defer l.Close()
+	server := newTestRedis(t, nil)
+	defer server.Close()
+	go func() {
+		for {
+			conn, err := l.Accept()
+			if err != nil {
+				return
+			}
+			server.Server().ServeConn(conn)
+		}
+	}()
+	cachePage(t, NewRedisCacheWithOptions(socket, "", time.Hour, RedisOptions{Network: "unix"}))
+}
+
+func TestRedisCache_Pool(t *testing.T) {
+	server := newTestRedis(t, nil)
+	defer server.Close()
+	store := NewRedisCacheWithOptions(server.Addr(), "", time.Hour, RedisOptions{MaxActive: 1, ReadTimeout: time.Second})
+	if store.pool.MaxIdle != 5 || store.pool.MaxActive != 1 || store.pool.IdleTimeout != 240*time.Second {
+		t.Errorf("Unexpected pool settings %+v", store.pool)
+	}
+
+	// The only connection is busy.
+	conn := store.pool.Get()
+	if err := store.Set("value", 1, DEFAULT); err != redis.ErrPoolExhausted {
+		t.Errorf("Expected redis.ErrPoolExhausted, got %v", err)
+	}
+	conn.Close()
+	if err := store.Set("value", 1, DEFAULT); err != nil {
+		t.Errorf("Error setting a value: %s", err)
+	}
+}
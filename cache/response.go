@@ -0,0 +1,268 @@
+package cache
+
+import (
+	"bytes"
+	"encoding/binary"
+	"encoding/json"
+	"errors"
+	"net/http"
+	"sort"
+	"time"
+
+	"github.com/vmihailenco/msgpack"
+)
+
+// responseCacheVersion is the first byte of every encoded responseCache.
+// Bump it whenever the layout below changes so that entries written by an
+// older release are treated as misses instead of being misread.
+const responseCacheVersion byte = 6
+
+var errBadResponseCache = errors.New("cache: malformed cached response.")
+
+type responseCache struct {
+	status int
+	header http.Header
+	data   []byte
+	date   time.Time
+
+	// gzip is the body compressed with gzip, if worth it and enabled.
+	gzip []byte
+
+	// expires is when the response stops being fresh; zero means never.
+	expires time.Time
+
+	etag         string
+	lastModified time.Time
+
+	// tags maps the tags of the response to their version when it was stored.
+	tags map[string]uint64
+}
+
+// MarshalBinary encodes the response as
+//
+//	version | status | date | expires | etag | last modified |
+//	tag count | (tag | tag version)... |
+//	header count | (key | value count | values...)... | body | gzip body
+//
+// where date, expires and last modified are varint Unix times in nanoseconds (0 if
+// unknown), other numbers are uvarints, and strings and the body are prefixed
+// with their uvarint length. Header keys are written in sorted order so that equal
+// responses always encode to the same bytes.
+func (r responseCache) MarshalBinary() ([]byte, error) {
+	var b bytes.Buffer
+	b.WriteByte(responseCacheVersion)
+	putUvarint(&b, uint64(r.status))
+	putTime(&b, r.date)
+	putTime(&b, r.expires)
+	putBytes(&b, []byte(r.etag))
+	putTime(&b, r.lastModified)
+
+	tags := make([]string, 0, len(r.tags))
+	for tag := range r.tags {
+		tags = append(tags, tag)
+	}
+	sort.Strings(tags)
+	putUvarint(&b, uint64(len(tags)))
+	for _, tag := range tags {
+		putBytes(&b, []byte(tag))
+		putUvarint(&b, r.tags[tag])
+	}
+
+	keys := make([]string, 0, len(r.header))
+	for k := range r.header {
+		keys = append(keys, k)
+	}
+	sort.Strings(keys)
+	putUvarint(&b, uint64(len(keys)))
+	for _, k := range keys {
+		putBytes(&b, []byte(k))
+		vals := r.header[k]
+		putUvarint(&b, uint64(len(vals)))
+		for _, v := range vals {
+			putBytes(&b, []byte(v))
+		}
+	}
+
+	putBytes(&b, r.data)
+	putBytes(&b, r.gzip)
+	return b.Bytes(), nil
+}
+
+// UnmarshalBinary decodes a response encoded by MarshalBinary.
+func (r *responseCache) UnmarshalBinary(data []byte) error {
+	b := bytes.NewReader(data)
+	version, err := b.ReadByte()
+	if err != nil || version != responseCacheVersion {
+		return errBadResponseCache
+	}
+
+	status, err := binary.ReadUvarint(b)
+	if err != nil {
+		return errBadResponseCache
+	}
+	date, err := readTime(b)
+	if err != nil {
+		return err
+	}
+	expires, err := readTime(b)
+	if err != nil {
+		return err
+	}
+	etag, err := readBytes(b)
+	if err != nil {
+		return err
+	}
+	lastModified, err := readTime(b)
+	if err != nil {
+		return err
+	}
+	ntags, err := binary.ReadUvarint(b)
+	if err != nil {
+		return errBadResponseCache
+	}
+	var tags map[string]uint64
+	if ntags > 0 {
+		tags = make(map[string]uint64)
+	}
+	for i := uint64(0); i < ntags; i++ {
+		tag, err := readBytes(b)
+		if err != nil {
+			return err
+		}
+		if tags[string(tag)], err = binary.ReadUvarint(b); err != nil {
+			return errBadResponseCache
+		}
+	}
+	nkeys, err := binary.ReadUvarint(b)
+	if err != nil {
+		return errBadResponseCache
+	}
+	header := make(http.Header)
+	for i := uint64(0); i < nkeys; i++ {
+		k, err := readBytes(b)
+		if err != nil {
+			return err
+		}
+		nvals, err := binary.ReadUvarint(b)
+		if err != nil {
+			return errBadResponseCache
+		}
+		for j := uint64(0); j < nvals; j++ {
+			v, err := readBytes(b)
+			if err != nil {
+				return err
+			}
+			header[string(k)] = append(header[string(k)], string(v))
+		}
+	}
+	body, err := readBytes(b)
+	if err != nil {
+		return err
+	}
+	gz, err := readBytes(b)
+	if err != nil {
+		return err
+	}
+	if len(gz) == 0 {
+		gz = nil
+	}
+	if b.Len() != 0 {
+		return errBadResponseCache
+	}
+
+	r.status = int(status)
+	r.header = header
+	r.data = body
+	r.gzip = gz
+	r.date = date
+	r.expires = expires
+	r.etag = string(etag)
+	r.lastModified = lastModified
+	r.tags = tags
+	return nil
+}
+
+// MarshalJSON and MarshalMsgpack wrap the binary encoding of the response,
+// so that pages can be cached whatever the Serializer of the store.
+func (r responseCache) MarshalJSON() ([]byte, error) {
+	b, err := r.MarshalBinary()
+	if err != nil {
+		return nil, err
+	}
+	return json.Marshal(b)
+}
+
+func (r *responseCache) UnmarshalJSON(data []byte) error {
+	var b []byte
+	if err := json.Unmarshal(data, &b); err != nil {
+		return err
+	}
+	return r.UnmarshalBinary(b)
+}
+
+func (r responseCache) MarshalMsgpack() ([]byte, error) {
+	b, err := r.MarshalBinary()
+	if err != nil {
+		return nil, err
+	}
+	return msgpack.Marshal(b)
+}
+
+func (r *responseCache) UnmarshalMsgpack(data []byte) error {
+	var b []byte
+	if err := msgpack.Unmarshal(data, &b); err != nil {
+		return err
+	}
+	return r.UnmarshalBinary(b)
+}
+
+// fresh reports whether the response may be served without revalidation.
+func (r responseCache) fresh(now time.Time) bool {
+	return r.expires.IsZero() || now.Before(r.expires)
+}
+
+func putUvarint(b *bytes.Buffer, x uint64) {
+	var buf [binary.MaxVarintLen64]byte
+	n := binary.PutUvarint(buf[:], x)
+	b.Write(buf[:n])
+}
+
+func putVarint(b *bytes.Buffer, x int64) {
+	var buf [binary.MaxVarintLen64]byte
+	n := binary.PutVarint(buf[:], x)
+	b.Write(buf[:n])
+}
+
+func putTime(b *bytes.Buffer, t time.Time) {
+	var nsec int64
+	if !t.IsZero() {
+		nsec = t.UnixNano()
+	}
+	putVarint(b, nsec)
+}
+
+func readTime(b *bytes.Reader) (time.Time, error) {
+	nsec, err := binary.ReadVarint(b)
+	if err != nil {
+		return time.Time{}, errBadResponseCache
+	}
+	if nsec == 0 {
+		return time.Time{}, nil
+	}
+	return time.Unix(0, nsec), nil
+}
+
+func putBytes(b *bytes.Buffer, p []byte) {
+	putUvarint(b, uint64(len(p)))
+	b.Write(p)
+}
+
+func readBytes(b *bytes.Reader) ([]byte, error) {
+	n, err := binary.ReadUvarint(b)
+	if err != nil || n > uint64(b.Len()) {
+		return nil, errBadResponseCache
+	}
+	p := make([]byte, n)
+	b.Read(p)
+	return p, nil
+}
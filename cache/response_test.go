@@ -0,0 +1,56 @@
+package cache
+
+import (
+	"net/http"
+	"reflect"
+	"testing"
+	"time"
+)
+
+func TestResponseCache_RoundTrip(t *testing.T) {
+	in := responseCache{
+		status: http.StatusNotFound,
+		header: http.Header{
+			"Content-Type": {"text/html"},
+			"X-Multi":      {"a", "b"},
+		},
+		data: []byte("<h1>not found</h1>"),
+		gzip: gzipped("<h1>not found</h1>"),
+		date: time.Unix(0, 1136214245000000000),
+
+		expires: time.Unix(1136217845, 0),
+
+		etag:         `"abc"`,
+		lastModified: time.Unix(1136214245, 0),
+
+		tags: map[string]uint64{"product:42": 7, "path:/": 1},
+	}
+
+	// Through the serializers used by RedisStore and MemcachedStore.
+	for _, s := range []Serializer{nil, GobSerializer, JSONSerializer, MsgpackSerializer} {
+		b, err := serialize(s, in)
+		if err != nil {
+			t.Fatalf("Error serializing with %T: %s", s, err)
+		}
+		var out responseCache
+		if err = deserialize(s, b, &out); err != nil {
+			t.Fatalf("Error deserializing with %T: %s", s, err)
+		}
+		if !reflect.DeepEqual(in, out) {
+			t.Errorf("Expected %+v with %T, got %+v", in, s, out)
+		}
+	}
+}
+
+func TestResponseCache_BadVersion(t *testing.T) {
+	b, _ := responseCache{status: http.StatusOK}.MarshalBinary()
+	b[0] = responseCacheVersion + 1
+
+	var out responseCache
+	if err := out.UnmarshalBinary(b); err != errBadResponseCache {
+		t.Errorf("Expected errBadResponseCache for an unknown version, got: %v", err)
+	}
+	if err := out.UnmarshalBinary(b[:0]); err != errBadResponseCache {
+		t.Errorf("Expected errBadResponseCache for empty data, got: %v", err)
+	}
+}
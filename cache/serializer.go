@@ -2,12 +2,110 @@ package cache
 
 import (
 	"bytes"
+	"compress/gzip"
 	"encoding/gob"
+	"encoding/json"
+	"errors"
+	"io/ioutil"
 	"reflect"
 	"strconv"
+
+	"github.com/vmihailenco/msgpack"
+)
+
+// Serializer converts the values stored by the remote stores to bytes and
+// back.
+//
+// Integers and byte slices are always stored as is, whatever the serializer,
+// so that counters keep working and raw values can be shared with other
+// programs. Other values are prefixed by a header byte naming their format,
+// which lets a store read the values written with another built-in
+// serializer, or without compression, while switching from one to another.
+type Serializer interface {
+	Marshal(value interface{}) ([]byte, error)
+	Unmarshal(data []byte, ptr interface{}) error
+}
+
+var (
+	// GobSerializer encodes values with encoding/gob. Types stored in
+	// interfaces must be registered with gob.Register.
+	GobSerializer Serializer = gobSerializer{}
+
+	// JSONSerializer encodes values with encoding/json, which other
+	// languages can read. Only exported fields are stored.
+	JSONSerializer Serializer = jsonSerializer{}
+
+	// MsgpackSerializer encodes values with MessagePack, which is more
+	// compact than JSON and also readable by other languages.
+	MsgpackSerializer Serializer = msgpackSerializer{}
 )
 
-func serialize(value interface{}) ([]byte, error) {
+// Formats of the header byte. The high nibble is the version of the header,
+// chosen so that it never starts a gob stream written without a header by
+// earlier releases. The low nibble holds the format and the compression flag.
+const (
+	headerVersion     byte = 0xa0
+	headerVersionMask      = 0xf0
+	headerFormatMask       = 0x07
+	headerCompressed       = 0x08
+
+	formatCustom  byte = 0
+	formatGob     byte = 1
+	formatJSON    byte = 2
+	formatMsgpack byte = 3
+)
+
+var errUnknownFormat = errors.New("cache: value stored in an unknown format.")
+
+type gobSerializer struct{}
+
+func (gobSerializer) Marshal(value interface{}) ([]byte, error) {
+	var b bytes.Buffer
+	if err := gob.NewEncoder(&b).Encode(value); err != nil {
+		return nil, err
+	}
+	return b.Bytes(), nil
+}
+
+func (gobSerializer) Unmarshal(data []byte, ptr interface{}) error {
+	return gob.NewDecoder(bytes.NewReader(data)).Decode(ptr)
+}
+
+type jsonSerializer struct{}
+
+func (jsonSerializer) Marshal(value interface{}) ([]byte, error) {
+	return json.Marshal(value)
+}
+
+func (jsonSerializer) Unmarshal(data []byte, ptr interface{}) error {
+	return json.Unmarshal(data, ptr)
+}
+
+type msgpackSerializer struct{}
+
+func (msgpackSerializer) Marshal(value interface{}) ([]byte, error) {
+	return msgpack.Marshal(value)
+}
+
+func (msgpackSerializer) Unmarshal(data []byte, ptr interface{}) error {
+	return msgpack.Unmarshal(data, ptr)
+}
+
+// CompressSerializer returns a Serializer compressing with gzip the values
+// encoded by s that are at least threshold bytes long. Compressed values can
+// be read whether or not the store compresses.
+func CompressSerializer(s Serializer, threshold int) Serializer {
+	return compressSerializer{s, threshold}
+}
+
+type compressSerializer struct {
+	Serializer
+	threshold int
+}
+
+// serialize encodes value with s, or as a headerless gob like earlier
+// releases if s is nil.
+func serialize(s Serializer, value interface{}) ([]byte, error) {
 	if bytes, ok := value.([]byte); ok {
 		return bytes, nil
 	}
@@ -19,15 +117,28 @@ func serialize(value interface{}) ([]byte, error) {
 		return []byte(strconv.FormatUint(v.Uint(), 10)), nil
 	}
 
-	var b bytes.Buffer
-	encoder := gob.NewEncoder(&b)
-	if err := encoder.Encode(value); err != nil {
+	if s == nil {
+		return gobSerializer{}.Marshal(value)
+	}
+	threshold := -1
+	if c, ok := s.(compressSerializer); ok {
+		s, threshold = c.Serializer, c.threshold
+	}
+	data, err := s.Marshal(value)
+	if err != nil {
 		return nil, err
 	}
-	return b.Bytes(), nil
+	header := headerVersion | serializerFormat(s)
+	if threshold >= 0 && len(data) >= threshold {
+		if data, err = compress(data); err != nil {
+			return nil, err
+		}
+		header |= headerCompressed
+	}
+	return append([]byte{header}, data...), nil
 }
 
-func deserialize(byt []byte, ptr interface{}) (err error) {
+func deserialize(s Serializer, byt []byte, ptr interface{}) (err error) {
 	if bytes, ok := ptr.(*[]byte); ok {
 		*bytes = byt
 		return nil
@@ -57,10 +168,65 @@ func deserialize(byt []byte, ptr interface{}) (err error) {
 		}
 	}
 
-	b := bytes.NewBuffer(byt)
-	decoder := gob.NewDecoder(b)
-	if err = decoder.Decode(ptr); err != nil {
-		return err
+	if len(byt) == 0 || byt[0]&headerVersionMask != headerVersion {
+		// Written without a header by an earlier release.
+		return gobSerializer{}.Unmarshal(byt, ptr)
+	}
+	header, data := byt[0], byt[1:]
+	if header&headerCompressed != 0 {
+		if data, err = decompress(data); err != nil {
+			return err
+		}
+	}
+	switch header & headerFormatMask {
+	case formatGob:
+		s = GobSerializer
+	case formatJSON:
+		s = JSONSerializer
+	case formatMsgpack:
+		s = MsgpackSerializer
+	case formatCustom:
+		if c, ok := s.(compressSerializer); ok {
+			s = c.Serializer
+		}
+		if s == nil || serializerFormat(s) != formatCustom {
+			return errUnknownFormat
+		}
+	default:
+		return errUnknownFormat
+	}
+	return s.Unmarshal(data, ptr)
+}
+
+func serializerFormat(s Serializer) byte {
+	switch s.(type) {
+	case gobSerializer:
+		return formatGob
+	case jsonSerializer:
+		return formatJSON
+	case msgpackSerializer:
+		return formatMsgpack
+	}
+	return formatCustom
+}
+
+func compress(data []byte) ([]byte, error) {
+	var b bytes.Buffer
+	w := gzip.NewWriter(&b)
+	if _, err := w.Write(data); err != nil {
+		return nil, err
+	}
+	if err := w.Close(); err != nil {
+		return nil, err
+	}
+	return b.Bytes(), nil
+}
+
+func decompress(data []byte) ([]byte, error) {
+	r, err := gzip.NewReader(bytes.NewReader(data))
+	if err != nil {
+		return nil, err
 	}
-	return nil
+	defer r.Close()
+	return ioutil.ReadAll(r)
 }
@@ -0,0 +1,98 @@
+package cache
+
+import (
+	"bytes"
+	"encoding/json"
+	"strings"
+	"testing"
+)
+
+type serializedValue struct {
+	Name  string
+	Count int
+}
+
+func TestSerializer_RoundTrip(t *testing.T) {
+	in := serializedValue{"foo", 3}
+	for _, s := range []Serializer{
+		nil, GobSerializer, JSONSerializer, MsgpackSerializer,
+		CompressSerializer(JSONSerializer, 0), parenSerializer{},
+	} {
+		b, err := serialize(s, in)
+		if err != nil {
+			t.Fatalf("Error serializing with %T: %s", s, err)
+		}
+		var out serializedValue
+		if err = deserialize(s, b, &out); err != nil {
+			t.Fatalf("Error deserializing with %T: %s", s, err)
+		}
+		if out != in {
+			t.Errorf("Expected %v with %T, got %v", in, s, out)
+		}
+	}
+}
+
+func TestSerializer_Raw(t *testing.T) {
+	for _, s := range []Serializer{nil, JSONSerializer, CompressSerializer(MsgpackSerializer, 0)} {
+		if b, _ := serialize(s, 42); string(b) != "42" {
+			t.Errorf("Expected integers to be stored as is with %T, got %q", s, b)
+		}
+		if b, _ := serialize(s, []byte("raw")); string(b) != "raw" {
+			t.Errorf("Expected byte slices to be stored as is with %T, got %q", s, b)
+		}
+	}
+}
+
+func TestSerializer_Header(t *testing.T) {
+	b, _ := serialize(JSONSerializer, serializedValue{"foo", 3})
+	if b[0] != headerVersion|formatJSON || string(b[1:]) != `{"Name":"foo","Count":3}` {
+		t.Errorf("Expected a JSON header followed by JSON, got %q", b)
+	}
+
+	// Compressed above the threshold only.
+	small, _ := serialize(CompressSerializer(JSONSerializer, 1000), serializedValue{"foo", 3})
+	if !bytes.Equal(small, b) {
+		t.Errorf("Expected a small value not to be compressed, got %q", small)
+	}
+	large := serializedValue{strings.Repeat("foo", 1000), 3}
+	b, _ = serialize(CompressSerializer(JSONSerializer, 1000), large)
+	if b[0] != headerVersion|formatJSON|headerCompressed || len(b) > 1000 {
+		t.Errorf("Expected a large value to be compressed, got %d bytes with header %x", len(b), b[0])
+	}
+}
+
+func TestSerializer_Migration(t *testing.T) {
+	in := serializedValue{"foo", 3}
+	legacy, _ := serialize(nil, in)
+	compressed, _ := serialize(CompressSerializer(GobSerializer, 0), in)
+	msgpack, _ := serialize(MsgpackSerializer, in)
+
+	// A store switching to JSON keeps reading what it wrote before.
+	for _, b := range [][]byte{legacy, compressed, msgpack} {
+		var out serializedValue
+		if err := deserialize(JSONSerializer, b, &out); err != nil || out != in {
+			t.Errorf("Expected %v from %q, got %v: %v", in, b, out, err)
+		}
+	}
+
+	custom, _ := serialize(parenSerializer{}, in)
+	var out serializedValue
+	if err := deserialize(JSONSerializer, custom, &out); err != errUnknownFormat {
+		t.Errorf("Expected errUnknownFormat reading a custom format, got %v", err)
+	}
+	if err := deserialize(nil, []byte{headerVersion | headerFormatMask}, &out); err != errUnknownFormat {
+		t.Errorf("Expected errUnknownFormat reading a future format, got %v", err)
+	}
+}
+
+// parenSerializer is a custom Serializer storing JSON within parentheses.
+type parenSerializer struct{}
+
+func (parenSerializer) Marshal(value interface{}) ([]byte, error) {
+	b, err := json.Marshal(value)
+	return []byte("(" + string(b) + ")"), err
+}
+
+func (parenSerializer) Unmarshal(data []byte, ptr interface{}) error {
+	return json.Unmarshal(bytes.Trim(data, "()"), ptr)
+}
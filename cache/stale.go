@@ -0,0 +1,90 @@
+package cache
+
+import (
+	"context"
+	"fmt"
+	"net/http"
+	"time"
+
+	"github.com/gin-gonic/gin"
+)
+
+// staleGrace is how long entries are kept in the store after they expire.
+func (o Options) staleGrace() time.Duration {
+	if o.StaleWhileRevalidate > o.StaleIfError {
+		return o.StaleWhileRevalidate
+	}
+	return o.StaleIfError
+}
+
+// revalidate refreshes the entry in the background, unless a refresh of the
+// same key is already running.
+func (p *pageCache) revalidate(c *gin.Context, key string) {
+	p.mu.Lock()
+	if p.refreshing[key] {
+		p.mu.Unlock()
+		return
+	}
+	p.refreshing[key] = true
+	p.mu.Unlock()
+
+	cp := c.Copy()
+	// The client request is done long before the refresh, don't let its
+	// cancellation abort the handler.
+	cp.Request = c.Request.WithContext(context.Background())
+	writer := p.newWriter(c, newResponseRecorder(), key)
+	cp.Writer = writer
+
+	go func() {
+		defer func() {
+			p.mu.Lock()
+			delete(p.refreshing, key)
+			p.mu.Unlock()
+		}()
+		tags := p.options.snapshotTags(cp, p.store)
+		// The stale entry was served, a panic only fails the refresh.
+		if ok := p.callHandler(cp, key, true); ok && writer.Status() < http.StatusInternalServerError {
+			_, _, err := writer.commit(tags)
+			p.options.logError(cp, key, err)
+		}
+	}()
+}
+
+// missOrStale runs the handler like miss does, but answers with the stale
+// entry if the handler panics or fails with a 5xx status. The response is
+// buffered until the handler returns.
+func (p *pageCache) missOrStale(c *gin.Context, key string, stale responseCache) {
+	recorder := newResponseRecorder()
+	writer := p.newWriter(c, recorder, key)
+	w := c.Writer
+	c.Writer = writer
+	c.Header("X-Cache", "MISS")
+	tags := p.options.snapshotTags(c, p.store)
+	ok := p.callHandler(c, key, true)
+	c.Writer = w
+
+	if !ok || recorder.Status() >= http.StatusInternalServerError {
+		replay(c, stale, "STALE")
+		return
+	}
+	_, _, err := writer.commit(tags)
+	p.options.logError(c, key, err)
+	recorder.writeTo(w)
+}
+
+// callHandler runs the handler, reporting false if it panicked. The panic is
+// reported to the Logger, and goes on unless stale is set, telling that a
+// stale entry can be served instead.
+func (p *pageCache) callHandler(c *gin.Context, key string, stale bool) (ok bool) {
+	defer func() {
+		if r := recover(); r != nil {
+			p.options.logError(c, key, fmt.Errorf("cache: handler panicked: %v", r))
+			if !stale {
+				panic(r)
+			}
+			ok = false
+		}
+	}()
+	p.handle(c)
+	return true
+}
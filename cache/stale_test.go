@@ -0,0 +1,136 @@
+package cache
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/gin-gonic/gin"
+)
+
+// storeExpired puts a page that expired a second ago in the store.
+func storeExpired(store CacheStore, path string, body string) {
+	store.Set(urlEscape(PageCachePrefix, path), responseCache{
+		status:  http.StatusOK,
+		header:  http.Header{},
+		data:    []byte(body),
+		date:    time.Now().Add(-time.Minute),
+		expires: time.Now().Add(-time.Second),
+	}, time.Hour)
+}
+
+func TestCachePage_StaleWhileRevalidate(t *testing.T) {
+	store := NewInMemoryStore(time.Hour)
+	storeExpired(store, "/page", "stale")
+
+	var mu sync.Mutex
+	calls := 0
+	release := make(chan struct{})
+	router := gin.New()
+	options := Options{StaleWhileRevalidate: time.Minute}
+	router.GET("/page", CachePageWithOptions(store, time.Minute, options, func(c *gin.Context) {
+		mu.Lock()
+		calls++
+		mu.Unlock()
+		<-release
+		c.String(http.StatusOK, "fresh")
+	}))
+
+	for i := 0; i < 3; i++ {
+		w := performRequest(router, "GET", "/page")
+		if w.Body.String() != "stale" || w.Header().Get("X-Cache") != "STALE" {
+			t.Errorf("Request %d: expected the stale page, got %q (%s)", i, w.Body.String(), w.Header().Get("X-Cache"))
+		}
+	}
+	close(release)
+
+	deadline := time.Now().Add(time.Second)
+	var cache responseCache
+	for {
+		err := store.Get(urlEscape(PageCachePrefix, "/page"), &cache)
+		if err == nil && string(cache.data) == "fresh" {
+			break
+		}
+		if time.Now().After(deadline) {
+			t.Fatalf("The page was not refreshed in the background")
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+	if w := performRequest(router, "GET", "/page"); w.Body.String() != "fresh" || w.Header().Get("X-Cache") != "HIT" {
+		t.Errorf("Expected the refreshed page, got %q (%s)", w.Body.String(), w.Header().Get("X-Cache"))
+	}
+	mu.Lock()
+	defer mu.Unlock()
+	if calls != 1 {
+		t.Errorf("Expected a single background refresh, handler ran %d times", calls)
+	}
+}
+
+func TestCachePage_StaleIfError(t *testing.T) {
+	store := NewInMemoryStore(time.Hour)
+	router := gin.New()
+	var logged []error
+	options := Options{StaleIfError: time.Minute, Logger: func(c *gin.Context, key string, err error) {
+		logged = append(logged, err)
+	}}
+	router.GET("/page", CachePageWithOptions(store, time.Minute, options, func(c *gin.Context) {
+		switch c.Query("fail") {
+		case "status":
+			c.String(http.StatusServiceUnavailable, "unavailable")
+		case "panic":
+			panic("boom")
+		default:
+			c.String(http.StatusOK, "fresh")
+		}
+	}))
+
+	for _, target := range []string{"/page?fail=status", "/page?fail=panic"} {
+		storeExpired(store, target, "stale")
+		w := performRequest(router, "GET", target)
+		if w.Code != http.StatusOK || w.Body.String() != "stale" || w.Header().Get("X-Cache") != "STALE" {
+			t.Errorf("%s: expected the stale page, got %d %q", target, w.Code, w.Body.String())
+		}
+	}
+	if len(logged) != 1 || !strings.Contains(logged[0].Error(), "boom") {
+		t.Errorf("Expected the panic to be logged, got %v", logged)
+	}
+
+	storeExpired(store, "/page", "stale")
+	w := performRequest(router, "GET", "/page")
+	if w.Body.String() != "fresh" || w.Header().Get("X-Cache") != "MISS" {
+		t.Errorf("Expected the handler's response, got %q (%s)", w.Body.String(), w.Header().Get("X-Cache"))
+	}
+	if w = performRequest(router, "GET", "/page"); w.Body.String() != "fresh" || w.Header().Get("X-Cache") != "HIT" {
+		t.Errorf("Expected the new response to be cached, got %q (%s)", w.Body.String(), w.Header().Get("X-Cache"))
+	}
+}
+
+func TestCallHandler_Panic(t *testing.T) {
+	p := &pageCache{handle: func(c *gin.Context) { panic("boom") }}
+	c, _ := gin.CreateTestContext(httptest.NewRecorder())
+	if p.callHandler(c, "key", true) {
+		t.Errorf("Expected a panic to be reported")
+	}
+	defer func() {
+		if r := recover(); r != "boom" {
+			t.Errorf("Expected the panic to go on without a stale entry, got %v", r)
+		}
+	}()
+	p.callHandler(c, "key", false)
+}
+
+func TestCachePage_StaleExpired(t *testing.T) {
+	store := NewInMemoryStore(time.Hour)
+	storeExpired(store, "/page", "stale")
+	router := gin.New()
+	router.GET("/page", CachePage(store, time.Minute, func(c *gin.Context) {
+		c.String(http.StatusOK, "fresh")
+	}))
+
+	if w := performRequest(router, "GET", "/page"); w.Body.String() != "fresh" {
+		t.Errorf("Expected expired pages not to be served without stale options, got %q", w.Body.String())
+	}
+}
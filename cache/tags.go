@@ -0,0 +1,182 @@
+package cache
+
+import (
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/gin-gonic/gin"
+)
+
+const tagsContextKey = "gincontrib.cache.tags"
+
+// Tag attaches tags, e.g. "product:42", to the page being rendered by the
+// handler of CachePage, so that it can later be evicted with InvalidateTags.
+// The page is only valid for the versions of the tags current when Tag is
+// called, so call it before reading the data the page is made of. It does
+// nothing outside of CachePage.
+func Tag(c *gin.Context, tags ...string) {
+	if v, ok := c.Get(tagsContextKey); ok && len(tags) > 0 {
+		v.(*tagSnapshot).add(tags)
+	}
+}
+
+// InvalidateTags evicts the pages cached with any of the given tags.
+//
+// Every tag has a version number kept in the store, and pages remember the
+// versions of their tags when they are stored. Invalidating a tag bumps its
+// version, making the pages holding the previous one misses. This works with
+// any CacheStore, whether it can list its keys or not.
+func InvalidateTags(store CacheStore, tags ...string) error {
+	for _, tag := range tags {
+		key := tagKey(tag)
+		if _, err := store.Increment(key, 1); err == ErrCacheMiss {
+			err = store.Set(key, newTagVersion(), FOREVER)
+			if err != nil {
+				return err
+			}
+		} else if err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// InvalidatePrefix evicts the pages whose path is prefix or lies below it,
+// e.g. "/products" matches "/products" and "/products/42" but not
+// "/productsearch". Only pages cached with Options.InvalidateByPrefix set are
+// affected.
+func InvalidatePrefix(store CacheStore, prefix string) error {
+	return InvalidateTags(store, pathTag(prefix))
+}
+
+// tagSnapshot holds the versions of the tags of the page being rendered,
+// read as soon as the tags are known so that the invalidations made while
+// the handler runs are not lost.
+type tagSnapshot struct {
+	store CacheStore
+
+	mu       sync.Mutex
+	versions map[string]uint64
+	err      error
+}
+
+// snapshotTags starts recording the tags of the page rendered for c. It must
+// be called before running the handler, and reads the versions of the tags
+// known already.
+func (o Options) snapshotTags(c *gin.Context, store CacheStore) *tagSnapshot {
+	s := &tagSnapshot{store: store, versions: make(map[string]uint64)}
+	c.Set(tagsContextKey, s)
+	if o.InvalidateByPrefix {
+		s.add(pathTags(c.Request.URL.Path))
+	}
+	return s
+}
+
+// add reads the versions of the tags not seen yet.
+func (s *tagSnapshot) add(tags []string) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	var missing []string
+	for _, tag := range tags {
+		if _, ok := s.versions[tag]; !ok && !containsString(missing, tag) {
+			missing = append(missing, tag)
+		}
+	}
+	versions, err := tagVersions(s.store, missing)
+	if err != nil {
+		if s.err == nil {
+			s.err = err
+		}
+		return
+	}
+	for tag, version := range versions {
+		s.versions[tag] = version
+	}
+}
+
+// get returns the versions of the tags, nil if there are none, or the first
+// error met reading them.
+func (s *tagSnapshot) get() (map[string]uint64, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if s.err != nil || len(s.versions) == 0 {
+		return nil, s.err
+	}
+	versions := make(map[string]uint64, len(s.versions))
+	for tag, version := range s.versions {
+		versions[tag] = version
+	}
+	return versions, nil
+}
+
+// tagVersions returns the current version of the tags, creating the missing
+// ones.
+func tagVersions(store CacheStore, tags []string) (map[string]uint64, error) {
+	versions := make(map[string]uint64, len(tags))
+	for _, tag := range tags {
+		var version uint64
+		err := store.Get(tagKey(tag), &version)
+		if err == ErrCacheMiss {
+			version = newTagVersion()
+			if err = store.Add(tagKey(tag), version, FOREVER); err == ErrNotStored {
+				// Created concurrently.
+				err = store.Get(tagKey(tag), &version)
+			}
+		}
+		if err != nil {
+			return nil, err
+		}
+		versions[tag] = version
+	}
+	return versions, nil
+}
+
+// valid reports whether none of the tags of the response were invalidated
+// since it was stored.
+func (r responseCache) valid(store CacheStore) bool {
+	for tag, stored := range r.tags {
+		var version uint64
+		if err := store.Get(tagKey(tag), &version); err != nil || version != stored {
+			return false
+		}
+	}
+	return true
+}
+
+// newTagVersion starts tag versions from the current time rather than zero,
+// so that a version evicted from the store is not recreated with a value
+// pages may still hold.
+func newTagVersion() uint64 {
+	return uint64(time.Now().UnixNano())
+}
+
+func tagKey(tag string) string {
+	return urlEscape(PageCachePrefix+".tag", tag)
+}
+
+// isTagKey reports whether key holds the version of a tag.
+func isTagKey(key string) bool {
+	return strings.HasPrefix(key, PageCachePrefix+".tag:")
+}
+
+func pathTag(path string) string {
+	if path != "/" {
+		path = strings.TrimSuffix(path, "/")
+	}
+	return "path:" + path
+}
+
+// pathTags returns the tags of path and of each of its parents.
+func pathTags(path string) []string {
+	tags := []string{pathTag("/")}
+	for i := 1; i < len(path); i++ {
+		if path[i] == '/' {
+			tags = append(tags, pathTag(path[:i]))
+		}
+	}
+	if path != "/" && !strings.HasSuffix(path, "/") {
+		tags = append(tags, pathTag(path))
+	}
+	return tags
+}
@@ -0,0 +1,111 @@
+package cache
+
+import (
+	"net/http"
+	"reflect"
+	"testing"
+	"time"
+
+	"github.com/gin-gonic/gin"
+)
+
+func TestPathTags(t *testing.T) {
+	cases := map[string][]string{
+		"/":                 {"path:/"},
+		"/products":         {"path:/", "path:/products"},
+		"/products/":        {"path:/", "path:/products"},
+		"/products/42/info": {"path:/", "path:/products", "path:/products/42", "path:/products/42/info"},
+	}
+	for path, expected := range cases {
+		if tags := pathTags(path); !reflect.DeepEqual(tags, expected) {
+			t.Errorf("%s: expected %v, got %v", path, expected, tags)
+		}
+	}
+	if tag := pathTag("/products/"); tag != "path:/products" {
+		t.Errorf("Expected trailing slashes to be ignored, got %s", tag)
+	}
+}
+
+// Test that tagged pages are evicted by InvalidateTags and InvalidatePrefix
+func tagInvalidation(t *testing.T, store CacheStore) {
+	calls := map[string]int{}
+	router := gin.New()
+	options := Options{InvalidateByPrefix: true}
+	router.GET("/products/:id", CachePageWithOptions(store, time.Hour, options, func(c *gin.Context) {
+		calls[c.Request.URL.Path]++
+		Tag(c, "product:"+c.Param("id"))
+		Tag(c, "products")
+		c.String(http.StatusOK, c.Param("id"))
+	}))
+	router.GET("/productsearch", CachePageWithOptions(store, time.Hour, options, func(c *gin.Context) {
+		calls[c.Request.URL.Path]++
+		c.String(http.StatusOK, "search")
+	}))
+
+	paths := []string{"/products/1", "/products/2", "/productsearch"}
+	request := func() {
+		for _, path := range paths {
+			performRequest(router, "GET", path)
+		}
+	}
+	expect := func(step string, expected ...int) {
+		for i, path := range paths {
+			if calls[path] != expected[i] {
+				t.Errorf("%s: expected %d calls for %s, got %d", step, expected[i], path, calls[path])
+			}
+		}
+	}
+
+	request()
+	request()
+	expect("cached", 1, 1, 1)
+
+	if err := InvalidateTags(store, "product:1"); err != nil {
+		t.Fatalf("Error invalidating a tag: %s", err)
+	}
+	request()
+	expect("tag", 2, 1, 1)
+
+	if err := InvalidateTags(store, "products"); err != nil {
+		t.Fatalf("Error invalidating a tag: %s", err)
+	}
+	request()
+	expect("shared tag", 3, 2, 1)
+
+	if err := InvalidatePrefix(store, "/products"); err != nil {
+		t.Fatalf("Error invalidating a prefix: %s", err)
+	}
+	request()
+	expect("prefix", 4, 3, 1)
+
+	if err := InvalidateTags(store, "unknown"); err != nil {
+		t.Errorf("Error invalidating an unused tag: %s", err)
+	}
+	request()
+	expect("unused tag", 4, 3, 1)
+}
+
+func TestTagInvalidatedWhileRendering(t *testing.T) {
+	store := NewInMemoryStore(time.Hour)
+	calls := 0
+	router := gin.New()
+	options := Options{InvalidateByPrefix: true}
+	router.GET("/products/:id", CachePageWithOptions(store, time.Hour, options, func(c *gin.Context) {
+		calls++
+		Tag(c, "products")
+		if calls == 1 {
+			// The data changes after the handler read it.
+			InvalidateTags(store, "products")
+			InvalidatePrefix(store, "/products")
+		}
+		c.String(http.StatusOK, "page")
+	}))
+
+	performRequest(router, "GET", "/products/1")
+	if w := performRequest(router, "GET", "/products/1"); w.Header().Get("X-Cache") != "MISS" || calls != 2 {
+		t.Errorf("Expected the page invalidated while rendering to be a miss, got %s after %d calls", w.Header().Get("X-Cache"), calls)
+	}
+	if w := performRequest(router, "GET", "/products/1"); w.Header().Get("X-Cache") != "HIT" || calls != 2 {
+		t.Errorf("Expected the page rendered again to be cached, got %s after %d calls", w.Header().Get("X-Cache"), calls)
+	}
+}
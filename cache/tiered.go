@@ -0,0 +1,375 @@
+package cache
+
+import (
+	"crypto/rand"
+	"encoding/hex"
+	"reflect"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/garyburd/redigo/redis"
+)
+
+// defaultL1Expiration is how long a TieredStore keeps items in its L1 store
+// unless TieredOptions says otherwise.
+const defaultL1Expiration = 10 * time.Second
+
+// tieredGenerations is the number of generations a TieredStore spreads the
+// keys over. Keys sharing a generation only cost each other an L1 fill.
+const tieredGenerations = 256
+
+// TieredStore keeps the items of a remote L2 store, such as a RedisStore or a
+// MemcachedStore, in a local L1 store, typically an InMemoryStore, for a
+// short time. Reads are served by L1 when possible, writes and deletes go
+// through both stores.
+//
+// Other instances sharing the L2 store may see stale items in their own L1
+// store until it expires, unless the changes are broadcast by an
+// Invalidator. Counters, including the versions of the tags of cached pages,
+// are never kept in L1. L1 holds serialized copies of the items, so that
+// changes made to a value after it is stored or read do not leak into it.
+type TieredStore struct {
+	l1                CacheStore
+	l2                CacheStore
+	defaultExpiration time.Duration
+	l1Expiration      time.Duration
+	invalidator       Invalidator
+	logger            func(key string, err error)
+
+	// generations counts the changes made to L1 by the keys hashing to
+	// each of them, so that Get does not fill L1 with a value read from L2
+	// before a concurrent write or delete.
+	mu          sync.Mutex
+	generations [tieredGenerations]uint64
+}
+
+// TieredOptions holds the optional settings of a TieredStore.
+type TieredOptions struct {
+	// L1Expiration caps how long items are kept in the L1 store. It
+	// defaults to 10 seconds.
+	L1Expiration time.Duration
+
+	// Invalidator broadcasts the keys changed by the store to the other
+	// instances, which drop them from their L1 store.
+	Invalidator Invalidator
+
+	// Logger is called with the errors of the Invalidator, which are
+	// ignored by default.
+	Logger func(key string, err error)
+}
+
+// Invalidator broadcasts the keys changed in a TieredStore to the other
+// instances sharing its L2 store. An empty key stands for a Flush.
+type Invalidator interface {
+	// Invalidate tells the other instances that key changed.
+	Invalidate(key string) error
+	// Subscribe calls f with the keys invalidated by the other instances.
+	Subscribe(f func(key string))
+	// Close stops the subscription.
+	Close() error
+}
+
+func NewTieredStore(l1, l2 CacheStore, defaultExpiration time.Duration) *TieredStore {
+	return NewTieredStoreWithOptions(l1, l2, defaultExpiration, TieredOptions{})
+}
+
+// NewTieredStoreWithOptions is like NewTieredStore but accepts TieredOptions.
+func NewTieredStoreWithOptions(l1, l2 CacheStore, defaultExpiration time.Duration, options TieredOptions) *TieredStore {
+	if options.L1Expiration <= 0 {
+		options.L1Expiration = defaultL1Expiration
+	}
+	c := &TieredStore{
+		l1:                l1,
+		l2:                l2,
+		defaultExpiration: defaultExpiration,
+		l1Expiration:      options.L1Expiration,
+		invalidator:       options.Invalidator,
+		logger:            options.Logger,
+	}
+	if c.invalidator != nil {
+		c.invalidator.Subscribe(c.evict)
+	}
+	return c
+}
+
+func (c *TieredStore) Get(key string, value interface{}) error {
+	local := c.local(key, value)
+	if local {
+		var b []byte
+		if c.l1.Get(key, &b) == nil {
+			if _, ok := value.(*[]byte); ok {
+				b = append([]byte(nil), b...)
+			}
+			if deserialize(GobSerializer, b, value) == nil {
+				return nil
+			}
+		}
+	}
+	generation := c.generation(key)
+	if err := c.l2.Get(key, value); err != nil {
+		return err
+	}
+	if v := reflect.ValueOf(value); local && v.Kind() == reflect.Ptr && !v.IsNil() {
+		c.fill(key, generation, v.Elem().Interface())
+	}
+	return nil
+}
+
+func (c *TieredStore) Set(key string, value interface{}, expires time.Duration) error {
+	expires = c.expiration(expires)
+	err := c.l2.Set(key, value, expires)
+	c.written(key, value, expires, err)
+	return err
+}
+
+func (c *TieredStore) Add(key string, value interface{}, expires time.Duration) error {
+	expires = c.expiration(expires)
+	err := c.l2.Add(key, value, expires)
+	c.written(key, value, expires, err)
+	return err
+}
+
+func (c *TieredStore) Replace(key string, value interface{}, expires time.Duration) error {
+	expires = c.expiration(expires)
+	err := c.l2.Replace(key, value, expires)
+	c.written(key, value, expires, err)
+	return err
+}
+
+func (c *TieredStore) Delete(key string) error {
+	err := c.l2.Delete(key)
+	c.evict(key)
+	c.invalidate(key)
+	return err
+}
+
+func (c *TieredStore) Increment(key string, delta uint64) (uint64, error) {
+	newValue, err := c.l2.Increment(key, delta)
+	c.evict(key)
+	if err == nil {
+		c.invalidate(key)
+	}
+	return newValue, err
+}
+
+func (c *TieredStore) Decrement(key string, delta uint64) (uint64, error) {
+	newValue, err := c.l2.Decrement(key, delta)
+	c.evict(key)
+	if err == nil {
+		c.invalidate(key)
+	}
+	return newValue, err
+}
+
+func (c *TieredStore) Flush() error {
+	err := c.l2.Flush()
+	c.evict("")
+	c.invalidate("")
+	return err
+}
+
+// Close stops listening to the invalidations of the other instances.
+func (c *TieredStore) Close() error {
+	if c.invalidator == nil {
+		return nil
+	}
+	return c.invalidator.Close()
+}
+
+// written updates L1 after a write to L2 returned err.
+func (c *TieredStore) written(key string, value interface{}, expires time.Duration, err error) {
+	if err != nil {
+		c.evict(key)
+		return
+	}
+	if !c.local(key, value) {
+		c.evict(key)
+	} else {
+		if expires <= 0 || expires > c.l1Expiration {
+			expires = c.l1Expiration
+		}
+		c.mu.Lock()
+		c.generations[c.index(key)]++
+		c.keep(key, value, expires)
+		c.mu.Unlock()
+	}
+	c.invalidate(key)
+}
+
+// local reports whether the item of key, value or a pointer to it, may be
+// kept in L1. Counters and the versions of tags are not.
+func (c *TieredStore) local(key string, value interface{}) bool {
+	if isTagKey(key) {
+		return false
+	}
+	switch reflect.Indirect(reflect.ValueOf(value)).Kind() {
+	case reflect.Int, reflect.Int8, reflect.Int16, reflect.Int32, reflect.Int64,
+		reflect.Uint, reflect.Uint8, reflect.Uint16, reflect.Uint32, reflect.Uint64:
+		return false
+	}
+	return true
+}
+
+// generation returns the generation of key, to be given to fill.
+func (c *TieredStore) generation(key string) uint64 {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	return c.generations[c.index(key)]
+}
+
+// fill keeps value, read from L2, in L1 unless key may have been written or
+// evicted since its generation was read.
+func (c *TieredStore) fill(key string, generation uint64, value interface{}) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	if c.generations[c.index(key)] == generation {
+		c.keep(key, value, c.l1Expiration)
+	}
+}
+
+// keep stores a serialized copy of value in L1, or drops key from L1 if
+// value cannot be serialized. It is called with mu held.
+func (c *TieredStore) keep(key string, value interface{}, expires time.Duration) {
+	b, err := serialize(GobSerializer, value)
+	if err != nil {
+		c.l1.Delete(key)
+		return
+	}
+	c.l1.Set(key, append([]byte(nil), b...), expires)
+}
+
+// evict drops key from L1, or everything if key is empty.
+func (c *TieredStore) evict(key string) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	if key == "" {
+		for i := range c.generations {
+			c.generations[i]++
+		}
+		c.l1.Flush()
+	} else {
+		c.generations[c.index(key)]++
+		c.l1.Delete(key)
+	}
+}
+
+// index returns the generation of key in generations.
+func (c *TieredStore) index(key string) int {
+	return int(crc16(key) % tieredGenerations)
+}
+
+func (c *TieredStore) invalidate(key string) {
+	if c.invalidator == nil {
+		return
+	}
+	if err := c.invalidator.Invalidate(key); err != nil && c.logger != nil {
+		c.logger(key, err)
+	}
+}
+
+// expiration resolves DEFAULT, so that both stores agree on it.
+func (c *TieredStore) expiration(expires time.Duration) time.Duration {
+	if expires == DEFAULT {
+		return c.defaultExpiration
+	}
+	return expires
+}
+
+// RedisInvalidator is an Invalidator using redis pub/sub. Each instance must
+// have its own RedisInvalidator, as it ignores the keys it publishes.
+type RedisInvalidator struct {
+	pool    *redis.Pool
+	channel string
+	id      string
+
+	mu     sync.Mutex
+	conn   redis.Conn
+	closed bool
+}
+
+// redisInvalidatorRetry is how long a RedisInvalidator waits before
+// subscribing again after losing its connection.
+var redisInvalidatorRetry = time.Second
+
+// NewRedisInvalidator returns an Invalidator publishing to channel of the
+// redis server at host.
+func NewRedisInvalidator(host string, password string, channel string) *RedisInvalidator {
+	var id [8]byte
+	rand.Read(id[:])
+	return &RedisInvalidator{
+		pool:    newRedisPool(host, password, RedisOptions{}),
+		channel: channel,
+		id:      hex.EncodeToString(id[:]),
+	}
+}
+
+// Invalidate publishes key, prefixed by the id of the instance.
+func (i *RedisInvalidator) Invalidate(key string) error {
+	conn := i.pool.Get()
+	defer conn.Close()
+	_, err := conn.Do("PUBLISH", i.channel, i.id+" "+key)
+	return err
+}
+
+// Subscribe listens to the channel in the background until Close. As keys
+// may have been missed while the connection was lost, f is called with an
+// empty key after every reconnection.
+func (i *RedisInvalidator) Subscribe(f func(key string)) {
+	go func() {
+		for reconnected := false; ; reconnected = true {
+			if reconnected {
+				time.Sleep(redisInvalidatorRetry)
+			}
+			// A connection of its own, which Close can interrupt.
+			conn, err := i.pool.Dial()
+			i.mu.Lock()
+			if i.closed {
+				i.mu.Unlock()
+				if err == nil {
+					conn.Close()
+				}
+				return
+			}
+			i.conn = conn
+			i.mu.Unlock()
+			if err != nil {
+				continue
+			}
+			if reconnected {
+				f("")
+			}
+			i.receive(redis.PubSubConn{Conn: conn}, f)
+			conn.Close()
+		}
+	}()
+}
+
+// receive calls f with the keys published by other instances until the
+// connection fails.
+func (i *RedisInvalidator) receive(conn redis.PubSubConn, f func(key string)) {
+	if err := conn.Subscribe(i.channel); err != nil {
+		return
+	}
+	for {
+		switch v := conn.Receive().(type) {
+		case redis.Message:
+			data := string(v.Data)
+			if n := strings.IndexByte(data, ' '); n >= 0 && data[:n] != i.id {
+				f(data[n+1:])
+			}
+		case error:
+			return
+		}
+	}
+}
+
+func (i *RedisInvalidator) Close() error {
+	i.mu.Lock()
+	defer i.mu.Unlock()
+	i.closed = true
+	if i.conn != nil {
+		i.conn.Close()
+	}
+	return i.pool.Close()
+}
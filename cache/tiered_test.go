@@ -0,0 +1,190 @@
+package cache
+
+import (
+	"testing"
+	"time"
+)
+
+var newTieredStore = func(_ *testing.T, defaultExpiration time.Duration) CacheStore {
+	return NewTieredStore(NewInMemoryStore(defaultExpiration), NewInMemoryStore(defaultExpiration), defaultExpiration)
+}
+
+func TestTieredCache_TypicalGetSet(t *testing.T) {
+	typicalGetSet(t, newTieredStore)
+}
+
+func TestTieredCache_IncrDecr(t *testing.T) {
+	incrDecr(t, newTieredStore)
+}
+
+func TestTieredCache_Expiration(t *testing.T) {
+	expiration(t, newTieredStore)
+}
+
+func TestTieredCache_EmptyCache(t *testing.T) {
+	emptyCache(t, newTieredStore)
+}
+
+func TestTieredCache_Replace(t *testing.T) {
+	testReplace(t, newTieredStore)
+}
+
+func TestTieredCache_Add(t *testing.T) {
+	testAdd(t, newTieredStore)
+}
+
+func TestTieredCache_Concurrency(t *testing.T) {
+	concurrency(t, newTieredStore)
+}
+
+func TestTieredCache_CachePage(t *testing.T) {
+	cachePage(t, newTieredStore(t, time.Hour))
+}
+
+func TestTieredCache_L1(t *testing.T) {
+	l2 := NewInMemoryStore(time.Hour)
+	store := NewTieredStoreWithOptions(NewInMemoryStore(time.Hour), l2, time.Hour, TieredOptions{L1Expiration: time.Second})
+
+	// Reads fill L1, which is served even if L2 changes behind its back.
+	l2.Set("value", "l2", DEFAULT)
+	var value string
+	if err := store.Get("value", &value); err != nil || value != "l2" {
+		t.Fatalf("Expected l2, got %q: %v", value, err)
+	}
+	l2.Set("value", "changed", DEFAULT)
+	if err := store.Get("value", &value); err != nil || value != "l2" {
+		t.Errorf("Expected l2 from L1, got %q: %v", value, err)
+	}
+
+	// Until L1 expires.
+	time.Sleep(2 * time.Second)
+	if err := store.Get("value", &value); err != nil || value != "changed" {
+		t.Errorf("Expected changed once L1 expired, got %q: %v", value, err)
+	}
+
+	// Writes and deletes go through.
+	if err := store.Set("value", "written", DEFAULT); err != nil {
+		t.Fatalf("Error setting a value: %s", err)
+	}
+	if err := l2.Get("value", &value); err != nil || value != "written" {
+		t.Errorf("Expected written in L2, got %q: %v", value, err)
+	}
+	if err := store.Delete("value"); err != nil {
+		t.Fatalf("Error deleting a value: %s", err)
+	}
+	if err := store.Get("value", &value); err != ErrCacheMiss {
+		t.Errorf("Expected ErrCacheMiss after a delete, got %v", err)
+	}
+}
+
+func TestTieredCache_L1Items(t *testing.T) {
+	l1, l2 := NewInMemoryStore(time.Hour), NewInMemoryStore(time.Hour)
+	store := NewTieredStore(l1, l2, time.Hour)
+
+	// Counters and tag versions are read from L2 only.
+	store.Set("counter", 1, DEFAULT)
+	var n int
+	store.Get("counter", &n)
+	InvalidateTags(store, "products")
+	var version uint64
+	store.Get(tagKey("products"), &version)
+	for _, key := range []string{"counter", tagKey("products")} {
+		var b []byte
+		if err := l1.Get(key, &b); err != ErrCacheMiss {
+			t.Errorf("Expected %s not to be kept in L1, got %v", key, err)
+		}
+	}
+
+	// L1 holds copies of the values.
+	value := map[string]string{"name": "stored"}
+	store.Set("map", value, DEFAULT)
+	value["name"] = "changed"
+	var got map[string]string
+	if err := store.Get("map", &got); err != nil || got["name"] != "stored" {
+		t.Errorf("Expected the stored value, got %v: %v", got, err)
+	}
+	got["name"] = "changed"
+	got = nil
+	if err := store.Get("map", &got); err != nil || got["name"] != "stored" {
+		t.Errorf("Expected the stored value, got %v: %v", got, err)
+	}
+}
+
+// hookStore calls hook after each successful Get.
+type hookStore struct {
+	CacheStore
+	hook func(key string)
+}
+
+func (s hookStore) Get(key string, value interface{}) error {
+	err := s.CacheStore.Get(key, value)
+	if err == nil && s.hook != nil {
+		s.hook(key)
+	}
+	return err
+}
+
+func TestTieredCache_ChangedWhileReading(t *testing.T) {
+	l2 := &hookStore{CacheStore: NewInMemoryStore(time.Hour)}
+	store := NewTieredStore(NewInMemoryStore(time.Hour), l2, time.Hour)
+
+	// A value read from L2 is not kept in L1 once deleted or replaced.
+	for _, change := range []func(){
+		func() { store.Delete("value") },
+		func() { store.Set("value", "new", DEFAULT) },
+	} {
+		store.Set("value", "old", DEFAULT)
+		store.evict("value")
+		l2.hook = func(string) {
+			l2.hook = nil
+			change()
+		}
+		var value string
+		store.Get("value", &value)
+		value = ""
+		if err := store.Get("value", &value); value == "old" {
+			t.Errorf("Expected the change to be seen, got %q: %v", value, err)
+		}
+	}
+}
+
+func TestTieredCache_RedisInvalidation(t *testing.T) {
+	server := newTestRedis(t, nil)
+	defer server.Close()
+	host := server.Addr()
+	newStore := func() *TieredStore {
+		return NewTieredStoreWithOptions(NewInMemoryStore(time.Hour), NewRedisCache(host, "", time.Hour), time.Hour,
+			TieredOptions{L1Expiration: time.Hour, Invalidator: NewRedisInvalidator(host, "", "invalidations")})
+	}
+	a, b := newStore(), newStore()
+	defer a.Close()
+	defer b.Close()
+	waitSubscribers(t, server, "invalidations", 2)
+
+	var value string
+	a.Set("value", "first", DEFAULT)
+	if err := b.Get("value", &value); err != nil || value != "first" {
+		t.Fatalf("Expected first, got %q: %v", value, err)
+	}
+
+	// The change made by a evicts the value from the L1 store of b.
+	a.Set("value", "second", DEFAULT)
+	for deadline := time.Now().Add(5 * time.Second); value != "second" && time.Now().Before(deadline); {
+		time.Sleep(10 * time.Millisecond)
+		b.Get("value", &value)
+	}
+	if value != "second" {
+		t.Errorf("Expected second once invalidated, got %q", value)
+	}
+
+	// As does a flush.
+	a.Flush()
+	err := b.Get("value", &value)
+	for deadline := time.Now().Add(5 * time.Second); err == nil && time.Now().Before(deadline); {
+		time.Sleep(10 * time.Millisecond)
+		err = b.Get("value", &value)
+	}
+	if err != ErrCacheMiss {
+		t.Errorf("Expected ErrCacheMiss once flushed, got %q: %v", value, err)
+	}
+}
@@ -0,0 +1,161 @@
+//go:build go1.18
+// +build go1.18
+
+package cache
+
+import (
+	"errors"
+	"math/rand"
+	"sync"
+	"time"
+)
+
+// ErrNotFound is returned by the loader of GetOrLoad when the value does not
+// exist. Typed caches it for TypedOptions.NegativeTTL.
+var ErrNotFound = errors.New("cache: value not found.")
+
+var errLoaderPanicked = errors.New("cache: loader panicked.")
+
+// Typed is a type-safe view of a store holding values of type T, with a
+// read-through GetOrLoad.
+//
+// Values are stored wrapped, with a flag marking the values known not to
+// exist, so the keys of a Typed cache should not be used directly with its
+// store.
+type Typed[T any] struct {
+	store   CacheStore
+	options TypedOptions
+
+	mu    sync.Mutex
+	calls map[string]*typedCall[T]
+}
+
+// TypedOptions holds the optional settings of a Typed cache.
+type TypedOptions struct {
+	// NegativeTTL is how long GetOrLoad remembers that its loader returned
+	// ErrNotFound. Zero disables it.
+	NegativeTTL time.Duration
+
+	// Jitter shortens every expiration by a random fraction of it, up to
+	// Jitter, so that values stored together do not expire together. 0.1
+	// gives expirations between 90% and 100% of the requested one. It has
+	// no effect on DEFAULT and FOREVER.
+	Jitter float64
+
+	// Logger is called with the errors of the store that GetOrLoad cannot
+	// return, which are ignored by default.
+	Logger func(key string, err error)
+}
+
+// typedEntry is the stored form of the values of a Typed cache.
+type typedEntry[T any] struct {
+	Value    T
+	NotFound bool
+}
+
+// typedCall is a load of GetOrLoad, shared by the concurrent callers.
+type typedCall[T any] struct {
+	done  chan struct{}
+	value T
+	err   error
+}
+
+// valueGetter is implemented by the in-memory stores, which can return their
+// values without reflection.
+type valueGetter interface {
+	getValue(key string) (interface{}, bool)
+}
+
+func NewTyped[T any](store CacheStore, options TypedOptions) *Typed[T] {
+	return &Typed[T]{store: store, options: options, calls: make(map[string]*typedCall[T])}
+}
+
+// Get returns the value of key, ErrCacheMiss if it is missing, or ErrNotFound
+// if it is known not to exist.
+func (c *Typed[T]) Get(key string) (T, error) {
+	var entry typedEntry[T]
+	if getter, ok := c.store.(valueGetter); ok {
+		value, found := getter.getValue(key)
+		if !found {
+			return entry.Value, ErrCacheMiss
+		}
+		if entry, ok = value.(typedEntry[T]); !ok {
+			return entry.Value, ErrNotStored
+		}
+	} else if err := c.store.Get(key, &entry); err != nil {
+		return entry.Value, err
+	}
+	if entry.NotFound {
+		return entry.Value, ErrNotFound
+	}
+	return entry.Value, nil
+}
+
+func (c *Typed[T]) Set(key string, value T, expire time.Duration) error {
+	return c.store.Set(key, typedEntry[T]{Value: value}, c.jitter(expire))
+}
+
+func (c *Typed[T]) Delete(key string) error {
+	return c.store.Delete(key)
+}
+
+// GetOrLoad returns the value of key, calling loader to get it and store it
+// for expire if it is missing. Concurrent calls for the same key share a
+// single call to loader.
+//
+// If loader returns ErrNotFound, it is returned, and remembered for
+// NegativeTTL. Other errors are returned without being stored.
+func (c *Typed[T]) GetOrLoad(key string, expire time.Duration, loader func() (T, error)) (T, error) {
+	value, err := c.Get(key)
+	if err == nil || err == ErrNotFound {
+		return value, err
+	}
+	if err != ErrCacheMiss {
+		c.logError(key, err)
+	}
+
+	c.mu.Lock()
+	if call, ok := c.calls[key]; ok {
+		c.mu.Unlock()
+		<-call.done
+		return call.value, call.err
+	}
+	call := &typedCall[T]{done: make(chan struct{}), err: errLoaderPanicked}
+	c.calls[key] = call
+	c.mu.Unlock()
+
+	defer func() {
+		c.mu.Lock()
+		delete(c.calls, key)
+		c.mu.Unlock()
+		close(call.done)
+	}()
+	call.value, call.err = loader()
+	switch {
+	case call.err == nil:
+		c.logError(key, c.Set(key, call.value, expire))
+	case call.err == ErrNotFound && c.options.NegativeTTL > 0:
+		entry := typedEntry[T]{NotFound: true}
+		c.logError(key, c.store.Set(key, entry, c.jitter(c.options.NegativeTTL)))
+	}
+	return call.value, call.err
+}
+
+// jitter shortens expire by a random fraction of up to Jitter.
+func (c *Typed[T]) jitter(expire time.Duration) time.Duration {
+	if c.options.Jitter <= 0 || expire <= 0 {
+		return expire
+	}
+	jittered := expire - time.Duration(rand.Float64()*c.options.Jitter*float64(expire))
+	if jittered <= 0 {
+		// Never DEFAULT or FOREVER.
+		jittered = 1
+	}
+	return jittered
+}
+
+func (c *Typed[T]) logError(key string, err error) {
+	if err != nil && c.options.Logger != nil {
+		c.options.Logger(key, err)
+	}
+}
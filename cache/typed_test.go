@@ -0,0 +1,124 @@
+//go:build go1.18
+// +build go1.18
+
+package cache
+
+import (
+	"errors"
+	"sync"
+	"sync/atomic"
+	"testing"
+	"time"
+)
+
+type typedValue struct {
+	Name string
+	Tags []string
+}
+
+func TestTyped_GetSet(t *testing.T) {
+	server := newTestRedis(t, nil)
+	defer server.Close()
+	for _, store := range []CacheStore{
+		NewInMemoryStore(time.Hour),
+		NewBoundedStore(time.Hour, BoundedOptions{MaxEntries: 10}),
+		NewRedisCacheWithOptions(server.Addr(), "", time.Hour, RedisOptions{Serializer: JSONSerializer}),
+	} {
+		typed := NewTyped[typedValue](store, TypedOptions{})
+		if _, err := typed.Get("value"); err != ErrCacheMiss {
+			t.Errorf("Expected ErrCacheMiss from %T, got %v", store, err)
+		}
+		in := typedValue{"foo", []string{"a", "b"}}
+		if err := typed.Set("value", in, DEFAULT); err != nil {
+			t.Fatalf("Error setting a value in %T: %s", store, err)
+		}
+		if out, err := typed.Get("value"); err != nil || out.Name != "foo" || len(out.Tags) != 2 {
+			t.Errorf("Expected %v from %T, got %v: %v", in, store, out, err)
+		}
+		if _, err := NewTyped[int](store, TypedOptions{}).Get("value"); err == nil {
+			t.Errorf("Expected an error getting a value of another type from %T", store)
+		}
+	}
+}
+
+func TestTyped_GetOrLoad(t *testing.T) {
+	typed := NewTyped[string](NewInMemoryStore(time.Hour), TypedOptions{})
+	var calls int32
+	release := make(chan struct{})
+	loader := func() (string, error) {
+		atomic.AddInt32(&calls, 1)
+		<-release
+		return "loaded", nil
+	}
+
+	var wg sync.WaitGroup
+	for i := 0; i < 10; i++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			if value, err := typed.GetOrLoad("value", time.Hour, loader); err != nil || value != "loaded" {
+				t.Errorf("Expected loaded, got %q: %v", value, err)
+			}
+		}()
+	}
+	time.Sleep(50 * time.Millisecond)
+	close(release)
+	wg.Wait()
+	if calls != 1 {
+		t.Errorf("Expected a single load, got %d", calls)
+	}
+
+	// Stored.
+	if value, err := typed.GetOrLoad("value", time.Hour, loader); err != nil || value != "loaded" || calls != 1 {
+		t.Errorf("Expected the stored value, got %q with %d loads: %v", value, calls, err)
+	}
+
+	// Errors are not stored.
+	failure := errors.New("failure")
+	if _, err := typed.GetOrLoad("failing", time.Hour, func() (string, error) { return "", failure }); err != failure {
+		t.Errorf("Expected the error of the loader, got %v", err)
+	}
+	if _, err := typed.Get("failing"); err != ErrCacheMiss {
+		t.Errorf("Expected errors not to be stored, got %v", err)
+	}
+}
+
+func TestTyped_NegativeCaching(t *testing.T) {
+	typed := NewTyped[int](NewInMemoryStore(time.Hour), TypedOptions{NegativeTTL: time.Second})
+	calls := 0
+	loader := func() (int, error) {
+		calls++
+		return 0, ErrNotFound
+	}
+	for i := 0; i < 2; i++ {
+		if _, err := typed.GetOrLoad("missing", time.Hour, loader); err != ErrNotFound {
+			t.Errorf("Expected ErrNotFound, got %v", err)
+		}
+	}
+	if calls != 1 {
+		t.Errorf("Expected ErrNotFound to be cached, got %d loads", calls)
+	}
+	time.Sleep(2 * time.Second)
+	typed.GetOrLoad("missing", time.Hour, loader)
+	if calls != 2 {
+		t.Errorf("Expected ErrNotFound to expire, got %d loads", calls)
+	}
+}
+
+func TestTyped_Jitter(t *testing.T) {
+	typed := NewTyped[int](NewInMemoryStore(time.Hour), TypedOptions{Jitter: 0.1})
+	varied := false
+	for i := 0; i < 100; i++ {
+		expire := typed.jitter(time.Hour)
+		if expire < 54*time.Minute || expire > time.Hour {
+			t.Fatalf("Expected an expiration between 54m and 1h, got %s", expire)
+		}
+		varied = varied || expire != time.Hour
+	}
+	if !varied {
+		t.Errorf("Expected the expirations to vary")
+	}
+	if typed.jitter(DEFAULT) != DEFAULT || typed.jitter(FOREVER) != FOREVER {
+		t.Errorf("Expected DEFAULT and FOREVER to be kept")
+	}
+}
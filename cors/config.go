@@ -1,60 +1,194 @@
 package cors
 
 import (
+	"errors"
 	"net/http"
+	"regexp"
 	"strconv"
 	"strings"
 	"time"
+
+	"github.com/gin-gonic/gin"
 )
 
 type settings struct {
-	allowAllOrigins   bool
-	allowedOriginFunc func(string) bool
-	allowedOrigins    []string
-	allowedMethods    []string
-	allowedHeaders    []string
-	exposedHeaders    []string
-	normalHeaders     http.Header
-	preflightHeaders  http.Header
+	abortOnError             bool
+	allowAllOrigins          bool
+	allowAllHeaders          bool
+	allowCredentials         bool
+	allowPrivateNetwork      bool
+	passThroughPreflight     bool
+	preflightStatus          int
+	allowedOriginFunc        func(string) bool
+	allowedOriginContextFunc func(*gin.Context, string) bool
+	allowedOrigins           []string
+	originPatterns           []*regexp.Regexp
+	dynamicOrigins           *originList
+	allowedMethods           []string
+	allowedHeaders           []string
+	exposedHeaders           []string
+	normalHeaders            http.Header
+	preflightHeaders         http.Header
 }
 
 func newSettings(c Config) *settings {
 	if err := c.Validate(); err != nil {
 		panic(err.Error())
 	}
+	origins, patterns := compileOrigins(c.AllowedOrigins)
+	for _, expr := range c.AllowedOriginRegexps {
+		patterns = append(patterns, regexp.MustCompile("^(?:"+expr+")$"))
+	}
+	preflightStatus := c.PreflightStatus
+	if preflightStatus == 0 {
+		preflightStatus = http.StatusOK
+	}
+	var dynamicOrigins *originList
+	if c.AllowOriginsProvider != nil {
+		dynamicOrigins = newOriginList(c.AllowOriginsProvider, c.AllowOriginsRefresh, c.AllowCustomSchemes, c.AllowOriginsLogger)
+	}
 	return &settings{
-		allowedOriginFunc: c.AllowOriginFunc,
-		allowAllOrigins:   c.AllowAllOrigins,
-		allowedOrigins:    c.AllowedOrigins,
-		allowedMethods:    distinct(c.AllowedMethods),
-		allowedHeaders:    distinct(c.AllowedHeaders),
-		normalHeaders:     generateNormalHeaders(c),
-		preflightHeaders:  generatePreflightHeaders(c),
+		abortOnError:             c.AbortOnError,
+		allowedOriginFunc:        c.AllowOriginFunc,
+		allowedOriginContextFunc: c.AllowOriginWithContext,
+		allowAllOrigins:          c.AllowAllOrigins || contains(c.AllowedOrigins, "*"),
+		allowedOrigins:           origins,
+		originPatterns:           patterns,
+		dynamicOrigins:           dynamicOrigins,
+		allowedMethods:           distinct(normalize(c.AllowedMethods, strings.ToUpper)),
+		allowedHeaders:           distinct(normalize(c.AllowedHeaders, http.CanonicalHeaderKey)),
+		allowAllHeaders:          contains(c.AllowedHeaders, "*"),
+		allowCredentials:         c.AllowCredentials,
+		allowPrivateNetwork:      c.AllowPrivateNetwork,
+		passThroughPreflight:     c.PassThroughPreflight,
+		preflightStatus:          preflightStatus,
+		normalHeaders:            generateNormalHeaders(c),
+		preflightHeaders:         generatePreflightHeaders(c),
 	}
 }
 
-func (c *settings) validateOrigin(origin string) (string, bool) {
+func (c *settings) validateOrigin(ctx *gin.Context, origin string) (string, bool) {
 	if c.allowAllOrigins {
+		// "*" is not allowed with credentials, the origin is reflected.
+		if c.allowCredentials {
+			return origin, true
+		}
 		return "*", true
 	}
-	if c.allowedOriginFunc != nil {
-		return origin, c.allowedOriginFunc(origin)
+	if matchOrigin(c.allowedOrigins, c.originPatterns, origin) {
+		return origin, true
 	}
-	for _, value := range c.allowedOrigins {
-		if value == origin {
-			return origin, true
-		}
+	if c.dynamicOrigins != nil && c.dynamicOrigins.allowed(origin) {
+		return origin, true
+	}
+	if c.allowedOriginFunc != nil && c.allowedOriginFunc(origin) {
+		return origin, true
+	}
+	if c.allowedOriginContextFunc != nil && c.allowedOriginContextFunc(ctx, origin) {
+		return origin, true
 	}
 	return "", false
 }
 
-func (c *settings) validateMethod(method string) bool {
-	// TODO!!!
+// varyOrigin reports whether the response depends on the origin of the
+// request, so that it must have a Vary: Origin header.
+func (c *settings) varyOrigin() bool {
+	return !c.allowAllOrigins || c.allowCredentials
+}
+
+// compileOrigins splits a list of origins into the exact ones, lowercased,
+// and the regular expressions matching those with wildcards.
+func compileOrigins(list []string) (origins []string, patterns []*regexp.Regexp) {
+	for _, origin := range list {
+		origin = strings.ToLower(origin)
+		if strings.Contains(origin, "*") {
+			patterns = append(patterns, compileWildcard(origin))
+		} else {
+			origins = append(origins, origin)
+		}
+	}
+	return origins, patterns
+}
+
+// matchOrigin reports whether origin is in origins or matches one of patterns.
+func matchOrigin(origins []string, patterns []*regexp.Regexp, origin string) bool {
+	if contains(origins, strings.ToLower(origin)) {
+		return true
+	}
+	for _, pattern := range patterns {
+		if pattern.MatchString(origin) {
+			return true
+		}
+	}
+	return false
+}
+
+// compileWildcard returns a regular expression matching the origins matched
+// by pattern, where each "*" stands for a part of a host name or a port.
+func compileWildcard(pattern string) *regexp.Regexp {
+	parts := strings.Split(pattern, "*")
+	for i, part := range parts {
+		parts[i] = regexp.QuoteMeta(part)
+	}
+	return regexp.MustCompile("(?i)^" + strings.Join(parts, "[a-z0-9.-]+") + "$")
+}
+
+// validScheme reports whether origin starts with a scheme followed by "://".
+func validScheme(origin string) bool {
+	i := strings.Index(origin, "://")
+	if i <= 0 {
+		return false
+	}
+	for j, r := range origin[:i] {
+		switch {
+		case 'a' <= r && r <= 'z', 'A' <= r && r <= 'Z':
+		case j > 0 && ('0' <= r && r <= '9' || r == '+' || r == '-' || r == '.'):
+		default:
+			return false
+		}
+	}
 	return true
 }
 
+// checkOrigin returns an error if origin cannot be in AllowedOrigins.
+func checkOrigin(origin string, customSchemes bool) error {
+	if origin == "*" {
+		return nil
+	}
+	if !customSchemes && !strings.HasPrefix(origin, "http://") && !strings.HasPrefix(origin, "https://") {
+		return errors.New("bad origin: origins must include http:// or https://")
+	}
+	if !validScheme(origin) {
+		return errors.New("bad origin: origins must include a scheme such as http://")
+	}
+	return nil
+}
+
+// validateMethod checks the method requested by a preflight request. The
+// simple methods are always allowed.
+func (c *settings) validateMethod(method string) bool {
+	if len(method) == 0 {
+		return false
+	}
+	method = strings.ToUpper(method)
+	switch method {
+	case "GET", "HEAD", "POST":
+		return true
+	}
+	return contains(c.allowedMethods, method)
+}
+
+// validateHeader checks the comma-separated list of headers requested by a
+// preflight request. Header names are case-insensitive.
 func (c *settings) validateHeader(header string) bool {
-	// TODO!!!
+	if c.allowAllHeaders {
+		return true
+	}
+	for _, name := range parse(header) {
+		if len(name) > 0 && !contains(c.allowedHeaders, http.CanonicalHeaderKey(name)) {
+			return false
+		}
+	}
 	return true
 }
 
@@ -63,7 +197,9 @@ func generateNormalHeaders(c Config) http.Header {
 	if c.AllowCredentials {
 		headers.Set("Access-Control-Allow-Credentials", "true")
 	}
-	if len(c.ExposedHeaders) > 0 {
+	if contains(c.ExposedHeaders, "*") {
+		headers.Set("Access-Control-Expose-Headers", "*")
+	} else if len(c.ExposedHeaders) > 0 {
 		headers.Set("Access-Control-Expose-Headers", strings.Join(c.ExposedHeaders, ", "))
 	}
 	return headers
@@ -86,6 +222,23 @@ func generatePreflightHeaders(c Config) http.Header {
 	return headers
 }
 
+// addVary adds fields to the Vary header of h, unless they are already there.
+func addVary(h http.Header, fields ...string) {
+	for _, field := range fields {
+		found := false
+		for _, value := range h["Vary"] {
+			for _, v := range parse(value) {
+				if v == "*" || strings.EqualFold(v, field) {
+					found = true
+				}
+			}
+		}
+		if !found {
+			h.Add("Vary", field)
+		}
+	}
+}
+
 func distinct(s []string) []string {
 	m := map[string]bool{}
 	for _, v := range s {
@@ -97,6 +250,24 @@ func distinct(s []string) []string {
 	return s[:len(m)]
 }
 
+// normalize returns a copy of s with f applied to its values.
+func normalize(s []string, f func(string) string) []string {
+	normalized := make([]string, len(s))
+	for i, v := range s {
+		normalized[i] = f(v)
+	}
+	return normalized
+}
+
+func contains(s []string, value string) bool {
+	for _, v := range s {
+		if v == value {
+			return true
+		}
+	}
+	return false
+}
+
 func parse(content string) []string {
 	if len(content) == 0 {
 		return nil
@@ -3,6 +3,8 @@ package cors
 import (
 	"errors"
 	"net/http"
+	"regexp"
+	"sort"
 	"strings"
 	"time"
 
@@ -15,35 +17,84 @@ type Config struct {
 
 	// AllowedOrigins is a list of origins a cross-domain request can be executed from.
 	// If the special "*" value is present in the list, all origins will be allowed.
+	// An origin may contain "*" wildcards, each matching a host name or a part of
+	// it, or a port: "https://*.example.com" allows all the subdomains of
+	// example.com, "http://localhost:*" any port of localhost.
 	// Default value is ["*"]
 	AllowedOrigins []string
 
+	// AllowedOriginRegexps is a list of regular expressions matching the whole
+	// origin of the cross-domain requests allowed, in addition to AllowedOrigins.
+	AllowedOriginRegexps []string
+
+	// AllowCustomSchemes lets AllowedOrigins contain origins with schemes other
+	// than http and https, such as "chrome-extension://", "capacitor://" or
+	// "tauri://".
+	AllowCustomSchemes bool
+
 	// AllowOriginFunc is a custom function to validate the origin. It take the origin
-	// as argument and returns true if allowed or false otherwise. If this option is
-	// set, the content of AllowedOrigins is ignored.
+	// as argument and returns true if allowed or false otherwise. Origins not in
+	// AllowedOrigins nor matching AllowedOriginRegexps are allowed if it returns true.
 	AllowOriginFunc func(origin string) bool
 
+	// AllowOriginWithContext is like AllowOriginFunc but also takes the context of
+	// the request, to allow origins per tenant or after a lookup for instance.
+	AllowOriginWithContext func(c *gin.Context, origin string) bool
+
+	// AllowOriginsProvider returns a list of origins allowed in addition to
+	// AllowedOrigins, in the same format. It is called by New, then in the
+	// background whenever the list is older than AllowOriginsRefresh. If it fails
+	// or panics, the previous list is kept until the next refresh. Invalid origins
+	// and "*" are ignored.
+	AllowOriginsProvider func() ([]string, error)
+
+	// AllowOriginsRefresh is how often AllowOriginsProvider is called. Default
+	// value is one minute.
+	AllowOriginsRefresh time.Duration
+
+	// AllowOriginsLogger is called with the errors and panics of
+	// AllowOriginsProvider, which are ignored by default.
+	AllowOriginsLogger func(err error)
+
 	// AllowedMethods is a list of methods the client is allowed to use with
-	// cross-domain requests. Default value is simple methods (GET and POST)
+	// cross-domain requests. Simple methods (GET, HEAD and POST) are always
+	// allowed. Methods are matched case-insensitively.
 	AllowedMethods []string
 
 	// AllowedHeaders is list of non simple headers the client is allowed to use with
 	// cross-domain requests.
 	// If the special "*" value is present in the list, all headers will be allowed.
+	// Header names are matched case-insensitively.
 	// Default value is [] but "Origin" is always appended to the list.
 	AllowedHeaders []string
 
 	// ExposedHeaders indicates which headers are safe to expose to the API of a CORS
-	// API specification
+	// API specification. If the special "*" value is present in the list, all
+	// headers are exposed, which cannot be combined with AllowCredentials.
 	ExposedHeaders []string
 
 	// AllowCredentials indicates whether the request can include user credentials like
-	// cookies, HTTP authentication or client side SSL certificates.
+	// cookies, HTTP authentication or client side SSL certificates. As "*" is
+	// then not a wildcard, the origin and requested headers are reflected
+	// instead, and ExposedHeaders must not be "*".
 	AllowCredentials bool
 
 	// MaxAge indicates how long (in seconds) the results of a preflight request
 	// can be cached
 	MaxAge time.Duration
+
+	// AllowPrivateNetwork answers the preflight requests of public pages to
+	// private network addresses, which have an
+	// Access-Control-Request-Private-Network header. They are denied otherwise.
+	AllowPrivateNetwork bool
+
+	// PreflightStatus is the status of the successful preflight responses.
+	// Default value is 200 OK, some clients expect 204 No Content.
+	PreflightStatus int
+
+	// PassThroughPreflight lets the next handlers answer the preflight requests
+	// instead of aborting them once the CORS headers are set.
+	PassThroughPreflight bool
 }
 
 func (c *Config) AddAllowedMethods(methods ...string) {
@@ -59,18 +110,28 @@ func (c *Config) AddExposedHeaders(headers ...string) {
 }
 
 func (c Config) Validate() error {
-	if c.AllowAllOrigins && (c.AllowOriginFunc != nil || len(c.AllowedOrigins) > 0) {
-		return errors.New("conflict settings: all origins are allowed. AllowOriginFunc or AllowedOrigins is not needed")
+	hasOrigins := len(c.AllowedOrigins) > 0 || len(c.AllowedOriginRegexps) > 0 || c.AllowOriginsProvider != nil
+	hasFuncs := c.AllowOriginFunc != nil || c.AllowOriginWithContext != nil
+	if c.AllowAllOrigins && (hasFuncs || hasOrigins) {
+		return errors.New("conflict settings: all origins are allowed. AllowOriginFunc, AllowOriginWithContext, AllowedOrigins, AllowedOriginRegexps or AllowOriginsProvider is not needed")
 	}
-	if !c.AllowAllOrigins && c.AllowOriginFunc == nil && len(c.AllowedOrigins) == 0 {
+	if !c.AllowAllOrigins && !hasFuncs && !hasOrigins {
 		return errors.New("conflict settings: all origins disabled")
 	}
-	if c.AllowOriginFunc != nil && len(c.AllowedOrigins) > 0 {
-		return errors.New("conflict settings: if a allow origin func is provided, AllowedOrigins is not needed")
-	}
 	for _, origin := range c.AllowedOrigins {
-		if !strings.HasPrefix(origin, "http://") && !strings.HasPrefix(origin, "https://") {
-			return errors.New("bad origin: origins must include http:// or https://")
+		if err := checkOrigin(origin, c.AllowCustomSchemes); err != nil {
+			return err
+		}
+	}
+	if c.PreflightStatus != 0 && (c.PreflightStatus < 200 || c.PreflightStatus > 299) {
+		return errors.New("bad preflight status: browsers only accept 2xx statuses")
+	}
+	if c.AllowCredentials && contains(c.ExposedHeaders, "*") {
+		return errors.New("conflict settings: ExposedHeaders \"*\" is not a wildcard when AllowCredentials is set")
+	}
+	for _, expr := range c.AllowedOriginRegexps {
+		if _, err := regexp.Compile(expr); err != nil {
+			return errors.New("bad origin regexp: " + err.Error())
 		}
 	}
 	return nil
@@ -96,44 +157,110 @@ func Default() gin.HandlerFunc {
 }
 
 func New(config Config) gin.HandlerFunc {
-	s := newSettings(config)
+	return newSettings(config).handle
+}
 
-	// Algorithm based in http://www.html5rocks.com/static/images/cors_server_flowchart.png
-	return func(c *gin.Context) {
-		origin := c.Request.Header.Get("Origin")
-		if len(origin) == 0 {
-			return
+// Policy is a CORS configuration for the routes under a path prefix.
+type Policy struct {
+	// Prefix matches the paths equal to it or starting with it followed by a
+	// slash, "/api" matches "/api" and "/api/users" but not "/apis".
+	Prefix string
+	Config Config
+}
+
+// NewWithPolicies is like New but applies to each request the policy with the
+// longest prefix matching its path, if any, instead of config. Registered on
+// the engine, it also answers the preflight requests of routes without an
+// OPTIONS handler, which a middleware registered on a route group cannot do.
+func NewWithPolicies(config Config, policies ...Policy) gin.HandlerFunc {
+	global := newSettings(config)
+	prefixes := make([]string, len(policies))
+	byPrefix := make(map[string]*settings, len(policies))
+	for i, policy := range policies {
+		prefix := strings.TrimSuffix(policy.Prefix, "/")
+		if _, found := byPrefix[prefix]; found {
+			panic("conflict settings: several policies for the prefix " + policy.Prefix)
 		}
-		origin, valid := s.validateOrigin(origin)
-		if valid {
-			if c.Request.Method == "OPTIONS" {
-				valid = handlePreflight(c, s)
-			} else {
-				valid = handleNormal(c, s)
+		prefixes[i] = prefix
+		byPrefix[prefix] = newSettings(policy.Config)
+	}
+	sort.Slice(prefixes, func(i, j int) bool { return len(prefixes[i]) > len(prefixes[j]) })
+
+	return func(c *gin.Context) {
+		path := c.Request.URL.Path
+		for _, prefix := range prefixes {
+			if path == prefix || strings.HasPrefix(path, prefix+"/") {
+				byPrefix[prefix].handle(c)
+				return
 			}
 		}
+		global.handle(c)
+	}
+}
 
-		if !valid {
-			if config.AbortOnError {
-				c.AbortWithStatus(http.StatusForbidden)
-			}
-			return
+// Algorithm based in http://www.html5rocks.com/static/images/cors_server_flowchart.png
+func (s *settings) handle(c *gin.Context) {
+	// Responses without CORS headers must not be served by caches to
+	// the requests with an origin either.
+	if s.varyOrigin() {
+		addVary(c.Writer.Header(), "Origin")
+	}
+	origin := c.Request.Header.Get("Origin")
+	if len(origin) == 0 {
+		return
+	}
+	preflight := c.Request.Method == "OPTIONS"
+	if preflight {
+		// Private network requests are denied unless allowed, which also
+		// depends on the request.
+		addVary(c.Writer.Header(), "Access-Control-Request-Method", "Access-Control-Request-Headers",
+			"Access-Control-Request-Private-Network")
+	}
+	origin, valid := s.validateOrigin(c, origin)
+	if valid {
+		if preflight {
+			valid = handlePreflight(c, s)
+		} else {
+			valid = handleNormal(c, s)
 		}
-		c.Header("Access-Control-Allow-Origin", origin)
+	}
+
+	if !valid {
+		if s.abortOnError {
+			c.AbortWithStatus(http.StatusForbidden)
+		}
+		return
+	}
+	c.Header("Access-Control-Allow-Origin", origin)
+	if preflight && !s.passThroughPreflight {
+		c.AbortWithStatus(s.preflightStatus)
 	}
 }
 
+// handlePreflight checks the method and headers requested by a preflight
+// request, and sets the preflight headers if they are allowed. Nothing is
+// written otherwise.
 func handlePreflight(c *gin.Context, s *settings) bool {
-	c.AbortWithStatus(200)
 	if !s.validateMethod(c.Request.Header.Get("Access-Control-Request-Method")) {
 		return false
 	}
-	if !s.validateHeader(c.Request.Header.Get("Access-Control-Request-Header")) {
+	if !s.validateHeader(c.Request.Header.Get("Access-Control-Request-Headers")) {
+		return false
+	}
+	privateNetwork := c.Request.Header.Get("Access-Control-Request-Private-Network") == "true"
+	if privateNetwork && !s.allowPrivateNetwork {
 		return false
 	}
 	for key, value := range s.preflightHeaders {
 		c.Writer.Header()[key] = value
 	}
+	// Reflected, as "*" is not a wildcard with credentials.
+	if headers := c.Request.Header.Get("Access-Control-Request-Headers"); s.allowAllHeaders && len(headers) > 0 {
+		c.Header("Access-Control-Allow-Headers", headers)
+	}
+	if privateNetwork {
+		c.Header("Access-Control-Allow-Private-Network", "true")
+	}
 	return true
 }
 
@@ -1,9 +1,12 @@
 package cors
 
 import (
+	"errors"
 	"net/http"
 	"net/http/httptest"
+	"sync"
 	"testing"
+	"time"
 
 	"github.com/gin-gonic/gin"
 	"github.com/stretchr/testify/assert"
@@ -32,13 +35,36 @@ func TestBadConfig(t *testing.T) {
 	})
 	assert.Panics(t, func() {
 		New(Config{
-			AllowedOrigins:  []string{"http://google.com"},
-			AllowOriginFunc: func(origin string) bool { return false },
+			AllowedOrigins: []string{"google.com"},
 		})
 	})
 	assert.Panics(t, func() {
 		New(Config{
-			AllowedOrigins: []string{"google.com"},
+			AllowedOrigins: []string{"chrome-extension://abcdef"},
+		})
+	})
+	assert.Panics(t, func() {
+		New(Config{
+			AllowedOriginRegexps: []string{"https://(.*"},
+		})
+	})
+	assert.Panics(t, func() {
+		New(Config{
+			AllowAllOrigins:  true,
+			AllowCredentials: true,
+			ExposedHeaders:   []string{"*"},
+		})
+	})
+	assert.Panics(t, func() {
+		New(Config{
+			AllowAllOrigins: true,
+			PreflightStatus: http.StatusMultipleChoices,
+		})
+	})
+	assert.Panics(t, func() {
+		New(Config{
+			AllowCustomSchemes: true,
+			AllowedOrigins:     []string{"//google.com"},
 		})
 	})
 }
@@ -102,3 +128,420 @@ func TestPasses1(t *testing.T) {
 func TestPasses2(t *testing.T) {
 
 }
+
+func performPreflight(r http.Handler, origin, method, headers string) *httptest.ResponseRecorder {
+	req, _ := http.NewRequest("OPTIONS", "/", nil)
+	req.Header.Set("Origin", origin)
+	req.Header.Set("Access-Control-Request-Method", method)
+	if len(headers) > 0 {
+		req.Header.Set("Access-Control-Request-Headers", headers)
+	}
+	w := httptest.NewRecorder()
+	r.ServeHTTP(w, req)
+	return w
+}
+
+func TestPreflight(t *testing.T) {
+	router := gin.New()
+	router.Use(New(Config{
+		AbortOnError:   true,
+		AllowedOrigins: []string{"http://example.com"},
+		AllowedMethods: []string{"put", "DELETE"},
+		AllowedHeaders: []string{"Content-Type", "x-requested-with"},
+	}))
+
+	w := performPreflight(router, "http://example.com", "PUT", "content-type, X-Requested-With")
+	assert.Equal(t, http.StatusOK, w.Code)
+	assert.Equal(t, "http://example.com", w.Header().Get("Access-Control-Allow-Origin"))
+	assert.Equal(t, "put, DELETE", w.Header().Get("Access-Control-Allow-Methods"))
+
+	w = performPreflight(router, "http://example.com", "GET", "")
+	assert.Equal(t, http.StatusOK, w.Code)
+
+	w = performPreflight(router, "http://example.com", "PATCH", "")
+	assert.Equal(t, http.StatusForbidden, w.Code)
+	assert.Empty(t, w.Header().Get("Access-Control-Allow-Origin"))
+
+	w = performPreflight(router, "http://example.com", "PUT", "Content-Type, Authorization")
+	assert.Equal(t, http.StatusForbidden, w.Code)
+	assert.Empty(t, w.Header().Get("Access-Control-Allow-Methods"))
+
+	w = performPreflight(router, "http://example.com", "", "")
+	assert.Equal(t, http.StatusForbidden, w.Code)
+}
+
+func TestPreflightAllHeaders(t *testing.T) {
+	router := gin.New()
+	router.Use(New(Config{
+		AllowAllOrigins: true,
+		AllowedMethods:  []string{"PUT"},
+		AllowedHeaders:  []string{"*"},
+	}))
+
+	w := performPreflight(router, "http://example.com", "PUT", "Authorization, X-Custom")
+	assert.Equal(t, http.StatusOK, w.Code)
+	assert.Equal(t, "*", w.Header().Get("Access-Control-Allow-Origin"))
+}
+
+func TestPreflightDenied(t *testing.T) {
+	called := false
+
+	router := gin.New()
+	router.Use(New(Config{
+		AllowAllOrigins: true,
+		AllowedHeaders:  []string{"Content-Type"},
+	}))
+	router.OPTIONS("/", func(c *gin.Context) {
+		called = true
+	})
+
+	w := performPreflight(router, "http://example.com", "POST", "Authorization")
+	assert.True(t, called)
+	assert.Empty(t, w.Header().Get("Access-Control-Allow-Origin"))
+	assert.Empty(t, w.Header().Get("Access-Control-Allow-Headers"))
+}
+
+func allowedOrigin(r http.Handler, origin string) string {
+	req, _ := http.NewRequest("GET", "/", nil)
+	req.Header.Set("Origin", origin)
+	w := httptest.NewRecorder()
+	r.ServeHTTP(w, req)
+	return w.Header().Get("Access-Control-Allow-Origin")
+}
+
+func TestOriginPatterns(t *testing.T) {
+	router := gin.New()
+	router.Use(New(Config{
+		AllowedOrigins:       []string{"https://*.example.com", "http://localhost:*", "https://Example.org"},
+		AllowedOriginRegexps: []string{`https://app-\d+\.example\.net`},
+	}))
+	router.GET("/", func(c *gin.Context) {})
+
+	allowed := []string{
+		"https://www.example.com",
+		"https://a.b.example.com",
+		"http://localhost:8080",
+		"https://example.org",
+		"https://app-42.example.net",
+	}
+	for _, origin := range allowed {
+		assert.Equal(t, origin, allowedOrigin(router, origin), origin)
+	}
+	denied := []string{
+		"https://example.com",
+		"http://www.example.com",
+		"https://www.example.com.evil.com",
+		"https://evil.com/.example.com",
+		"http://localhost",
+		"https://app-42.example.net.evil.com",
+		"https://app-x.example.net",
+	}
+	for _, origin := range denied {
+		assert.Empty(t, allowedOrigin(router, origin), origin)
+	}
+}
+
+func TestAllOriginsInList(t *testing.T) {
+	router := gin.New()
+	router.Use(New(Config{AllowedOrigins: []string{"*"}}))
+	router.GET("/", func(c *gin.Context) {})
+
+	assert.Equal(t, "*", allowedOrigin(router, "http://example.com"))
+}
+
+func TestCustomSchemes(t *testing.T) {
+	router := gin.New()
+	router.Use(New(Config{
+		AllowCustomSchemes: true,
+		AllowedOrigins:     []string{"chrome-extension://abcdef", "capacitor://localhost", "https://example.com"},
+	}))
+	router.GET("/", func(c *gin.Context) {})
+
+	assert.Equal(t, "chrome-extension://abcdef", allowedOrigin(router, "chrome-extension://abcdef"))
+	assert.Equal(t, "capacitor://localhost", allowedOrigin(router, "capacitor://localhost"))
+	assert.Empty(t, allowedOrigin(router, "tauri://localhost"))
+}
+
+func TestOriginsAndFunc(t *testing.T) {
+	router := gin.New()
+	router.Use(New(Config{
+		AllowedOrigins:  []string{"http://example.com"},
+		AllowOriginFunc: func(origin string) bool { return origin == "http://example.org" },
+	}))
+	router.GET("/", func(c *gin.Context) {})
+
+	assert.Equal(t, "http://example.com", allowedOrigin(router, "http://example.com"))
+	assert.Equal(t, "http://example.org", allowedOrigin(router, "http://example.org"))
+	assert.Empty(t, allowedOrigin(router, "http://example.net"))
+}
+
+func TestVary(t *testing.T) {
+	router := gin.New()
+	router.Use(New(Config{
+		AllowedOrigins: []string{"http://example.com"},
+		AllowedMethods: []string{"PUT"},
+	}))
+	router.GET("/", func(c *gin.Context) {
+		c.Writer.Header().Add("Vary", "Accept-Encoding")
+	})
+
+	w := performRequest(router, "GET", "/")
+	assert.Equal(t, []string{"Origin", "Accept-Encoding"}, w.Header()["Vary"])
+
+	req, _ := http.NewRequest("GET", "/", nil)
+	req.Header.Set("Origin", "http://example.org")
+	w = httptest.NewRecorder()
+	router.ServeHTTP(w, req)
+	assert.Equal(t, []string{"Origin", "Accept-Encoding"}, w.Header()["Vary"])
+
+	w = performPreflight(router, "http://example.com", "PUT", "")
+	assert.Equal(t, []string{"Origin", "Access-Control-Request-Method", "Access-Control-Request-Headers",
+		"Access-Control-Request-Private-Network"}, w.Header()["Vary"])
+}
+
+func TestVaryAllOrigins(t *testing.T) {
+	router := gin.New()
+	router.Use(New(Config{AllowAllOrigins: true}))
+	router.GET("/", func(c *gin.Context) {})
+
+	req, _ := http.NewRequest("GET", "/", nil)
+	req.Header.Set("Origin", "http://example.com")
+	w := httptest.NewRecorder()
+	router.ServeHTTP(w, req)
+	assert.Equal(t, "*", w.Header().Get("Access-Control-Allow-Origin"))
+	assert.Empty(t, w.Header().Get("Vary"))
+}
+
+func TestCredentials(t *testing.T) {
+	router := gin.New()
+	router.Use(New(Config{
+		AllowAllOrigins:  true,
+		AllowCredentials: true,
+		AllowedMethods:   []string{"PUT"},
+		AllowedHeaders:   []string{"*"},
+	}))
+	router.GET("/", func(c *gin.Context) {})
+
+	req, _ := http.NewRequest("GET", "/", nil)
+	req.Header.Set("Origin", "http://example.com")
+	w := httptest.NewRecorder()
+	router.ServeHTTP(w, req)
+	assert.Equal(t, "http://example.com", w.Header().Get("Access-Control-Allow-Origin"))
+	assert.Equal(t, "true", w.Header().Get("Access-Control-Allow-Credentials"))
+	assert.Equal(t, "Origin", w.Header().Get("Vary"))
+
+	w = performPreflight(router, "http://example.com", "PUT", "X-Custom, Authorization")
+	assert.Equal(t, "http://example.com", w.Header().Get("Access-Control-Allow-Origin"))
+	assert.Equal(t, "X-Custom, Authorization", w.Header().Get("Access-Control-Allow-Headers"))
+}
+
+func TestAllowOriginWithContext(t *testing.T) {
+	router := gin.New()
+	router.Use(func(c *gin.Context) {
+		c.Set("tenant", c.Request.Header.Get("X-Tenant"))
+	})
+	router.Use(New(Config{
+		AllowOriginWithContext: func(c *gin.Context, origin string) bool {
+			return origin == "https://"+c.GetString("tenant")+".example.com"
+		},
+	}))
+	router.GET("/", func(c *gin.Context) {})
+
+	request := func(tenant, origin string) string {
+		req, _ := http.NewRequest("GET", "/", nil)
+		req.Header.Set("Origin", origin)
+		req.Header.Set("X-Tenant", tenant)
+		w := httptest.NewRecorder()
+		router.ServeHTTP(w, req)
+		return w.Header().Get("Access-Control-Allow-Origin")
+	}
+	assert.Equal(t, "https://acme.example.com", request("acme", "https://acme.example.com"))
+	assert.Empty(t, request("other", "https://acme.example.com"))
+}
+
+func TestPolicies(t *testing.T) {
+	router := gin.New()
+	router.Use(NewWithPolicies(Config{
+		AllowedOrigins: []string{"http://example.com"},
+	}, Policy{
+		Prefix: "/api/",
+		Config: Config{
+			AbortOnError:   true,
+			AllowedOrigins: []string{"http://api.example.com"},
+			AllowedMethods: []string{"DELETE"},
+		},
+	}))
+	router.GET("/", func(c *gin.Context) {})
+	router.GET("/apis", func(c *gin.Context) {})
+	api := router.Group("/api")
+	api.GET("/users", func(c *gin.Context) {})
+	api.DELETE("/users", func(c *gin.Context) {})
+
+	request := func(path string) *httptest.ResponseRecorder {
+		req, _ := http.NewRequest("GET", path, nil)
+		req.Header.Set("Origin", "http://example.com")
+		w := httptest.NewRecorder()
+		router.ServeHTTP(w, req)
+		return w
+	}
+	assert.Equal(t, "http://example.com", request("/").Header().Get("Access-Control-Allow-Origin"))
+	assert.Equal(t, "http://example.com", request("/apis").Header().Get("Access-Control-Allow-Origin"))
+	assert.Equal(t, http.StatusForbidden, request("/api/users").Code)
+
+	req, _ := http.NewRequest("OPTIONS", "/api/users", nil)
+	req.Header.Set("Origin", "http://api.example.com")
+	req.Header.Set("Access-Control-Request-Method", "DELETE")
+	w := httptest.NewRecorder()
+	router.ServeHTTP(w, req)
+	assert.Equal(t, http.StatusOK, w.Code)
+	assert.Equal(t, "http://api.example.com", w.Header().Get("Access-Control-Allow-Origin"))
+	assert.Equal(t, "DELETE", w.Header().Get("Access-Control-Allow-Methods"))
+
+	assert.Panics(t, func() {
+		NewWithPolicies(Config{AllowAllOrigins: true},
+			Policy{Prefix: "/api", Config: Config{AllowAllOrigins: true}},
+			Policy{Prefix: "/api/", Config: Config{AllowAllOrigins: true}})
+	})
+}
+
+func TestAllowOriginsProvider(t *testing.T) {
+	var mu sync.Mutex
+	origins := []string{"http://example.com", "bad"}
+	var err error
+	panics := false
+	var logged []error
+	router := gin.New()
+	router.Use(New(Config{
+		AllowOriginsProvider: func() ([]string, error) {
+			mu.Lock()
+			defer mu.Unlock()
+			if panics {
+				panic("boom")
+			}
+			return origins, err
+		},
+		AllowOriginsRefresh: 10 * time.Millisecond,
+		AllowOriginsLogger: func(err error) {
+			mu.Lock()
+			defer mu.Unlock()
+			logged = append(logged, err)
+		},
+	}))
+	router.GET("/", func(c *gin.Context) {})
+
+	assert.Equal(t, "http://example.com", allowedOrigin(router, "http://example.com"))
+	assert.Empty(t, allowedOrigin(router, "bad"))
+
+	// Refreshed in the background.
+	mu.Lock()
+	origins = []string{"http://*.example.org"}
+	mu.Unlock()
+	eventually := func(origin, expected string) {
+		for deadline := time.Now().Add(5 * time.Second); allowedOrigin(router, origin) != expected; {
+			if time.Now().After(deadline) {
+				t.Fatalf("Expected %q for %s", expected, origin)
+			}
+			time.Sleep(5 * time.Millisecond)
+		}
+	}
+	eventually("http://www.example.org", "http://www.example.org")
+	assert.Empty(t, allowedOrigin(router, "http://example.com"))
+
+	// Kept when the provider fails or panics, which is logged.
+	failed := func(message string) {
+		for deadline := time.Now().Add(5 * time.Second); ; {
+			assert.Equal(t, "http://www.example.org", allowedOrigin(router, "http://www.example.org"))
+			mu.Lock()
+			n := len(logged)
+			last := ""
+			if n > 0 {
+				last = logged[n-1].Error()
+			}
+			mu.Unlock()
+			if last == message {
+				return
+			}
+			if time.Now().After(deadline) {
+				t.Fatalf("Expected %q to be logged, got %q", message, last)
+			}
+			time.Sleep(5 * time.Millisecond)
+		}
+	}
+	mu.Lock()
+	origins, err = nil, errors.New("unavailable")
+	mu.Unlock()
+	failed("unavailable")
+	mu.Lock()
+	panics = true
+	mu.Unlock()
+	failed("cors: AllowOriginsProvider panicked: boom")
+
+	// Refreshes go on after a panic.
+	mu.Lock()
+	panics, origins, err = false, []string{"http://example.net"}, nil
+	mu.Unlock()
+	eventually("http://example.net", "http://example.net")
+}
+
+func TestPrivateNetwork(t *testing.T) {
+	config := Config{AbortOnError: true, AllowAllOrigins: true}
+	preflight := func(config Config) *httptest.ResponseRecorder {
+		router := gin.New()
+		router.Use(New(config))
+		req, _ := http.NewRequest("OPTIONS", "/", nil)
+		req.Header.Set("Origin", "https://example.com")
+		req.Header.Set("Access-Control-Request-Method", "GET")
+		req.Header.Set("Access-Control-Request-Private-Network", "true")
+		w := httptest.NewRecorder()
+		router.ServeHTTP(w, req)
+		return w
+	}
+
+	w := preflight(config)
+	assert.Equal(t, http.StatusForbidden, w.Code)
+	assert.Empty(t, w.Header().Get("Access-Control-Allow-Private-Network"))
+	assert.Contains(t, w.Header()["Vary"], "Access-Control-Request-Private-Network")
+
+	config.AllowPrivateNetwork = true
+	w = preflight(config)
+	assert.Equal(t, http.StatusOK, w.Code)
+	assert.Equal(t, "true", w.Header().Get("Access-Control-Allow-Private-Network"))
+	assert.Contains(t, w.Header()["Vary"], "Access-Control-Request-Private-Network")
+}
+
+func TestPreflightStatus(t *testing.T) {
+	router := gin.New()
+	router.Use(New(Config{AllowAllOrigins: true, PreflightStatus: http.StatusNoContent}))
+
+	w := performPreflight(router, "http://example.com", "GET", "")
+	assert.Equal(t, http.StatusNoContent, w.Code)
+	assert.Equal(t, "*", w.Header().Get("Access-Control-Allow-Origin"))
+}
+
+func TestPassThroughPreflight(t *testing.T) {
+	called := false
+
+	router := gin.New()
+	router.Use(New(Config{AllowAllOrigins: true, PassThroughPreflight: true}))
+	router.OPTIONS("/", func(c *gin.Context) {
+		called = true
+		c.Status(http.StatusAccepted)
+	})
+
+	w := performPreflight(router, "http://example.com", "GET", "")
+	assert.True(t, called)
+	assert.Equal(t, http.StatusAccepted, w.Code)
+	assert.Equal(t, "*", w.Header().Get("Access-Control-Allow-Origin"))
+}
+
+func TestExposeAllHeaders(t *testing.T) {
+	router := gin.New()
+	router.Use(New(Config{AllowAllOrigins: true, ExposedHeaders: []string{"X-Total", "*"}}))
+	router.GET("/", func(c *gin.Context) {})
+
+	req, _ := http.NewRequest("GET", "/", nil)
+	req.Header.Set("Origin", "http://example.com")
+	w := httptest.NewRecorder()
+	router.ServeHTTP(w, req)
+	assert.Equal(t, "*", w.Header().Get("Access-Control-Expose-Headers"))
+}
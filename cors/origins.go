@@ -0,0 +1,87 @@
+package cors
+
+import (
+	"fmt"
+	"regexp"
+	"sync"
+	"time"
+)
+
+const defaultOriginsRefresh = time.Minute
+
+// originList is a list of allowed origins loaded from a provider, reloaded in
+// the background once it is older than interval.
+type originList struct {
+	provider      func() ([]string, error)
+	interval      time.Duration
+	customSchemes bool
+	logger        func(err error)
+
+	mu         sync.RWMutex
+	origins    []string
+	patterns   []*regexp.Regexp
+	loaded     time.Time
+	refreshing bool
+}
+
+func newOriginList(provider func() ([]string, error), interval time.Duration, customSchemes bool, logger func(err error)) *originList {
+	if interval <= 0 {
+		interval = defaultOriginsRefresh
+	}
+	l := &originList{provider: provider, interval: interval, customSchemes: customSchemes, logger: logger}
+	l.refresh()
+	return l
+}
+
+// allowed reports whether origin is in the list, starting a refresh if it is
+// stale. The current list is used meanwhile.
+func (l *originList) allowed(origin string) bool {
+	l.mu.RLock()
+	origins, patterns := l.origins, l.patterns
+	stale := !l.refreshing && time.Since(l.loaded) >= l.interval
+	l.mu.RUnlock()
+
+	if stale {
+		l.mu.Lock()
+		if !l.refreshing && time.Since(l.loaded) >= l.interval {
+			l.refreshing = true
+			go l.refresh()
+		}
+		l.mu.Unlock()
+	}
+	return matchOrigin(origins, patterns, origin)
+}
+
+// refresh reloads the list, keeping the previous one if the provider fails
+// or panics. Either way, the next refresh is due after interval.
+func (l *originList) refresh() {
+	list, err := l.load()
+	if err != nil && l.logger != nil {
+		l.logger(err)
+	}
+	var valid []string
+	for _, origin := range list {
+		if origin != "*" && checkOrigin(origin, l.customSchemes) == nil {
+			valid = append(valid, origin)
+		}
+	}
+	origins, patterns := compileOrigins(valid)
+
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	l.refreshing = false
+	l.loaded = time.Now()
+	if err == nil {
+		l.origins, l.patterns = origins, patterns
+	}
+}
+
+// load calls the provider, turning a panic into an error.
+func (l *originList) load() (list []string, err error) {
+	defer func() {
+		if r := recover(); r != nil {
+			list, err = nil, fmt.Errorf("cors: AllowOriginsProvider panicked: %v", r)
+		}
+	}()
+	return l.provider()
+}